@@ -10,3 +10,13 @@ func hash256(m []byte) []byte {
 	h.Write(m)
 	return h.Sum(nil)
 }
+
+// trieHash is the SHA-256 hash function of a trie, which hashes the
+// concatenation of its inputs.
+func trieHash(data ...[]byte) []byte {
+	h := sha256.New()
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
@@ -2,30 +2,61 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
 	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/dashevo/universe-tree-db/universe"
+	"github.com/dashevo/universe-tree-db/verify"
+	"github.com/golang/protobuf/proto"
 	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
 )
 
 // Note: This gRPC client is for example purposes and is only intended to
 // demonstrate example usage of the server. It is not meant to be used for
 // production use.
 
+var (
+	tlsEnabled    = flag.Bool("tls", false, "connect w/TLS, implied by the other TLS flags")
+	tlsCA         = flag.String("ca", "", "CA `file` to verify the server certificate w/instead of the system CAs")
+	tlsCert       = flag.String("cert", "", "client certificate `file` for mutual TLS")
+	tlsKey        = flag.String("key", "", "client key `file` for mutual TLS")
+	tlsServerName = flag.String("server-name", "", "`name` to verify the server certificate for, defaults to the host connected to")
+	token         = flag.String("token", os.Getenv("UNIDB_TOKEN"), "bearer `token` to authenticate w/, defaults to $UNIDB_TOKEN")
+)
+
 func main() {
 	flag.Parse()
 	if flag.NArg() < 1 {
-		fmt.Fprintln(os.Stderr, "missing subcommand: list, create, drop, sync, update, commit, get, stash, revert, merkleproof, merkleproofcompressed, merkleproofr, merkleproofcompressedr")
+		fmt.Fprintln(os.Stderr, "missing subcommand: list, create, fork, rename, drop, drops, sync, autocommit, update, multiupdate, commit, get, batchget, stash, revert, merkleproof, merkleproofcompressed, merkleproofr, merkleproofcompressedr, batchproof, versions, revertversion, iterate, diff, export, import, watch, health")
 		os.Exit(1)
 	}
 
 	// Get connection addr from env or use default
 	strConnect := srvConnAddr()
 
-	conn, err := grpc.Dial(strConnect, grpc.WithInsecure())
+	dialOpt, err := transportOption()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "could not set up TLS: %v\n", err)
+		os.Exit(1)
+	}
+	dialOpts := []grpc.DialOption{dialOpt}
+	if *token != "" {
+		dialOpts = append(dialOpts, grpc.WithPerRPCCredentials(bearerToken(*token)))
+	}
+	conn, err := grpc.Dial(strConnect, dialOpts...)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "could not connect to backend: %v\n", err)
 		os.Exit(1)
@@ -37,18 +68,60 @@ func main() {
 		err = listTrees(context.Background(), client)
 	case "create":
 		if flag.NArg() < 2 {
-			fmt.Fprintln(os.Stderr, "usage: create <name>")
+			fmt.Fprintln(os.Stderr, "usage: create <name> [sha256|blake2b|keccak256]")
+			os.Exit(1)
+		}
+		hashAlgorithm := "sha256"
+		if flag.NArg() >= 3 {
+			hashAlgorithm = flag.Arg(2)
+		}
+		err = createTree(context.Background(), client, flag.Arg(1), hashAlgorithm)
+	case "fork":
+		if flag.NArg() < 3 {
+			fmt.Fprintln(os.Stderr, "usage: fork <name> <source-treename> [version]")
+			os.Exit(1)
+		}
+		var version uint64
+		if flag.NArg() >= 4 {
+			version, err = strconv.ParseUint(flag.Arg(3), 10, 64)
+			if err != nil {
+				break
+			}
+		}
+		err = forkTree(context.Background(), client, flag.Arg(1), flag.Arg(2), version)
+	case "rename":
+		if flag.NArg() < 3 {
+			fmt.Fprintln(os.Stderr, "usage: rename <treename> <new-name>")
 			os.Exit(1)
 		}
-		err = createTree(context.Background(), client, flag.Arg(1))
+		err = renameTree(context.Background(), client, flag.Arg(1), flag.Arg(2))
 	case "drop":
 		if flag.NArg() < 2 {
 			fmt.Fprintln(os.Stderr, "usage: drop <name>")
 			os.Exit(1)
 		}
 		err = dropTree(context.Background(), client, flag.Arg(1))
+	case "drops":
+		err = listDrops(context.Background(), client)
 	case "sync":
 		err = syncMeta(context.Background(), client)
+	case "autocommit":
+		if flag.NArg() < 2 {
+			fmt.Fprintln(os.Stderr, "usage: autocommit <treename> [<updates> [<seconds> [<memory-bytes>]]]")
+			os.Exit(1)
+		}
+		var limits [3]uint64
+		for i := range limits {
+			if flag.NArg() < i+3 {
+				break
+			}
+			limits[i], err = strconv.ParseUint(flag.Arg(i+2), 10, 64)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "invalid limit %v: %v\n", flag.Arg(i+2), err)
+				os.Exit(1)
+			}
+		}
+		err = setAutoCommit(context.Background(), client, flag.Arg(1), limits[0], limits[1], limits[2])
 	case "update":
 		if flag.NArg() < 4 {
 			fmt.Fprintln(os.Stderr, "usage: update <treename> <key-str> <val-str> [1=atomic]")
@@ -59,6 +132,12 @@ func main() {
 			atomicUpdate = true
 		}
 		err = update(context.Background(), client, flag.Arg(1), flag.Arg(2), flag.Arg(3), atomicUpdate)
+	case "multiupdate":
+		if flag.NArg() < 4 || (flag.NArg()-1)%3 != 0 {
+			fmt.Fprintln(os.Stderr, "usage: multiupdate <treename> <key-str> <val-str> [<treename> <key-str> <val-str> ...]")
+			os.Exit(1)
+		}
+		err = multiUpdate(context.Background(), client, flag.Args()[1:])
 	case "commit":
 		if flag.NArg() < 2 {
 			fmt.Fprintln(os.Stderr, "usage: commit <treename>")
@@ -67,10 +146,23 @@ func main() {
 		err = commit(context.Background(), client, flag.Arg(1))
 	case "get":
 		if flag.NArg() < 3 {
-			fmt.Fprintln(os.Stderr, "usage: get <treename> <key-str>")
+			fmt.Fprintln(os.Stderr, "usage: get <treename> <key-str> [version]")
+			os.Exit(1)
+		}
+		var version uint64
+		if flag.NArg() >= 4 {
+			version, err = strconv.ParseUint(flag.Arg(3), 10, 64)
+			if err != nil {
+				break
+			}
+		}
+		err = get(context.Background(), client, flag.Arg(1), flag.Arg(2), version)
+	case "batchget":
+		if flag.NArg() < 3 {
+			fmt.Fprintln(os.Stderr, "usage: batchget <treename> <key-str> [<key-str>...]")
 			os.Exit(1)
 		}
-		err = get(context.Background(), client, flag.Arg(1), flag.Arg(2))
+		err = batchGet(context.Background(), client, flag.Arg(1), flag.Args()[2:])
 	case "stash":
 		if flag.NArg() < 2 {
 			fmt.Fprintln(os.Stderr, "usage: stash <treename> [1=rollbackCache]")
@@ -111,6 +203,89 @@ func main() {
 			os.Exit(1)
 		}
 		err = merkleproofcompressedr(context.Background(), client, flag.Arg(1), flag.Arg(2), flag.Arg(3))
+	case "batchproof":
+		if flag.NArg() < 3 {
+			fmt.Fprintln(os.Stderr, "usage: batchproof <treename> <key-str> [<key-str>...]")
+			os.Exit(1)
+		}
+		err = batchMerkleProof(context.Background(), client, flag.Arg(1), flag.Args()[2:])
+	case "versions":
+		if flag.NArg() < 2 {
+			fmt.Fprintln(os.Stderr, "usage: versions <treename>")
+			os.Exit(1)
+		}
+		err = listVersions(context.Background(), client, flag.Arg(1))
+	case "revertversion":
+		if flag.NArg() < 3 {
+			fmt.Fprintln(os.Stderr, "usage: revertversion <treename> <version>")
+			os.Exit(1)
+		}
+		var version uint64
+		version, err = strconv.ParseUint(flag.Arg(2), 10, 64)
+		if err != nil {
+			break
+		}
+		err = revertVersion(context.Background(), client, flag.Arg(1), version)
+	case "iterate":
+		if flag.NArg() < 2 {
+			fmt.Fprintln(os.Stderr, "usage: iterate <treename> [version]")
+			os.Exit(1)
+		}
+		var version uint64
+		if flag.NArg() >= 3 {
+			version, err = strconv.ParseUint(flag.Arg(2), 10, 64)
+			if err != nil {
+				break
+			}
+		}
+		err = iterate(context.Background(), client, flag.Arg(1), version)
+	case "diff":
+		if flag.NArg() < 3 {
+			fmt.Fprintln(os.Stderr, "usage: diff <treename> <from-version> [to-version]")
+			os.Exit(1)
+		}
+		var from, to uint64
+		from, err = strconv.ParseUint(flag.Arg(2), 10, 64)
+		if err != nil {
+			break
+		}
+		if flag.NArg() >= 4 {
+			to, err = strconv.ParseUint(flag.Arg(3), 10, 64)
+			if err != nil {
+				break
+			}
+		}
+		err = diff(context.Background(), client, flag.Arg(1), from, to)
+	case "export":
+		if flag.NArg() < 3 {
+			fmt.Fprintln(os.Stderr, "usage: export <treename> <file> [version]")
+			os.Exit(1)
+		}
+		var version uint64
+		if flag.NArg() >= 4 {
+			version, err = strconv.ParseUint(flag.Arg(3), 10, 64)
+			if err != nil {
+				break
+			}
+		}
+		err = exportTree(context.Background(), client, flag.Arg(1), flag.Arg(2), version)
+	case "import":
+		if flag.NArg() < 2 {
+			fmt.Fprintln(os.Stderr, "usage: import <file> [treename]")
+			os.Exit(1)
+		}
+		err = importTree(context.Background(), client, flag.Arg(1), flag.Arg(2))
+	case "watch":
+		var from uint64
+		if flag.NArg() >= 3 {
+			from, err = strconv.ParseUint(flag.Arg(2), 10, 64)
+			if err != nil {
+				break
+			}
+		}
+		err = watch(context.Background(), client, flag.Arg(1), from)
+	case "health":
+		err = checkHealth(context.Background(), healthpb.NewHealthClient(conn), flag.Arg(1))
 	default:
 		err = fmt.Errorf("unknown subcommand %s", cmd)
 	}
@@ -128,16 +303,22 @@ func listTrees(ctx context.Context, client universe.UniTreeDBClient) error {
 
 	fmt.Printf("Got %d trees\n", len(resp.GetList()))
 	for _, t := range resp.GetList() {
-		fmt.Printf("\tname: %s, root: %x, height: %d, loadDbCounter: %d, loadCacheCounter: %d, cacheHeightLimit: %d\n", t.Name, t.Root, t.TrieHeight, t.LoadDbCounter, t.LoadCacheCounter, t.CacheHeightLimit)
+		fmt.Printf("\tname: %s, root: %x, height: %d, loadDbCounter: %d, loadCacheCounter: %d, cacheHeightLimit: %d, hashAlgorithm: %v\n", t.Name, t.Root, t.TrieHeight, t.LoadDbCounter, t.LoadCacheCounter, t.CacheHeightLimit, t.HashAlgorithm)
 	}
 
 	return nil
 }
 
-func createTree(ctx context.Context, client universe.UniTreeDBClient, name string) error {
+func createTree(ctx context.Context, client universe.UniTreeDBClient, name string, hashAlgorithm string) error {
+	alg, ok := universe.HashAlgorithm_value[strings.ToUpper(hashAlgorithm)]
+	if !ok {
+		return fmt.Errorf("unknown hash algorithm %s", hashAlgorithm)
+	}
+
 	resp, err := client.CreateTree(ctx, &universe.CreateTreeRequest{
 		Name:             name,
 		CacheHeightLimit: 0,
+		HashAlgorithm:    universe.HashAlgorithm(alg),
 	})
 	if err != nil {
 		return err
@@ -149,6 +330,33 @@ func createTree(ctx context.Context, client universe.UniTreeDBClient, name strin
 	return nil
 }
 
+func forkTree(ctx context.Context, client universe.UniTreeDBClient, name, source string, version uint64) error {
+	info, err := client.ForkTree(ctx, &universe.ForkTreeRequest{
+		Name:           name,
+		SourceTreeName: source,
+		SourceVersion:  version,
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("trie %v forked from trie %v at root [%x], %d keys\n", info.GetName(), info.GetForkedFrom(), info.GetForkRoot(), info.GetKeyCount())
+	return nil
+}
+
+func renameTree(ctx context.Context, client universe.UniTreeDBClient, name, newName string) error {
+	info, err := client.RenameTree(ctx, &universe.RenameTreeRequest{
+		TreeName: name,
+		NewName:  newName,
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("trie %v renamed to %v\n", name, info.GetName())
+	return nil
+}
+
 func dropTree(ctx context.Context, client universe.UniTreeDBClient, name string) error {
 	resp, err := client.DropTree(ctx, &universe.DropTreeRequest{Name: name})
 	if err != nil {
@@ -161,6 +369,20 @@ func dropTree(ctx context.Context, client universe.UniTreeDBClient, name string)
 	return nil
 }
 
+func listDrops(ctx context.Context, client universe.UniTreeDBClient) error {
+	resp, err := client.ListDrops(ctx, &universe.Void{})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Got %d drops\n", len(resp.GetList()))
+	for _, d := range resp.GetList() {
+		fmt.Printf("\tname: %s, state: %v, nodesDeleted: %d, nodesShared: %d, error: %s\n", d.Name, d.State, d.NodesDeleted, d.NodesShared, d.Error)
+	}
+
+	return nil
+}
+
 func syncMeta(ctx context.Context, client universe.UniTreeDBClient) error {
 	_, err := client.SyncMeta(ctx, &universe.Void{})
 	if err != nil {
@@ -198,11 +420,40 @@ func update(ctx context.Context, client universe.UniTreeDBClient, treeName, key,
 	return nil
 }
 
-func get(ctx context.Context, client universe.UniTreeDBClient, treeName string, key string) error {
+func multiUpdate(ctx context.Context, client universe.UniTreeDBClient, args []string) error {
+	var updates []*universe.UpdateRequest
+	byTree := make(map[string]*universe.UpdateRequest)
+	for i := 0; i+2 < len(args); i += 3 {
+		treeName := args[i]
+		u, ok := byTree[treeName]
+		if !ok {
+			u = &universe.UpdateRequest{TreeName: treeName, SortPairs: true}
+			byTree[treeName] = u
+			updates = append(updates, u)
+		}
+		u.KeyValuePairs = append(u.KeyValuePairs, &universe.KeyValuePair{
+			Key:   hash256([]byte(args[i+1])),
+			Value: hash256([]byte(args[i+2])),
+		})
+	}
+
+	resp, err := client.MultiUpdate(ctx, &universe.MultiUpdateRequest{Updates: updates})
+	if err != nil {
+		return err
+	}
+
+	for _, r := range resp.GetRoots() {
+		fmt.Printf("trie %v new root: [%x]\n", r.GetTreeName(), r.GetRoot())
+	}
+	return nil
+}
+
+func get(ctx context.Context, client universe.UniTreeDBClient, treeName string, key string, version uint64) error {
 	hashK := hash256([]byte(key))
 	resp, err := client.Get(ctx, &universe.GetRequest{
 		TreeName: treeName,
 		Key:      hashK,
+		Version:  version,
 	})
 	if err != nil {
 		return err
@@ -214,6 +465,52 @@ func get(ctx context.Context, client universe.UniTreeDBClient, treeName string,
 	return nil
 }
 
+func batchGet(ctx context.Context, client universe.UniTreeDBClient, treeName string, keys []string) error {
+	hashKeys := make([][]byte, len(keys))
+	for i, key := range keys {
+		hashKeys[i] = hash256([]byte(key))
+	}
+	resp, err := client.BatchGet(ctx, &universe.BatchGetRequest{
+		TreeName: treeName,
+		Keys:     hashKeys,
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("root: [%x]\n", resp.GetRoot())
+	for i, v := range resp.GetValues() {
+		fmt.Printf("%s: found: %v, val: %x\n", keys[i], v.GetFound(), v.GetValue())
+	}
+
+	return nil
+}
+
+func setAutoCommit(ctx context.Context, client universe.UniTreeDBClient, treeName string, updates, seconds, memoryBytes uint64) error {
+	var policy *universe.AutoCommitPolicy
+	if updates != 0 || seconds != 0 || memoryBytes != 0 {
+		policy = &universe.AutoCommitPolicy{
+			Updates:     updates,
+			Seconds:     seconds,
+			MemoryBytes: memoryBytes,
+		}
+	}
+	info, err := client.SetAutoCommit(ctx, &universe.SetAutoCommitRequest{
+		TreeName:   treeName,
+		AutoCommit: policy,
+	})
+	if err != nil {
+		return err
+	}
+
+	if info.AutoCommit == nil {
+		fmt.Printf("trie %v is no longer committed automatically\n", treeName)
+		return nil
+	}
+	fmt.Printf("trie %v auto commit: updates: %d, seconds: %d, memoryBytes: %d\n", treeName, info.AutoCommit.Updates, info.AutoCommit.Seconds, info.AutoCommit.MemoryBytes)
+	return nil
+}
+
 func commit(ctx context.Context, client universe.UniTreeDBClient, treeName string) error {
 	_, err := client.Commit(ctx, &universe.CommitRequest{TreeName: treeName})
 	if err != nil {
@@ -345,6 +642,220 @@ func merkleproofcompressedr(ctx context.Context, client universe.UniTreeDBClient
 	return nil
 }
 
+func batchMerkleProof(ctx context.Context, client universe.UniTreeDBClient, treeName string, keys []string) error {
+	hashKeys := make([][]byte, len(keys))
+	for i, key := range keys {
+		hashKeys[i] = hash256([]byte(key))
+	}
+	resp, err := client.BatchMerkleProof(ctx, &universe.BatchMerkleProofRequest{
+		TreeName: treeName,
+		Keys:     hashKeys,
+	})
+	if err != nil {
+		return err
+	}
+
+	bp := resp.GetMerkleProof()
+	fmt.Printf("trie %v got batch merkle proof for root [%x], audit path: %d, leaves: %d, size: %d bytes\n", treeName, resp.GetRoot(), len(bp.GetAuditPath()), len(bp.GetLeaves()), proto.Size(bp))
+	if bp.GetHashAlgorithm() != universe.HashAlgorithm_SHA256 {
+		fmt.Printf("not verified, hash algorithm %v\n", bp.GetHashAlgorithm())
+		return nil
+	}
+	values, ok := verify.BatchMerkleProof(resp.GetRoot(), trieHash, hashKeys, bp)
+	if !ok {
+		return fmt.Errorf("batch merkle proof does not verify")
+	}
+	for i, v := range values {
+		fmt.Printf("%s: included: %v, val: %x\n", keys[i], v != nil, v)
+	}
+
+	return nil
+}
+
+func listVersions(ctx context.Context, client universe.UniTreeDBClient, treeName string) error {
+	resp, err := client.ListVersions(ctx, &universe.ListVersionsRequest{TreeName: treeName})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Got %d versions\n", len(resp.GetList()))
+	for _, v := range resp.GetList() {
+		fmt.Printf("\tversion: %d, root: %x, time: %s, keyCount: %d\n", v.Version, v.Root, time.Unix(v.Timestamp, 0).UTC().Format(time.RFC3339), v.KeyCount)
+	}
+
+	return nil
+}
+
+func revertVersion(ctx context.Context, client universe.UniTreeDBClient, treeName string, version uint64) error {
+	v, err := client.RevertToVersion(ctx, &universe.RevertToVersionRequest{
+		TreeName: treeName,
+		Version:  version,
+	})
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("trie %v reverted to version %d, new version %d, root [%x]\n", treeName, version, v.Version, v.Root)
+	return nil
+}
+
+func iterate(ctx context.Context, client universe.UniTreeDBClient, treeName string, version uint64) error {
+	req := &universe.IterateRequest{
+		TreeName: treeName,
+		Version:  version,
+	}
+
+	var count int
+	for {
+		stream, err := client.Iterate(ctx, req)
+		if err != nil {
+			return err
+		}
+		for {
+			resp, err := stream.Recv()
+			if err == io.EOF {
+				fmt.Printf("trie %v has %d keys\n", treeName, count)
+				return nil
+			}
+			if status.Code(err) == codes.Unavailable && len(req.ResumeToken) != 0 {
+				// stream broke, pick up after the last key received
+				fmt.Fprintln(os.Stderr, "resuming after:", err)
+				time.Sleep(time.Second)
+				break
+			}
+			if err != nil {
+				return err
+			}
+			count++
+			req.ResumeToken = resp.GetResumeToken()
+			fmt.Printf("key: [%x], val: [%x]\n", resp.GetKey(), resp.GetValue())
+		}
+	}
+}
+
+func diff(ctx context.Context, client universe.UniTreeDBClient, treeName string, from, to uint64) error {
+	stream, err := client.Diff(ctx, &universe.DiffRequest{
+		TreeName:    treeName,
+		FromVersion: from,
+		ToVersion:   to,
+	})
+	if err != nil {
+		return err
+	}
+
+	var count int
+	for {
+		resp, err := stream.Recv()
+		if err == io.EOF {
+			fmt.Printf("trie %v has %d changed keys\n", treeName, count)
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		count++
+		switch resp.GetChange() {
+		case universe.DiffChange_DIFF_ADDED:
+			fmt.Printf("added key: [%x], val: [%x]\n", resp.GetKey(), resp.GetNewValue())
+		case universe.DiffChange_DIFF_REMOVED:
+			fmt.Printf("removed key: [%x], val: [%x]\n", resp.GetKey(), resp.GetOldValue())
+		default:
+			fmt.Printf("modified key: [%x], old val: [%x], new val: [%x]\n", resp.GetKey(), resp.GetOldValue(), resp.GetNewValue())
+		}
+	}
+}
+
+func watch(ctx context.Context, client universe.UniTreeDBClient, treeName string, from uint64) error {
+	req := &universe.WatchTreeRequest{
+		TreeName:     treeName,
+		FromSequence: from,
+	}
+
+	for {
+		stream, err := client.WatchTree(ctx, req)
+		if err != nil {
+			return err
+		}
+		for {
+			ev, err := stream.Recv()
+			if err == io.EOF {
+				return nil
+			}
+			code := status.Code(err)
+			if (code == codes.Unavailable || code == codes.Aborted) && req.FromSequence != 0 {
+				// stream broke, pick up after the last event received
+				fmt.Fprintln(os.Stderr, "resuming after:", err)
+				time.Sleep(time.Second)
+				break
+			}
+			if err != nil {
+				return err
+			}
+			req.FromSequence = ev.GetSequence() + 1
+			fmt.Printf("%d: trie %v %v old root [%x] new root [%x]\n", ev.GetSequence(), ev.GetTreeName(), ev.GetOperation(), ev.GetOldRoot(), ev.GetNewRoot())
+		}
+	}
+}
+
+// checkHealth prints the health of the server, or of a tree if treeName is
+// set.
+func checkHealth(ctx context.Context, client healthpb.HealthClient, treeName string) error {
+	service := ""
+	if treeName != "" {
+		service = "tree/" + treeName
+	}
+	resp, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: service})
+	if err != nil {
+		return err
+	}
+	fmt.Println(resp.GetStatus())
+	return nil
+}
+
+// transportOption returns the dial option for TLS if any of the TLS flags
+// is set, and for a plaintext connection otherwise.
+func transportOption() (grpc.DialOption, error) {
+	if !*tlsEnabled && *tlsCA == "" && *tlsCert == "" && *tlsKey == "" && *tlsServerName == "" {
+		return grpc.WithInsecure(), nil
+	}
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		ServerName: *tlsServerName,
+	}
+	if *tlsCA != "" {
+		pem, err := ioutil.ReadFile(*tlsCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no CA certificates found in [%v]", *tlsCA)
+		}
+		config.RootCAs = pool
+	}
+	if *tlsCert != "" || *tlsKey != "" {
+		cert, err := tls.LoadX509KeyPair(*tlsCert, *tlsKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return grpc.WithTransportCredentials(credentials.NewTLS(config)), nil
+}
+
+// bearerToken sends a token in the "authorization" metadata of each call.
+type bearerToken string
+
+func (t bearerToken) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{"authorization": "Bearer " + string(t)}, nil
+}
+
+// RequireTransportSecurity allows sending the token in plaintext, e.g. to a
+// server on localhost.
+func (t bearerToken) RequireTransportSecurity() bool {
+	return false
+}
+
 // srvConnAddr returns the IP / port to connect to
 func srvConnAddr() string {
 	addr := os.Getenv("UNIDB_CONNECT")
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/dashevo/universe-tree-db/universe"
+	"github.com/golang/protobuf/proto"
+)
+
+// snapshotMagic starts every snapshot file. It is followed by the snapshot
+// chunks, each one prefixed by its length as a uvarint. The first chunk holds
+// the header: tree name, hash algorithm and root.
+const snapshotMagic = "universe-tree-db snapshot\n"
+
+// maxChunkSize guards against reading a corrupted length prefix.
+const maxChunkSize = 64 << 20
+
+func exportTree(ctx context.Context, client universe.UniTreeDBClient, treeName, path string, version uint64) error {
+	stream, err := client.ExportTree(ctx, &universe.ExportTreeRequest{
+		TreeName: treeName,
+		Version:  version,
+	})
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+
+	_, err = w.WriteString(snapshotMagic)
+	if err != nil {
+		return err
+	}
+	var count int
+	var root []byte
+	for {
+		chunk, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if chunk.GetHeader() != nil {
+			root = chunk.GetHeader().GetRoot()
+		}
+		count += len(chunk.GetKeys())
+		err = writeChunk(w, chunk)
+		if err != nil {
+			return err
+		}
+	}
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("exported trie %v root [%x] w/%d keys to %v\n", treeName, root, count, path)
+	return nil
+}
+
+func importTree(ctx context.Context, client universe.UniTreeDBClient, path, treeName string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	magic := make([]byte, len(snapshotMagic))
+	_, err = io.ReadFull(r, magic)
+	if err != nil || string(magic) != snapshotMagic {
+		return fmt.Errorf("%v is not a snapshot file", path)
+	}
+
+	stream, err := client.ImportTree(ctx)
+	if err != nil {
+		return err
+	}
+	for {
+		chunk, err := readChunk(r)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if chunk.GetHeader() != nil && treeName != "" {
+			// import under another name
+			chunk.Header.Name = treeName
+		}
+		err = stream.Send(chunk)
+		if err == io.EOF {
+			// the server gave up, its error is returned by CloseAndRecv
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	info, err := stream.CloseAndRecv()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("imported trie %v root [%x] w/%d keys\n", info.GetName(), info.GetRoot(), info.GetKeyCount())
+	return nil
+}
+
+// writeChunk writes a length prefixed snapshot chunk.
+func writeChunk(w io.Writer, chunk *universe.SnapshotChunk) error {
+	data, err := proto.Marshal(chunk)
+	if err != nil {
+		return err
+	}
+	prefix := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutUvarint(prefix, uint64(len(data)))
+	_, err = w.Write(prefix[:n])
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// readChunk reads a length prefixed snapshot chunk, returning io.EOF at the
+// end of the file.
+func readChunk(r *bufio.Reader) (*universe.SnapshotChunk, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if size > maxChunkSize {
+		return nil, fmt.Errorf("snapshot chunk of %d bytes is too big", size)
+	}
+	data := make([]byte, size)
+	_, err = io.ReadFull(r, data)
+	if err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	var chunk universe.SnapshotChunk
+	err = proto.Unmarshal(data, &chunk)
+	if err != nil {
+		return nil, err
+	}
+	return &chunk, nil
+}
@@ -0,0 +1,471 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dashevo/universe-tree-db/universe"
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// Calls are authenticated by a bearer token in the "authorization" metadata
+// or by the common name of a verified client certificate, and authorized by
+// the grants of an ACL policy file like:
+//
+//	{
+//	  "principals": [
+//	    {"name": "indexer", "token_sha256": "<hex SHA-256 of the token>"},
+//	    {"name": "ops", "common_name": "ops.example.com"}
+//	  ],
+//	  "grants": [
+//	    {"principals": ["indexer"], "trees": ["blocks-*"], "rights": ["read", "write"]},
+//	    {"principals": ["ops"], "trees": ["*"], "rights": ["admin"]},
+//	    {"principals": ["*"], "trees": ["public"], "rights": ["read", "prove"]}
+//	  ]
+//	}
+//
+// A "*" in a tree pattern matches any run of characters, a "*" principal any
+// authenticated principal. Calls about all trees, e.g. ListTrees, need the
+// right on a pattern matching every tree name, i.e. "*".
+//
+// Health checks need no authentication, so that load balancers can probe the
+// server. Server reflection is open to every authenticated principal w/o any
+// grant: it only describes the services, which are public anyway, and gives
+// no access to trees.
+
+// policyReloadInterval is the minimum time between checks of the policy file
+// for changes.
+const policyReloadInterval = 5 * time.Second
+
+// right is a set of rights on a tree.
+type right uint8
+
+const (
+	rightRead right = 1 << iota
+	rightWrite
+	rightProve
+	// rightAdmin allows creating, dropping and importing trees and implies
+	// all other rights
+	rightAdmin
+)
+
+var rightNames = map[string]right{
+	"read":  rightRead,
+	"write": rightWrite,
+	"prove": rightProve,
+	"admin": rightAdmin | rightRead | rightWrite | rightProve,
+}
+
+// methodRights maps each method to the right it needs on the tree of the
+// request. Methods not listed need admin rights on all trees, except for
+// health checks which need no authentication and server reflection which
+// needs no rights.
+var methodRights = map[string]right{
+	"ListTrees":              rightRead,
+	"CreateTree":             rightAdmin,
+	"ForkTree":               rightAdmin,
+	"RenameTree":             rightAdmin,
+	"DropTree":               rightAdmin,
+	"SyncMeta":               rightWrite,
+	"ListDrops":              rightRead,
+	"SetAutoCommit":          rightAdmin,
+	"Update":                 rightWrite,
+	"AtomicUpdate":           rightWrite,
+	"MultiUpdate":            rightWrite,
+	"Commit":                 rightWrite,
+	"Get":                    rightRead,
+	"BatchGet":               rightRead,
+	"Stash":                  rightWrite,
+	"Revert":                 rightWrite,
+	"MerkleProof":            rightProve,
+	"MerkleProofCompressed":  rightProve,
+	"MerkleProofR":           rightProve,
+	"MerkleProofCompressedR": rightProve,
+	"BatchMerkleProof":       rightProve,
+	"VerifyInclusion":        rightProve,
+	"VerifyNonInclusion":     rightProve,
+	"VerifyInclusionC":       rightProve,
+	"VerifyNonInclusionC":    rightProve,
+	"Iterate":                rightRead,
+	"Diff":                   rightRead,
+	"ListVersions":           rightRead,
+	"GetVersion":             rightRead,
+	"RevertToVersion":        rightWrite,
+	"ExportTree":             rightRead,
+	"ImportTree":             rightAdmin,
+	"WatchTree":              rightRead,
+}
+
+// reflectionMethodPrefix is the prefix of the full names of the methods of
+// the server reflection service.
+const reflectionMethodPrefix = "/grpc.reflection.v1alpha.ServerReflection/"
+
+// uniTreeDBMethodPrefix is the prefix of the full names of the methods of the
+// UniTreeDB service.
+const uniTreeDBMethodPrefix = "/universe.UniTreeDB/"
+
+// policyFile is the JSON format of the ACL policy file.
+type policyFile struct {
+	Principals []struct {
+		Name        string `json:"name"`
+		TokenSHA256 string `json:"token_sha256"`
+		CommonName  string `json:"common_name"`
+	} `json:"principals"`
+	Grants []struct {
+		Principals []string `json:"principals"`
+		Trees      []string `json:"trees"`
+		Rights     []string `json:"rights"`
+	} `json:"grants"`
+}
+
+// grant gives rights on the trees matching a pattern.
+type grant struct {
+	principals map[string]bool
+	trees      []string
+	rights     right
+}
+
+// policy is a parsed ACL policy file.
+type policy struct {
+	// tokens maps the SHA-256 of a token to its principal
+	tokens map[[sha256.Size]byte]string
+	// commonNames maps the common name of a client certificate to its
+	// principal
+	commonNames map[string]string
+	grants      []grant
+}
+
+// parsePolicy parses and checks an ACL policy file.
+func parsePolicy(data []byte) (*policy, error) {
+	var f policyFile
+	err := json.Unmarshal(data, &f)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &policy{
+		tokens:      make(map[[sha256.Size]byte]string),
+		commonNames: make(map[string]string),
+	}
+	names := make(map[string]bool)
+	for i, pr := range f.Principals {
+		if pr.Name == "" || pr.Name == "*" {
+			return nil, fmt.Errorf("principal [%d] has invalid name [%v]", i, pr.Name)
+		}
+		if names[pr.Name] {
+			return nil, fmt.Errorf("principal [%v] is defined twice", pr.Name)
+		}
+		names[pr.Name] = true
+		if pr.TokenSHA256 == "" && pr.CommonName == "" {
+			return nil, fmt.Errorf("principal [%v] has neither a token nor a common name", pr.Name)
+		}
+		if pr.TokenSHA256 != "" {
+			hash, err := hex.DecodeString(pr.TokenSHA256)
+			if err != nil || len(hash) != sha256.Size {
+				return nil, fmt.Errorf("token of principal [%v] is not a hex SHA-256", pr.Name)
+			}
+			var key [sha256.Size]byte
+			copy(key[:], hash)
+			if other, ok := p.tokens[key]; ok {
+				return nil, fmt.Errorf("principals [%v] and [%v] have the same token", other, pr.Name)
+			}
+			p.tokens[key] = pr.Name
+		}
+		if pr.CommonName != "" {
+			if other, ok := p.commonNames[pr.CommonName]; ok {
+				return nil, fmt.Errorf("principals [%v] and [%v] have the same common name", other, pr.Name)
+			}
+			p.commonNames[pr.CommonName] = pr.Name
+		}
+	}
+
+	for i, g := range f.Grants {
+		pg := grant{
+			principals: make(map[string]bool),
+			trees:      g.Trees,
+		}
+		for _, name := range g.Principals {
+			if name != "*" && !names[name] {
+				return nil, fmt.Errorf("grant [%d] refers to unknown principal [%v]", i, name)
+			}
+			pg.principals[name] = true
+		}
+		for _, pattern := range g.Trees {
+			if pattern == "" {
+				return nil, fmt.Errorf("grant [%d] has an empty tree pattern", i)
+			}
+		}
+		for _, name := range g.Rights {
+			r, ok := rightNames[name]
+			if !ok {
+				return nil, fmt.Errorf("grant [%d] has unknown right [%v]", i, name)
+			}
+			pg.rights |= r
+		}
+		p.grants = append(p.grants, pg)
+	}
+	return p, nil
+}
+
+// allowed returns whether principal has right r on the tree treeName, or
+// on all trees if treeName is empty.
+func (p *policy) allowed(principal string, treeName string, r right) bool {
+	for _, g := range p.grants {
+		if g.rights&r != r || (!g.principals[principal] && !g.principals["*"]) {
+			continue
+		}
+		for _, pattern := range g.trees {
+			if matchPattern(pattern, treeName) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchPattern returns whether name matches pattern, where "*" matches any
+// run of characters.
+func matchPattern(pattern, name string) bool {
+	parts := strings.Split(pattern, "*")
+	if len(parts) == 1 {
+		return pattern == name
+	}
+	if !strings.HasPrefix(name, parts[0]) {
+		return false
+	}
+	name = name[len(parts[0]):]
+	last := parts[len(parts)-1]
+	for _, part := range parts[1 : len(parts)-1] {
+		i := strings.Index(name, part)
+		if i < 0 {
+			return false
+		}
+		name = name[i+len(part):]
+	}
+	return len(name) >= len(last) && strings.HasSuffix(name, last)
+}
+
+// authorizer authenticates and authorizes calls w/the policy in a file,
+// reloading it once it changes.
+type authorizer struct {
+	file string
+
+	sync.Mutex
+	// checked is when the file was last checked for changes
+	checked time.Time
+	modTime time.Time
+	policy  *policy
+}
+
+// newAuthorizer loads the policy in file.
+func newAuthorizer(file string) (*authorizer, error) {
+	a := &authorizer{file: file}
+	stat, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	err = a.load(stat.ModTime())
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *authorizer) load(modTime time.Time) error {
+	data, err := ioutil.ReadFile(a.file)
+	if err != nil {
+		return err
+	}
+	p, err := parsePolicy(data)
+	if err != nil {
+		return fmt.Errorf("invalid ACL policy [%v]: %v", a.file, err)
+	}
+	a.policy = p
+	a.modTime = modTime
+	a.checked = time.Now()
+	return nil
+}
+
+// currentPolicy returns the policy, reloading the file first if it changed.
+// If it can't be reloaded the previous policy is kept.
+func (a *authorizer) currentPolicy() *policy {
+	a.Lock()
+	defer a.Unlock()
+
+	if time.Since(a.checked) < policyReloadInterval {
+		return a.policy
+	}
+	a.checked = time.Now()
+	stat, err := os.Stat(a.file)
+	if err != nil {
+		log.Printf("ACL: could not check policy file: %v", err)
+		return a.policy
+	}
+	if stat.ModTime().Equal(a.modTime) {
+		return a.policy
+	}
+	err = a.load(stat.ModTime())
+	if err != nil {
+		log.Printf("ACL: could not reload policy, keeping previous one: %v", err)
+	} else {
+		log.Printf("ACL: reloaded policy [%v]", a.file)
+	}
+	return a.policy
+}
+
+// principal returns the principal making a call, preferring a bearer token
+// over a client certificate.
+func (p *policy) principal(ctx context.Context) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	if auth := md.Get("authorization"); len(auth) != 0 {
+		const prefix = "Bearer "
+		if len(auth) != 1 || !strings.HasPrefix(auth[0], prefix) {
+			return "", status.Error(codes.Unauthenticated, "authorization is not a single bearer token")
+		}
+		name, ok := p.tokens[sha256.Sum256([]byte(strings.TrimPrefix(auth[0], prefix)))]
+		if !ok {
+			return "", status.Error(codes.Unauthenticated, "unknown bearer token")
+		}
+		return name, nil
+	}
+
+	if pr, ok := peer.FromContext(ctx); ok {
+		if tlsInfo, ok := pr.AuthInfo.(credentials.TLSInfo); ok && len(tlsInfo.State.VerifiedChains) != 0 {
+			cn := tlsInfo.State.VerifiedChains[0][0].Subject.CommonName
+			name, ok := p.commonNames[cn]
+			if !ok {
+				return "", status.Errorf(codes.Unauthenticated, "unknown client certificate [%v]", cn)
+			}
+			return name, nil
+		}
+	}
+	return "", status.Error(codes.Unauthenticated, "no bearer token or client certificate")
+}
+
+// authorize checks that the caller may call fullMethod w/req.
+func (a *authorizer) authorize(ctx context.Context, fullMethod string, req interface{}) error {
+	if strings.HasPrefix(fullMethod, healthMethodPrefix) {
+		// health checks are open to all
+		return nil
+	}
+	p := a.currentPolicy()
+	principal, err := p.principal(ctx)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(fullMethod, reflectionMethodPrefix) {
+		// the service descriptions are open to any principal
+		return nil
+	}
+
+	r, treeNames := rightAdmin, []string{""}
+	if strings.HasPrefix(fullMethod, uniTreeDBMethodPrefix) {
+		if mr, ok := methodRights[strings.TrimPrefix(fullMethod, uniTreeDBMethodPrefix)]; ok {
+			r, treeNames = mr, requestTrees(req)
+		}
+	}
+	for _, treeName := range treeNames {
+		if p.allowed(principal, treeName, r) {
+			continue
+		}
+		if treeName == "" {
+			return status.Errorf(codes.PermissionDenied, "[%v] may not call [%v] on all trees", principal, fullMethod)
+		}
+		return treeError(codes.PermissionDenied, treeName, "[%v] may not call [%v] on tree [%v]", principal, fullMethod, treeName)
+	}
+	return nil
+}
+
+// requestTrees returns the names of the trees a request is about, the right
+// is needed on each of them.
+func requestTrees(req interface{}) []string {
+	switch req := req.(type) {
+	case *universe.MultiUpdateRequest:
+		if len(req.GetUpdates()) == 0 {
+			break
+		}
+		names := make([]string, len(req.GetUpdates()))
+		for i, u := range req.GetUpdates() {
+			names[i] = u.GetTreeName()
+		}
+		return names
+	case *universe.ForkTreeRequest:
+		return []string{req.GetName(), req.GetSourceTreeName()}
+	case *universe.RenameTreeRequest:
+		return []string{req.GetTreeName(), req.GetNewName()}
+	}
+	return []string{requestTree(req)}
+}
+
+// requestTree returns the name of the tree a request is about, or an empty
+// name for requests about all trees.
+func requestTree(req interface{}) string {
+	switch req := req.(type) {
+	case interface{ GetTreeName() string }:
+		return req.GetTreeName()
+	case *universe.CreateTreeRequest:
+		return req.GetName()
+	case *universe.DropTreeRequest:
+		return req.GetName()
+	case *universe.SnapshotChunk:
+		return req.GetHeader().GetName()
+	}
+	return ""
+}
+
+// unaryInterceptor authorizes unary calls.
+func (a *authorizer) unaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	err := a.authorize(ctx, info.FullMethod, req)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// streamInterceptor authorizes streaming calls once their first message is
+// received, as it names the tree.
+func (a *authorizer) streamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return handler(srv, &authStream{ServerStream: ss, a: a, fullMethod: info.FullMethod})
+}
+
+// authStream authorizes a call on receiving its first message.
+type authStream struct {
+	grpc.ServerStream
+	a          *authorizer
+	fullMethod string
+	authorized bool
+}
+
+func (s *authStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err != nil || s.authorized {
+		return err
+	}
+	err = s.a.authorize(s.Context(), s.fullMethod, m)
+	if err != nil {
+		return err
+	}
+	s.authorized = true
+	return nil
+}
+
+func (s *authStream) SendMsg(m interface{}) error {
+	if !s.authorized {
+		return status.Error(codes.PermissionDenied, "call not authorized yet")
+	}
+	return s.ServerStream.SendMsg(m)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+	"time"
+
+	"github.com/dashevo/universe-tree-db/universe"
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// testPolicy grants the indexer read and write rights on the block trees,
+// the admin all rights and everybody read rights on the public tree.
+func testPolicy() string {
+	token := func(s string) string {
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	return `{
+	  "principals": [
+	    {"name": "indexer", "token_sha256": "` + token("indexer-token") + `"},
+	    {"name": "admin", "token_sha256": "` + token("admin-token") + `"},
+	    {"name": "guest", "token_sha256": "` + token("guest-token") + `"}
+	  ],
+	  "grants": [
+	    {"principals": ["indexer"], "trees": ["blocks-*"], "rights": ["read", "write"]},
+	    {"principals": ["admin"], "trees": ["*"], "rights": ["admin"]},
+	    {"principals": ["*"], "trees": ["public"], "rights": ["read"]}
+	  ]
+	}`
+}
+
+func TestParsePolicy(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy string
+		valid  bool
+	}{
+		{"example", testPolicy(), true},
+		{"not json", `{`, false},
+		{"principal w/o name", `{"principals": [{"common_name": "x"}]}`, false},
+		{"principal named *", `{"principals": [{"name": "*", "common_name": "x"}]}`, false},
+		{"principal w/o credentials", `{"principals": [{"name": "x"}]}`, false},
+		{"principal defined twice", `{"principals": [{"name": "x", "common_name": "a"}, {"name": "x", "common_name": "b"}]}`, false},
+		{"token not hex", `{"principals": [{"name": "x", "token_sha256": "zz"}]}`, false},
+		{"shared common name", `{"principals": [{"name": "x", "common_name": "a"}, {"name": "y", "common_name": "a"}]}`, false},
+		{"unknown principal", `{"grants": [{"principals": ["x"], "trees": ["*"], "rights": ["read"]}]}`, false},
+		{"empty tree pattern", `{"grants": [{"principals": ["*"], "trees": [""], "rights": ["read"]}]}`, false},
+		{"unknown right", `{"grants": [{"principals": ["*"], "trees": ["*"], "rights": ["root"]}]}`, false},
+	}
+
+	for _, tt := range tests {
+		_, err := parsePolicy([]byte(tt.policy))
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: got error %v, expected valid %v", tt.name, err, tt.valid)
+		}
+	}
+}
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		match         bool
+	}{
+		{"public", "public", true},
+		{"public", "public2", false},
+		{"public", "", false},
+		{"*", "", true},
+		{"*", "anything", true},
+		{"blocks-*", "blocks-1", true},
+		{"blocks-*", "blocks-", true},
+		{"blocks-*", "block-1", false},
+		{"*-test", "a-test", true},
+		{"*-test", "a-test2", false},
+		{"a*b*c", "abc", true},
+		{"a*b*c", "axxbyyc", true},
+		{"a*b*c", "acb", false},
+		{"a*a", "a", false},
+	}
+
+	for _, tt := range tests {
+		if got := matchPattern(tt.pattern, tt.name); got != tt.match {
+			t.Errorf("pattern [%v] name [%v]: got %v, expected %v", tt.pattern, tt.name, got, tt.match)
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	a := testAuthorizer(t)
+	method := func(name string) string {
+		return uniTreeDBMethodPrefix + name
+	}
+
+	tests := []struct {
+		name   string
+		token  string
+		method string
+		req    interface{}
+		code   codes.Code
+	}{
+		{"write on matching tree", "indexer-token", method("Update"), &universe.UpdateRequest{TreeName: "blocks-1"}, codes.OK},
+		{"write on other tree", "indexer-token", method("Update"), &universe.UpdateRequest{TreeName: "public"}, codes.PermissionDenied},
+		{"read on public tree", "guest-token", method("Get"), &universe.GetRequest{TreeName: "public"}, codes.OK},
+		{"prove w/o the right", "indexer-token", method("MerkleProof"), &universe.GetRequest{TreeName: "blocks-1"}, codes.PermissionDenied},
+		{"all trees w/o *", "indexer-token", method("ListTrees"), &universe.Void{}, codes.PermissionDenied},
+		{"all trees w/*", "admin-token", method("ListTrees"), &universe.Void{}, codes.OK},
+		{"admin method", "indexer-token", method("CreateTree"), &universe.CreateTreeRequest{Name: "blocks-2"}, codes.PermissionDenied},
+		{"admin implies all", "admin-token", method("MerkleProof"), &universe.GetRequest{TreeName: "x"}, codes.OK},
+		{"multi-tree update w/one other tree", "indexer-token", method("MultiUpdate"), &universe.MultiUpdateRequest{Updates: []*universe.UpdateRequest{{TreeName: "blocks-1"}, {TreeName: "public"}}}, codes.PermissionDenied},
+		{"rename to other tree", "indexer-token", method("RenameTree"), &universe.RenameTreeRequest{TreeName: "blocks-1", NewName: "x"}, codes.PermissionDenied},
+		{"unlisted method", "indexer-token", method("Unknown"), &universe.GetRequest{TreeName: "blocks-1"}, codes.PermissionDenied},
+		{"unknown principal", "other-token", method("Get"), &universe.GetRequest{TreeName: "public"}, codes.Unauthenticated},
+		{"no credentials", "", method("Get"), &universe.GetRequest{TreeName: "public"}, codes.Unauthenticated},
+		{"reflection", "guest-token", reflectionMethodPrefix + "ServerReflectionInfo", nil, codes.OK},
+		{"reflection w/o credentials", "", reflectionMethodPrefix + "ServerReflectionInfo", nil, codes.Unauthenticated},
+		{"health w/o credentials", "", healthMethodPrefix + "Check", nil, codes.OK},
+	}
+
+	for _, tt := range tests {
+		err := a.authorize(tokenContext(tt.token), tt.method, tt.req)
+		if code := status.Code(err); code != tt.code {
+			t.Errorf("%s: got code %v, expected %v: %v", tt.name, code, tt.code, err)
+		}
+	}
+}
+
+func TestAuthorizeStream(t *testing.T) {
+	a := testAuthorizer(t)
+	tests := []struct {
+		name  string
+		token string
+		req   *universe.IterateRequest
+		code  codes.Code
+	}{
+		{"allowed", "indexer-token", &universe.IterateRequest{TreeName: "blocks-1"}, codes.OK},
+		{"denied", "guest-token", &universe.IterateRequest{TreeName: "blocks-1"}, codes.PermissionDenied},
+	}
+
+	for _, tt := range tests {
+		ss := &authTestStream{ctx: tokenContext(tt.token), req: tt.req}
+		st := &authStream{ServerStream: ss, a: a, fullMethod: uniTreeDBMethodPrefix + "Iterate"}
+		// nothing is sent before the first message names the tree
+		if code := status.Code(st.SendMsg(&universe.IterateReply{})); code != codes.PermissionDenied {
+			t.Errorf("%s: got code %v sending before receiving, expected %v", tt.name, code, codes.PermissionDenied)
+		}
+		var req universe.IterateRequest
+		err := st.RecvMsg(&req)
+		if code := status.Code(err); code != tt.code {
+			t.Errorf("%s: got code %v, expected %v: %v", tt.name, code, tt.code, err)
+		}
+		err = st.SendMsg(&universe.IterateReply{})
+		if code := status.Code(err); code != tt.code || (err == nil) != (ss.sent == 1) {
+			t.Errorf("%s: got code %v and %d messages sent after receiving, expected %v", tt.name, code, ss.sent, tt.code)
+		}
+	}
+}
+
+// testAuthorizer returns an authorizer w/testPolicy which doesn't reload it.
+func testAuthorizer(t *testing.T) *authorizer {
+	t.Helper()
+	p, err := parsePolicy([]byte(testPolicy()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &authorizer{policy: p, checked: time.Now().Add(time.Hour)}
+}
+
+// tokenContext returns the context of a call w/a bearer token, w/o one if
+// token is empty.
+func tokenContext(token string) context.Context {
+	if token == "" {
+		return context.Background()
+	}
+	return metadata.NewIncomingContext(context.Background(), metadata.Pairs("authorization", "Bearer "+token))
+}
+
+// authTestStream receives one request and counts the messages sent.
+type authTestStream struct {
+	grpc.ServerStream
+	ctx  context.Context
+	req  proto.Message
+	sent int
+}
+
+func (st *authTestStream) Context() context.Context {
+	return st.ctx
+}
+
+func (st *authTestStream) RecvMsg(m interface{}) error {
+	proto.Merge(m.(proto.Message), st.req)
+	return nil
+}
+
+func (st *authTestStream) SendMsg(m interface{}) error {
+	st.sent++
+	return nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/bits"
+	"time"
+
+	"github.com/aergoio/aergo/pkg/trie"
+	"github.com/dashevo/universe-tree-db/universe"
+)
+
+// A tree w/an auto commit policy is committed in the background once it has
+// had a number of updates, once its first update after the last commit is a
+// number of seconds old, or once the updated nodes held in memory pass a size.
+// The update and memory limits are checked after each update, the age of the
+// updates every autoCommitCheckInterval.
+
+// autoCommitCheckInterval is how often the trees are checked for updates
+// due for a commit.
+const autoCommitCheckInterval = time.Second
+
+// autoCommitQueue is the number of trees which may be queued for an auto
+// commit after an update, any further ones are committed on the next check.
+const autoCommitQueue = 64
+
+// nodeBatchBytes estimates the memory held by a batch of updated nodes: its
+// hash, 31 slices and up to 30 nodes.
+const nodeBatchBytes = trie.HashLength + 31*24 + 30*(trie.HashLength+1)
+
+// updatedNodesBytes estimates the memory held by the updated nodes of a tree
+// until the commit. The aergo trie doesn't expose its updated nodes, so each
+// pair updated since the commit is taken to update a batch every 4 levels
+// down to the depth of the leaves. Pairs sharing batches, or updating the
+// same keys again, make it an overestimate.
+// Expected to be called w/tree lock.
+func (ti *TreeInfo) updatedNodesBytes() uint64 {
+	batches := uint64(bits.Len64(ti.KeyCount)/4 + 1)
+	return ti.pendingPairs * batches * nodeBatchBytes
+}
+
+// autoCommitPolicy returns the policy of new trees, nil if they aren't
+// committed automatically.
+func (c *treeConfig) autoCommitPolicy() *universe.AutoCommitPolicy {
+	if c.AutoCommitUpdates == 0 && c.AutoCommitSeconds == 0 && c.AutoCommitMemoryBytes == 0 {
+		return nil
+	}
+	return &universe.AutoCommitPolicy{
+		Updates:     c.AutoCommitUpdates,
+		Seconds:     c.AutoCommitSeconds,
+		MemoryBytes: c.AutoCommitMemoryBytes,
+	}
+}
+
+// countUpdate counts an update of pairs pairs of a tree towards its auto
+// commit, and queues the commit if the update or memory limit is reached.
+// Expected to be called w/tree lock.
+func (s *universeTrieServer) countUpdate(ti *TreeInfo, pairs int) {
+	ti.pendingUpdates++
+	ti.pendingPairs += uint64(pairs)
+	if ti.pendingSince.IsZero() {
+		ti.pendingSince = time.Now()
+	}
+	if ti.autoCommitDue(time.Now()) == "" {
+		return
+	}
+	select {
+	case s.autoCommits <- ti:
+	default:
+		// the next check commits it
+	}
+}
+
+// autoCommitDue returns why a tree is due for an auto commit, or "" if it
+// isn't.
+// Expected to be called w/tree lock.
+func (ti *TreeInfo) autoCommitDue(now time.Time) string {
+	p := ti.AutoCommit
+	if p == nil || ti.pendingUpdates == 0 || ti.dropped {
+		return ""
+	}
+	if p.Updates != 0 && ti.pendingUpdates >= p.Updates {
+		return fmt.Sprintf("[%d] updates", ti.pendingUpdates)
+	}
+	if p.Seconds != 0 && now.Sub(ti.pendingSince) >= time.Duration(p.Seconds)*time.Second {
+		return fmt.Sprintf("[%v] since the first update", now.Sub(ti.pendingSince).Round(time.Millisecond))
+	}
+	if p.MemoryBytes != 0 {
+		if size := ti.updatedNodesBytes(); size >= p.MemoryBytes {
+			return fmt.Sprintf("[%d] bytes of updated nodes", size)
+		}
+	}
+	return ""
+}
+
+// clearPending resets the updates counted towards an auto commit, once the
+// tree has no uncommitted updates left.
+// Expected to be called w/tree lock.
+func (ti *TreeInfo) clearPending() {
+	ti.pendingUpdates = 0
+	ti.pendingPairs = 0
+	ti.pendingSince = time.Time{}
+}
+
+// autoCommitLoop commits the trees which are due in the background until the
+// server shuts down.
+func (s *universeTrieServer) autoCommitLoop() {
+	ticker := time.NewTicker(autoCommitCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case ti := <-s.autoCommits:
+			s.autoCommit(ti)
+		case <-ticker.C:
+			for _, ti := range s.trees() {
+				ti.RLock()
+				due := ti.autoCommitDue(time.Now()) != ""
+				ti.RUnlock()
+				if due {
+					s.autoCommit(ti)
+				}
+			}
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// autoCommit commits a tree if it is still due. Reads of the tree only wait
+// for the commit itself.
+func (s *universeTrieServer) autoCommit(ti *TreeInfo) {
+	ti.Lock()
+	defer ti.Unlock()
+
+	reason := ti.autoCommitDue(time.Now())
+	if reason == "" {
+		return
+	}
+	oldRoot := ti.committedRoot
+	err := s.commitTree(ti)
+	if err != nil {
+		log.Printf("AutoCommit: could not commit trie [%v]: %v", ti.Name, err)
+		return
+	}
+	s.notify(ti.Name, universe.TreeOperation_COMMIT, oldRoot, ti.committedRoot)
+	s.checkTreeHealth(ti)
+
+	log.Printf("AutoCommit: trie [%v] committed after %v", ti.Name, reason)
+}
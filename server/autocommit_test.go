@@ -0,0 +1,49 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dashevo/universe-tree-db/universe"
+)
+
+func TestAutoCommitDue(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		policy  *universe.AutoCommitPolicy
+		updates uint64
+		pairs   uint64
+		keys    uint64
+		age     time.Duration
+		reason  string
+	}{
+		{"no policy", nil, 100, 100, 100, time.Hour, ""},
+		{"no updates", &universe.AutoCommitPolicy{Updates: 1, Seconds: 1, MemoryBytes: 1}, 0, 0, 100, time.Hour, ""},
+		{"updates", &universe.AutoCommitPolicy{Updates: 10}, 10, 10, 100, 0, "updates"},
+		{"too few updates", &universe.AutoCommitPolicy{Updates: 10}, 9, 90, 100, 0, ""},
+		{"age", &universe.AutoCommitPolicy{Seconds: 5}, 1, 1, 100, 5 * time.Second, "since the first update"},
+		{"too young", &universe.AutoCommitPolicy{Seconds: 5}, 1, 1, 100, 4 * time.Second, ""},
+		// each pair of a tree of 100 keys counts as 2 batches
+		{"memory", &universe.AutoCommitPolicy{MemoryBytes: 20 * 2 * nodeBatchBytes}, 2, 20, 100, 0, "bytes of updated nodes"},
+		{"too little memory", &universe.AutoCommitPolicy{MemoryBytes: 20 * 2 * nodeBatchBytes}, 2, 19, 100, 0, ""},
+		{"memory of a deeper tree", &universe.AutoCommitPolicy{MemoryBytes: 20 * 2 * nodeBatchBytes}, 2, 19, 1 << 20, 0, "bytes of updated nodes"},
+	}
+
+	for _, tt := range tests {
+		ti := &TreeInfo{
+			TreeInfo: universe.TreeInfo{
+				KeyCount:   tt.keys,
+				AutoCommit: tt.policy,
+			},
+			pendingUpdates: tt.updates,
+			pendingPairs:   tt.pairs,
+			pendingSince:   now.Add(-tt.age),
+		}
+		reason := ti.autoCommitDue(now)
+		if (reason == "") != (tt.reason == "") || !strings.Contains(reason, tt.reason) {
+			t.Errorf("%s: got reason %q, expected %q", tt.name, reason, tt.reason)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aergoio/aergo-lib/db"
+	"github.com/dgraph-io/badger"
+)
+
+// badgerDB is the aergo DB, stored the same way as by the badger DB of
+// aergo-lib but opened w/configurable badger options.
+type badgerDB struct {
+	db     *badger.DB
+	dir    string
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+var _ db.DB = (*badgerDB)(nil)
+
+const (
+	// badgerGCDiscardRatio is the share of a value log file which must be
+	// stale for the file to be rewritten
+	badgerGCDiscardRatio = 0.5
+	// badgerGCInterval is the maximum time between garbage collections of
+	// the value log
+	badgerGCInterval = 10 * time.Minute
+	// badgerGCSize is the growth of the value log below which it is garbage
+	// collected right away, as the DB is idle enough
+	badgerGCSize = 1 << 20
+)
+
+// newBadgerDB opens the badger DB in opts.Dir as an aergo DB.
+func newBadgerDB(opts badger.Options) (*badgerDB, error) {
+	bdb, err := badger.Open(opts)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &badgerDB{
+		db:     bdb,
+		dir:    opts.Dir,
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	go d.runGC(ctx)
+	return d, nil
+}
+
+// runGC garbage collects the value log every minute if it barely grew, or
+// after badgerGCInterval otherwise.
+func (d *badgerDB) runGC(ctx context.Context) {
+	defer close(d.done)
+
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	lastGC := time.Now()
+	_, lastVlogSize := d.db.Size()
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+		_, vlogSize := d.db.Size()
+		if time.Since(lastGC) < badgerGCInterval && lastVlogSize+badgerGCSize <= vlogSize {
+			continue
+		}
+		err := d.db.RunValueLogGC(badgerGCDiscardRatio)
+		if err != nil && err != badger.ErrNoRewrite {
+			log.Printf("badgerDB: could not garbage collect value log of [%v]: %v", d.dir, err)
+		}
+		_, lastVlogSize = d.db.Size()
+		lastGC = time.Now()
+	}
+}
+
+// Type implements db.DB.
+func (d *badgerDB) Type() string {
+	return "badgerdb"
+}
+
+// Set implements db.DB.
+func (d *badgerDB) Set(key, value []byte) {
+	err := d.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(nonNil(key), nonNil(value))
+	})
+	if err != nil {
+		panic(fmt.Sprintf("Database Error: %v", err))
+	}
+}
+
+// Delete implements db.DB.
+func (d *badgerDB) Delete(key []byte) {
+	err := d.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(nonNil(key))
+	})
+	if err != nil {
+		panic(fmt.Sprintf("Database Error: %v", err))
+	}
+}
+
+// Get implements db.DB, returning an empty value for missing keys.
+func (d *badgerDB) Get(key []byte) []byte {
+	var val []byte
+	err := d.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(nonNil(key))
+		if err != nil {
+			return err
+		}
+		val, err = item.ValueCopy(nil)
+		return err
+	})
+	if err == badger.ErrKeyNotFound {
+		return []byte{}
+	}
+	if err != nil {
+		panic(fmt.Sprintf("Database Error: %v", err))
+	}
+	return val
+}
+
+// Exist implements db.DB.
+func (d *badgerDB) Exist(key []byte) bool {
+	err := d.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(nonNil(key))
+		return err
+	})
+	return err == nil
+}
+
+// Close implements db.DB, waiting for the garbage collection to stop first.
+func (d *badgerDB) Close() {
+	d.cancel()
+	<-d.done
+	err := d.db.Close()
+	if err != nil {
+		panic(fmt.Sprintf("Database Error: %v", err))
+	}
+}
+
+// NewTx implements db.DB.
+func (d *badgerDB) NewTx() db.Transaction {
+	return &badgerTx{tx: d.db.NewTransaction(true)}
+}
+
+// NewBulk implements db.DB.
+func (d *badgerDB) NewBulk() db.Bulk {
+	return &badgerBulk{batch: d.db.NewWriteBatch()}
+}
+
+// Iterator implements db.DB, iterating in reverse if start is after end.
+func (d *badgerDB) Iterator(start, end []byte) db.Iterator {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.Reverse = bytes.Compare(start, end) > 0
+
+	it := d.db.NewTransaction(false).NewIterator(opts)
+	it.Seek(start)
+	return &badgerIterator{it: it, end: end, reverse: opts.Reverse}
+}
+
+// nonNil returns an empty slice instead of nil, which badger rejects.
+func nonNil(b []byte) []byte {
+	if b == nil {
+		return []byte{}
+	}
+	return b
+}
+
+type badgerTx struct {
+	tx *badger.Txn
+}
+
+func (t *badgerTx) Set(key, value []byte) {
+	err := t.tx.Set(nonNil(key), nonNil(value))
+	if err != nil {
+		panic(fmt.Sprintf("Database Error: %v", err))
+	}
+}
+
+func (t *badgerTx) Delete(key []byte) {
+	err := t.tx.Delete(nonNil(key))
+	if err != nil {
+		panic(fmt.Sprintf("Database Error: %v", err))
+	}
+}
+
+func (t *badgerTx) Commit() {
+	err := t.tx.Commit()
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (t *badgerTx) Discard() {
+	t.tx.Discard()
+}
+
+type badgerBulk struct {
+	batch *badger.WriteBatch
+}
+
+func (b *badgerBulk) Set(key, value []byte) {
+	err := b.batch.Set(nonNil(key), nonNil(value))
+	if err != nil {
+		panic(fmt.Sprintf("Database Error: %v", err))
+	}
+}
+
+func (b *badgerBulk) Delete(key []byte) {
+	err := b.batch.Delete(nonNil(key))
+	if err != nil {
+		panic(fmt.Sprintf("Database Error: %v", err))
+	}
+}
+
+func (b *badgerBulk) Flush() {
+	err := b.batch.Flush()
+	if err != nil {
+		panic(err)
+	}
+}
+
+func (b *badgerBulk) DiscardLast() {
+	b.batch.Cancel()
+}
+
+type badgerIterator struct {
+	it      *badger.Iterator
+	end     []byte
+	reverse bool
+}
+
+func (i *badgerIterator) Next() {
+	if !i.Valid() {
+		panic("Iterator is Invalid")
+	}
+	i.it.Next()
+}
+
+func (i *badgerIterator) Valid() bool {
+	if !i.it.Valid() {
+		return false
+	}
+	if i.end == nil {
+		return true
+	}
+	if i.reverse {
+		return bytes.Compare(i.it.Item().Key(), i.end) > 0
+	}
+	return bytes.Compare(i.it.Item().Key(), i.end) < 0
+}
+
+func (i *badgerIterator) Key() []byte {
+	return i.it.Item().Key()
+}
+
+func (i *badgerIterator) Value() []byte {
+	val, err := i.it.Item().ValueCopy(nil)
+	if err != nil {
+		panic(err)
+	}
+	return val
+}
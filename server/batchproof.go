@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/aergoio/aergo/pkg/trie"
+	"github.com/dashevo/universe-tree-db/universe"
+)
+
+// proofKeys checks the keys of a batch proof and returns them sorted w/o
+// duplicates.
+func proofKeys(treeName string, keys [][]byte, keyLength int, maxKeys int) ([][]byte, error) {
+	if len(keys) == 0 {
+		return nil, fieldError(treeName, "keys", "batch has no keys")
+	}
+	if maxKeys != 0 && len(keys) > maxKeys {
+		return nil, fieldError(treeName, "keys", "batch has [%d] keys, the limit is [%d]", len(keys), maxKeys)
+	}
+	for i, key := range keys {
+		if len(key) != keyLength {
+			return nil, fieldError(treeName, fmt.Sprintf("keys[%d]", i), "key [%x] has length [%d], expected [%d]", key, len(key), keyLength)
+		}
+	}
+
+	sorted := make([][]byte, len(keys))
+	copy(sorted, keys)
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i], sorted[j]) < 0
+	})
+	unique := sorted[:1]
+	for _, key := range sorted[1:] {
+		if !bytes.Equal(key, unique[len(unique)-1]) {
+			unique = append(unique, key)
+		}
+	}
+	return unique, nil
+}
+
+// bitWriter appends bits to a bitmap, most significant bit first.
+type bitWriter struct {
+	bits []byte
+	n    int
+}
+
+func (w *bitWriter) add(set bool) {
+	if w.n%8 == 0 {
+		w.bits = append(w.bits, 0)
+	}
+	if set {
+		w.bits[w.n/8] |= 1 << uint(7-w.n%8)
+	}
+	w.n++
+}
+
+// batchProof builds a proof of the inclusion or non-inclusion of keys, which
+// must be sorted w/o duplicates, in the trie at root.
+func (r *nodeReader) batchProof(root []byte, keys [][]byte) (*universe.BatchMerkleProof, error) {
+	var branches, bitmap bitWriter
+	bp := &universe.BatchMerkleProof{}
+	err := r.proveNode(root, keys, nil, 0, r.trieHeight, bp, &branches, &bitmap)
+	if err != nil {
+		return nil, err
+	}
+	bp.Branches = branches.bits
+	bp.Bitmap = bitmap.bits
+	return bp, nil
+}
+
+func (r *nodeReader) proveNode(root []byte, keys [][]byte, batch [][]byte, iBatch, height int, bp *universe.BatchMerkleProof, branches, bitmap *bitWriter) error {
+	if len(root) == 0 {
+		// the paths of keys end in an empty subtree
+		branches.add(false)
+		bp.Leaves = append(bp.Leaves, &universe.BatchMerkleProofLeaf{})
+		return nil
+	}
+	batch, iBatch, lnode, rnode, isShortcut, err := r.loadChildren(root, height, iBatch, batch)
+	if err != nil {
+		return err
+	}
+	if isShortcut || height == 0 {
+		branches.add(false)
+		leaf := &universe.BatchMerkleProofLeaf{Value: rnode[:trie.HashLength]}
+		if !bytes.Equal(lnode[:trie.HashLength], keys[0]) {
+			leaf.Key = lnode[:trie.HashLength]
+		}
+		bp.Leaves = append(bp.Leaves, leaf)
+		return nil
+	}
+	branches.add(true)
+
+	// the keys share the path so far, so those going left come first
+	depth := r.trieHeight - height
+	split := sort.Search(len(keys), func(i int) bool {
+		return bitIsSet(keys[i], depth)
+	})
+	left, right := keys[:split], keys[split:]
+	switch {
+	case len(left) == 0:
+		addSibling(lnode, bp, bitmap)
+	case len(right) == 0:
+		addSibling(rnode, bp, bitmap)
+	}
+
+	if len(left) != 0 {
+		err = r.proveNode(lnode, left, batch, 2*iBatch+1, height-1, bp, branches, bitmap)
+		if err != nil {
+			return err
+		}
+	}
+	if len(right) != 0 {
+		return r.proveNode(rnode, right, batch, 2*iBatch+2, height-1, bp, branches, bitmap)
+	}
+	return nil
+}
+
+// addSibling adds the hash of a node which is on no path to a batch proof,
+// empty subtrees only to the bitmap.
+func addSibling(node []byte, bp *universe.BatchMerkleProof, bitmap *bitWriter) {
+	if len(node) == 0 {
+		bitmap.add(false)
+		return
+	}
+	bitmap.add(true)
+	bp.AuditPath = append(bp.AuditPath, node[:trie.HashLength])
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"github.com/aergoio/aergo-lib/db"
+	"github.com/aergoio/aergo/pkg/trie"
+	"github.com/dashevo/universe-tree-db/verify"
+)
+
+func TestBatchProof(t *testing.T) {
+	store := db.NewDB(db.MemoryImpl, "")
+	smt := trie.NewTrie(nil, Sha256, store)
+	key := func(i int) []byte {
+		return Sha256([]byte(fmt.Sprint(i)))
+	}
+	keys, values, err := updatePairs("x", testPairs(500, 0), trie.HashLength, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := smt.Update(keys, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = smt.Commit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// included, absent and duplicate keys
+	var probes [][]byte
+	for i := 0; i < 300; i += 3 {
+		probes = append(probes, key(i), key(i+10000))
+	}
+	probes = append(probes, key(3), key(10003))
+
+	sorted, err := proofKeys("x", probes, trie.HashLength, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bp, err := newNodeReader(store, smt.TrieHeight).batchProof(root, sorted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, ok := verify.BatchMerkleProof(root, Sha256, probes, bp)
+	if !ok {
+		t.Fatal("batch proof doesn't verify")
+	}
+	for i, k := range probes {
+		want, err := smt.Get(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got[i], want) {
+			t.Errorf("probe %d: got value [%x], expected [%x]", i, got[i], want)
+		}
+	}
+
+	// a proof for another root or value must not verify
+	if _, ok := verify.BatchMerkleProof(Sha256(root), Sha256, probes, bp); ok {
+		t.Error("batch proof verifies against the wrong root")
+	}
+	for _, leaf := range bp.Leaves {
+		if len(leaf.Value) != 0 {
+			leaf.Value = Sha256(leaf.Value)
+			break
+		}
+	}
+	if _, ok := verify.BatchMerkleProof(root, Sha256, probes, bp); ok {
+		t.Error("batch proof verifies w/a wrong value")
+	}
+}
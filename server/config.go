@@ -0,0 +1,370 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/dgraph-io/badger"
+	"github.com/dgraph-io/badger/options"
+	toml "github.com/pelletier/go-toml"
+	grpc "google.golang.org/grpc"
+)
+
+// The server is configured by, in order of precedence, command-line flags, a
+// TOML config file, UNIDB_* environment variables and defaults. Run the
+// server w/-print-config to get the effective config, which is also a valid
+// config file.
+
+// config is the server config.
+type config struct {
+	Listen        string       `toml:"listen" comment:"IP / port to serve gRPC on ($UNIDB_LISTEN)"`
+	DataDir       string       `toml:"data_dir" comment:"dir of the DBs, unless set for each DB ($UNIDB_DIR)"`
+	MetricsListen string       `toml:"metrics_listen" comment:"IP / port to serve Prometheus metrics on, disabled if empty ($UNIDB_METRICS_LISTEN)"`
+	GatewayListen string       `toml:"gateway_listen" comment:"IP / port to serve the JSON gateway on, disabled if empty ($UNIDB_GATEWAY_LISTEN)"`
+	ACLFile       string       `toml:"acl_file" comment:"ACL policy, calls are not authenticated if empty ($UNIDB_ACL_FILE)"`
+	TLS           tlsConfig    `toml:"tls"`
+	AergoDB       badgerConfig `toml:"aergo_db" comment:"badger DB of the trie nodes"`
+	MetaDB        badgerConfig `toml:"meta_db" comment:"badger DB of the tree metadata"`
+	WAL           walConfig    `toml:"wal" comment:"write-ahead log of the updates not committed yet"`
+	Trees         treeConfig   `toml:"trees" comment:"defaults of new trees"`
+	Log           logConfig    `toml:"log"`
+	Limits        limitConfig  `toml:"limits" comment:"limits of requests, 0 for no limit"`
+}
+
+type tlsConfig struct {
+	Cert     string `toml:"cert" comment:"server certificate, TLS is disabled if empty ($UNIDB_TLS_CERT)"`
+	Key      string `toml:"key" comment:"key of the server certificate ($UNIDB_TLS_KEY)"`
+	ClientCA string `toml:"client_ca" comment:"CAs of client certificates, which are required if set ($UNIDB_TLS_CLIENT_CA)"`
+}
+
+// badgerConfig holds the badger options which may be tuned.
+type badgerConfig struct {
+	Dir                     string `toml:"dir" comment:"dir of the DB, defaults to a subdir of data_dir"`
+	SyncWrites              bool   `toml:"sync_writes"`
+	TableLoadingMode        string `toml:"table_loading_mode" comment:"fileio, mmap or ram"`
+	ValueLogLoadingMode     string `toml:"value_log_loading_mode" comment:"fileio or mmap"`
+	ValueThreshold          int    `toml:"value_threshold" comment:"values of this size or larger go to the value log"`
+	ValueLogFileSize        int64  `toml:"value_log_file_size"`
+	MaxTableSize            int64  `toml:"max_table_size"`
+	NumMemtables            int    `toml:"num_memtables"`
+	NumCompactors           int    `toml:"num_compactors"`
+	NumLevelZeroTables      int    `toml:"num_level_zero_tables"`
+	NumLevelZeroTablesStall int    `toml:"num_level_zero_tables_stall"`
+}
+
+type walConfig struct {
+	Dir  string `toml:"dir" comment:"dir of the logs, defaults to a subdir of data_dir, updates are not logged if empty"`
+	Sync bool   `toml:"sync" comment:"sync each update to disk before it is acknowledged"`
+}
+
+type treeConfig struct {
+	CacheHeightLimit      uint32 `toml:"cache_height_limit" comment:"used if a CreateTree request doesn't set one"`
+	AutoCommitUpdates     uint64 `toml:"auto_commit_updates" comment:"commit after this many updates, 0 to disable; the auto_commit_* limits are used if a CreateTree request doesn't set any"`
+	AutoCommitSeconds     uint64 `toml:"auto_commit_seconds" comment:"commit once the first update after the last commit is this old, 0 to disable"`
+	AutoCommitMemoryBytes uint64 `toml:"auto_commit_memory_bytes" comment:"commit once the updated nodes held in memory pass this estimated size, 0 to disable"`
+}
+
+type logConfig struct {
+	File         string `toml:"file" comment:"file to append the log to, stderr if empty"`
+	Microseconds bool   `toml:"microseconds" comment:"log timestamps w/microseconds"`
+	Badger       bool   `toml:"badger" comment:"include the log of the badger DBs"`
+}
+
+type limitConfig struct {
+	MaxRecvMsgSize       int    `toml:"max_recv_msg_size" comment:"bytes of a received message"`
+	MaxSendMsgSize       int    `toml:"max_send_msg_size" comment:"bytes of a sent message"`
+	MaxConcurrentStreams uint32 `toml:"max_concurrent_streams" comment:"concurrent calls per client connection"`
+	MaxUpdatePairs       int    `toml:"max_update_pairs" comment:"key / value pairs of an update"`
+	MaxBatchGetKeys      int    `toml:"max_batch_get_keys" comment:"keys of a BatchGet"`
+	MaxBatchProofKeys    int    `toml:"max_batch_proof_keys" comment:"keys of a BatchMerkleProof"`
+}
+
+// defaultConfig returns the config used for anything not set otherwise. The
+// aergo DB defaults to the options of the aergo-lib badger DB.
+func defaultConfig() *config {
+	aergoDB := badgerDefaults(badger.DefaultOptions(""))
+	aergoDB.TableLoadingMode = "fileio"
+	aergoDB.ValueLogLoadingMode = "fileio"
+	aergoDB.ValueThreshold = 1024
+	aergoDB.ValueLogFileSize = 1<<26 - 1
+
+	return &config{
+		Listen:  "127.0.0.1:9002",
+		AergoDB: aergoDB,
+		MetaDB:  badgerDefaults(badger.DefaultOptions("")),
+		WAL: walConfig{
+			Sync: true,
+		},
+		Log: logConfig{
+			Badger: true,
+		},
+		Limits: limitConfig{
+			MaxRecvMsgSize: 4 << 20,
+		},
+	}
+}
+
+// badgerDefaults returns the tunable options of opts.
+func badgerDefaults(opts badger.Options) badgerConfig {
+	return badgerConfig{
+		SyncWrites:              opts.SyncWrites,
+		TableLoadingMode:        loadingModeName(opts.TableLoadingMode),
+		ValueLogLoadingMode:     loadingModeName(opts.ValueLogLoadingMode),
+		ValueThreshold:          opts.ValueThreshold,
+		ValueLogFileSize:        opts.ValueLogFileSize,
+		MaxTableSize:            opts.MaxTableSize,
+		NumMemtables:            opts.NumMemtables,
+		NumCompactors:           opts.NumCompactors,
+		NumLevelZeroTables:      opts.NumLevelZeroTables,
+		NumLevelZeroTablesStall: opts.NumLevelZeroTablesStall,
+	}
+}
+
+var loadingModes = map[string]options.FileLoadingMode{
+	"fileio": options.FileIO,
+	"mmap":   options.MemoryMap,
+	"ram":    options.LoadToRAM,
+}
+
+func loadingModeName(mode options.FileLoadingMode) string {
+	for name, m := range loadingModes {
+		if m == mode {
+			return name
+		}
+	}
+	return ""
+}
+
+// options returns the badger options of the DB, logging to logger.
+func (c *badgerConfig) options(logger badger.Logger) (badger.Options, error) {
+	opts := badger.DefaultOptions(c.Dir)
+	opts.SyncWrites = c.SyncWrites
+	opts.ValueThreshold = c.ValueThreshold
+	opts.ValueLogFileSize = c.ValueLogFileSize
+	opts.MaxTableSize = c.MaxTableSize
+	opts.NumMemtables = c.NumMemtables
+	opts.NumCompactors = c.NumCompactors
+	opts.NumLevelZeroTables = c.NumLevelZeroTables
+	opts.NumLevelZeroTablesStall = c.NumLevelZeroTablesStall
+	opts.Logger = logger
+
+	var ok bool
+	opts.TableLoadingMode, ok = loadingModes[c.TableLoadingMode]
+	if !ok {
+		return opts, fmt.Errorf("unknown table loading mode [%v]", c.TableLoadingMode)
+	}
+	opts.ValueLogLoadingMode, ok = loadingModes[c.ValueLogLoadingMode]
+	if !ok || opts.ValueLogLoadingMode == options.LoadToRAM {
+		return opts, fmt.Errorf("unknown value log loading mode [%v]", c.ValueLogLoadingMode)
+	}
+	return opts, nil
+}
+
+// envVars maps environment variables to the config value they set.
+func (c *config) envVars() map[string]*string {
+	return map[string]*string{
+		"UNIDB_LISTEN":         &c.Listen,
+		"UNIDB_DIR":            &c.DataDir,
+		"UNIDB_METRICS_LISTEN": &c.MetricsListen,
+		"UNIDB_GATEWAY_LISTEN": &c.GatewayListen,
+		"UNIDB_ACL_FILE":       &c.ACLFile,
+		"UNIDB_TLS_CERT":       &c.TLS.Cert,
+		"UNIDB_TLS_KEY":        &c.TLS.Key,
+		"UNIDB_TLS_CLIENT_CA":  &c.TLS.ClientCA,
+	}
+}
+
+// flags registers the command-line flags overriding the config on fs.
+func (c *config) flags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Listen, "listen", c.Listen, "IP / port to serve gRPC on")
+	fs.StringVar(&c.DataDir, "dir", c.DataDir, "dir of the DBs")
+	fs.StringVar(&c.MetricsListen, "metrics-listen", c.MetricsListen, "IP / port to serve Prometheus metrics on")
+	fs.StringVar(&c.GatewayListen, "gateway-listen", c.GatewayListen, "IP / port to serve the JSON gateway on")
+	fs.StringVar(&c.ACLFile, "acl-file", c.ACLFile, "ACL policy `file`")
+	fs.StringVar(&c.TLS.Cert, "tls-cert", c.TLS.Cert, "server certificate `file`")
+	fs.StringVar(&c.TLS.Key, "tls-key", c.TLS.Key, "server key `file`")
+	fs.StringVar(&c.TLS.ClientCA, "tls-client-ca", c.TLS.ClientCA, "`file` of the CAs of required client certificates")
+	fs.StringVar(&c.Log.File, "log-file", c.Log.File, "`file` to append the log to")
+}
+
+// loadConfig builds the config from the defaults, the environment, the
+// config file given by -config or $UNIDB_CONFIG and the flags in args. It
+// also returns whether -print-config was given.
+func loadConfig(args []string) (*config, bool, error) {
+	// the flags are parsed first to find the config file, then again to
+	// override it
+	var file string
+	var printConfig bool
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.StringVar(&file, "config", os.Getenv("UNIDB_CONFIG"), "TOML config `file` ($UNIDB_CONFIG)")
+	fs.BoolVar(&printConfig, "print-config", false, "print the effective config and exit")
+	c := defaultConfig()
+	c.flags(fs)
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, false, err
+	}
+	if fs.NArg() != 0 {
+		return nil, false, fmt.Errorf("unexpected arguments %v", fs.Args())
+	}
+
+	c = defaultConfig()
+	for name, value := range c.envVars() {
+		if v := os.Getenv(name); v != "" {
+			*value = v
+		}
+	}
+	if file != "" {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, false, err
+		}
+		err = c.decode(data)
+		if err != nil {
+			return nil, false, fmt.Errorf("invalid config file [%v]: %v", file, err)
+		}
+	}
+	fs = flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.String("config", "", "")
+	fs.Bool("print-config", false, "")
+	c.flags(fs)
+	err = fs.Parse(args)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if c.AergoDB.Dir == "" && c.DataDir != "" {
+		c.AergoDB.Dir = filepath.Join(c.DataDir, "aergo")
+	}
+	if c.MetaDB.Dir == "" && c.DataDir != "" {
+		c.MetaDB.Dir = filepath.Join(c.DataDir, "meta")
+	}
+	if c.WAL.Dir == "" && c.DataDir != "" {
+		c.WAL.Dir = filepath.Join(c.DataDir, "wal")
+	}
+	return c, printConfig, nil
+}
+
+// decode sets the values in a TOML config file, rejecting unknown keys as
+// they are most likely typos.
+func (c *config) decode(data []byte) error {
+	tree, err := toml.LoadBytes(data)
+	if err != nil {
+		return err
+	}
+	err = tree.Unmarshal(c)
+	if err != nil {
+		return err
+	}
+
+	known, err := toml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	knownTree, err := toml.LoadBytes(known)
+	if err != nil {
+		return err
+	}
+	var unknown []string
+	for _, key := range leafKeys(tree, "") {
+		if !knownTree.Has(key) {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) != 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown keys %v", unknown)
+	}
+	return nil
+}
+
+// leafKeys returns the dotted keys of the values in tree.
+func leafKeys(tree *toml.Tree, prefix string) []string {
+	var keys []string
+	for _, key := range tree.Keys() {
+		if sub, ok := tree.GetPath([]string{key}).(*toml.Tree); ok {
+			keys = append(keys, leafKeys(sub, prefix+key+".")...)
+		} else {
+			keys = append(keys, prefix+key)
+		}
+	}
+	return keys
+}
+
+// serverOptions returns the gRPC server options enforcing the limits.
+func (c *limitConfig) serverOptions() []grpc.ServerOption {
+	opts := []grpc.ServerOption{grpc.MaxRecvMsgSize(math.MaxInt32)}
+	if c.MaxRecvMsgSize != 0 {
+		opts[0] = grpc.MaxRecvMsgSize(c.MaxRecvMsgSize)
+	}
+	if c.MaxSendMsgSize != 0 {
+		opts = append(opts, grpc.MaxSendMsgSize(c.MaxSendMsgSize))
+	}
+	if c.MaxConcurrentStreams != 0 {
+		opts = append(opts, grpc.MaxConcurrentStreams(c.MaxConcurrentStreams))
+	}
+	return opts
+}
+
+// print writes the config as TOML.
+func (c *config) print(w io.Writer) error {
+	data, err := toml.Marshal(c)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// setupLog directs the log to the configured file, and returns the logger
+// of the badger DBs.
+func (c *logConfig) setupLog() (badger.Logger, error) {
+	out := io.Writer(os.Stderr)
+	if c.File != "" {
+		f, err := os.OpenFile(c.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		out = f
+	}
+	flags := log.LstdFlags
+	if c.Microseconds {
+		flags |= log.Lmicroseconds
+	}
+	log.SetOutput(out)
+	log.SetFlags(flags)
+
+	if !c.Badger {
+		return nil, nil
+	}
+	return badgerLogger{log.New(out, "badger ", flags)}, nil
+}
+
+// badgerLogger logs the messages of a badger DB.
+type badgerLogger struct {
+	*log.Logger
+}
+
+func (l badgerLogger) Errorf(format string, a ...interface{}) {
+	l.Printf("ERROR: "+strings.TrimSuffix(format, "\n"), a...)
+}
+
+func (l badgerLogger) Warningf(format string, a ...interface{}) {
+	l.Printf("WARNING: "+strings.TrimSuffix(format, "\n"), a...)
+}
+
+func (l badgerLogger) Infof(format string, a ...interface{}) {
+	l.Printf("INFO: "+strings.TrimSuffix(format, "\n"), a...)
+}
+
+func (l badgerLogger) Debugf(format string, a ...interface{}) {
+	l.Printf("DEBUG: "+strings.TrimSuffix(format, "\n"), a...)
+}
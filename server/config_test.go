@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		file    string
+		unknown string
+	}{
+		{"known keys", "listen = \"x:1\"\n[trees]\ncache_height_limit = 8\n[aergo_db]\nnum_memtables = 2\n", ""},
+		{"unknown key", "listn = \"x:1\"\n", "listn"},
+		{"unknown nested key", "[trees]\ncache_hight_limit = 8\n", "trees.cache_hight_limit"},
+		{"unknown table", "[wall]\nsync = true\n", "wall.sync"},
+	}
+
+	for _, tt := range tests {
+		err := defaultConfig().decode([]byte(tt.file))
+		switch {
+		case tt.unknown == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.unknown != "" && (err == nil || !strings.Contains(err.Error(), tt.unknown)):
+			t.Errorf("%s: got error %v, expected unknown key [%v]", tt.name, err, tt.unknown)
+		}
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "unidb.toml")
+	err := ioutil.WriteFile(file, []byte("listen = \"file:1\"\ndata_dir = \"/file\"\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	env := map[string]string{
+		"UNIDB_LISTEN":         "env:1",
+		"UNIDB_DIR":            "/env",
+		"UNIDB_METRICS_LISTEN": "env:2",
+	}
+	for name, value := range env {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+
+	// flags override the file, which overrides the environment
+	c, printConfig, err := loadConfig([]string{"-config", file, "-listen", "flag:1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if printConfig {
+		t.Error("got print-config w/o the flag")
+	}
+	for _, tt := range []struct {
+		name, got, want string
+	}{
+		{"listen", c.Listen, "flag:1"},
+		{"data_dir", c.DataDir, "/file"},
+		{"metrics_listen", c.MetricsListen, "env:2"},
+		{"aergo_db.dir", c.AergoDB.Dir, filepath.Join("/file", "aergo")},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("%s: got [%v], expected [%v]", tt.name, tt.got, tt.want)
+		}
+	}
+
+	// w/o a file, flags override the environment
+	c, _, err = loadConfig([]string{"-dir", "/flag"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Listen != "env:1" || c.DataDir != "/flag" {
+		t.Errorf("got listen [%v] and data_dir [%v], expected [env:1] and [/flag]", c.Listen, c.DataDir)
+	}
+}
+
+func TestPrintConfig(t *testing.T) {
+	c, printConfig, err := loadConfig([]string{"-print-config", "-listen", "x:1", "-dir", "/data"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !printConfig {
+		t.Error("got no print-config w/the flag")
+	}
+	c.Trees.AutoCommitUpdates = 100
+	c.AergoDB.TableLoadingMode = "ram"
+
+	// the printed config is a valid config file giving the same config
+	var buf bytes.Buffer
+	err = c.print(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := defaultConfig()
+	err = read.decode(buf.Bytes())
+	if err != nil {
+		t.Fatalf("printed config doesn't decode: %v\n%s", err, buf.Bytes())
+	}
+	if !reflect.DeepEqual(read, c) {
+		t.Errorf("got config %+v after printing, expected %+v", read, c)
+	}
+}
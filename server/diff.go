@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+
+	"github.com/aergoio/aergo/pkg/trie"
+)
+
+// diffFunc is called for every key which differs between two tries, w/a nil
+// oldValue for added keys and a nil newValue for removed keys.
+type diffFunc func(key, oldValue, newValue []byte) error
+
+// diff calls fn for every key which differs between the tries at from and
+// to, in key order. Both tries are walked together and subtrees w/the same
+// hash are skipped without being loaded.
+func (r *nodeReader) diff(from, to []byte, fn diffFunc) error {
+	return r.diffNode(from, nil, 0, to, nil, 0, r.trieHeight, fn)
+}
+
+func (r *nodeReader) diffNode(from []byte, fromBatch [][]byte, fromIBatch int, to []byte, toBatch [][]byte, toIBatch int, height int, fn diffFunc) error {
+	switch {
+	case len(from) == 0 && len(to) == 0:
+		return nil
+	case len(from) == 0:
+		return r.walkNode(to, nil, toBatch, toIBatch, height, func(key, value []byte) error {
+			return fn(key, nil, value)
+		})
+	case len(to) == 0:
+		return r.walkNode(from, nil, fromBatch, fromIBatch, height, func(key, value []byte) error {
+			return fn(key, value, nil)
+		})
+	case bytes.Equal(from[:trie.HashLength], to[:trie.HashLength]):
+		return nil
+	}
+
+	fBatch, fIBatch, flnode, frnode, fIsShortcut, err := r.loadChildren(from, height, fromIBatch, fromBatch)
+	if err != nil {
+		return err
+	}
+	tBatch, tIBatch, tlnode, trnode, tIsShortcut, err := r.loadChildren(to, height, toIBatch, toBatch)
+	if err != nil {
+		return err
+	}
+	if fIsShortcut || height == 0 {
+		return r.diffShortcut(flnode[:trie.HashLength], frnode[:trie.HashLength], to, toBatch, toIBatch, height, false, fn)
+	}
+	if tIsShortcut {
+		return r.diffShortcut(tlnode[:trie.HashLength], trnode[:trie.HashLength], from, fromBatch, fromIBatch, height, true, fn)
+	}
+
+	err = r.diffNode(flnode, fBatch, 2*fIBatch+1, tlnode, tBatch, 2*tIBatch+1, height-1, fn)
+	if err != nil {
+		return err
+	}
+	return r.diffNode(frnode, fBatch, 2*fIBatch+2, trnode, tBatch, 2*tIBatch+2, height-1, fn)
+}
+
+// diffShortcut diffs the single key of a shortcut against the subtree at
+// node, which is at the same position in the other trie. The shortcut is on
+// the from side, or on the to side w/reverse set.
+func (r *nodeReader) diffShortcut(key, value []byte, node []byte, batch [][]byte, iBatch, height int, reverse bool, fn diffFunc) error {
+	emit := func(k, shortcutValue, nodeValue []byte) error {
+		if reverse {
+			return fn(k, nodeValue, shortcutValue)
+		}
+		return fn(k, shortcutValue, nodeValue)
+	}
+
+	done := false
+	err := r.walkNode(node, nil, batch, iBatch, height, func(k, v []byte) error {
+		switch c := bytes.Compare(k, key); {
+		case c == 0:
+			done = true
+			if bytes.Equal(v, value) {
+				return nil
+			}
+			return emit(k, value, v)
+		case c > 0 && !done:
+			done = true
+			err := emit(key, value, nil)
+			if err != nil {
+				return err
+			}
+		}
+		return emit(k, nil, v)
+	})
+	if err != nil || done {
+		return err
+	}
+	return emit(key, value, nil)
+}
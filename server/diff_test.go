@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/aergoio/aergo-lib/db"
+	"github.com/aergoio/aergo/pkg/trie"
+	"github.com/dashevo/universe-tree-db/universe"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestDiff(t *testing.T) {
+	// modified returns pairs w/the keys of testPairs but other values
+	modified := func(n, off int) []*universe.KeyValuePair {
+		pairs := testPairs(n, off)
+		for _, p := range pairs {
+			p.Value = Sha256(p.Value)
+		}
+		return pairs
+	}
+	join := func(lists ...[]*universe.KeyValuePair) []*universe.KeyValuePair {
+		var pairs []*universe.KeyValuePair
+		for _, l := range lists {
+			pairs = append(pairs, l...)
+		}
+		return pairs
+	}
+
+	tests := []struct {
+		name     string
+		from, to []*universe.KeyValuePair
+	}{
+		{"shortcut vs interior", testPairs(1, 0), testPairs(50, 0)},
+		{"interior vs shortcut", testPairs(50, 0), testPairs(1, 0)},
+		{"shortcut vs interior w/o the key", testPairs(1, 100), testPairs(50, 0)},
+		{"shortcut vs shortcut", testPairs(1, 0), testPairs(1, 1)},
+		{"shortcut vs modified shortcut", testPairs(1, 0), modified(1, 0)},
+		{"empty vs tree", nil, testPairs(50, 0)},
+		{"tree vs empty", testPairs(50, 0), nil},
+		{"both empty", nil, nil},
+		{"identical", testPairs(200, 0), testPairs(200, 0)},
+		{"added, removed and modified", join(testPairs(200, 0), testPairs(20, 1000)), join(modified(20, 0), testPairs(160, 20), testPairs(30, 2000))},
+	}
+
+	for _, tt := range tests {
+		store := db.NewDB(db.MemoryImpl, "")
+		from := commitPairs(t, store, tt.from)
+		to := commitPairs(t, store, tt.to)
+
+		var got []string
+		err := newNodeReader(store, trie.HashLength*8).diff(from, to, func(key, oldValue, newValue []byte) error {
+			got = append(got, diffLine(key, oldValue, newValue))
+			return nil
+		})
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		want := diffPairs(tt.from, tt.to)
+		if len(got) != len(want) {
+			t.Errorf("%s: got %d changes, expected %d: %v", tt.name, len(got), len(want), got)
+			continue
+		}
+		for i := range want {
+			if got[i] != want[i] {
+				t.Errorf("%s: change %d: got %v, expected %v", tt.name, i, got[i], want[i])
+			}
+		}
+	}
+}
+
+func TestDiffUncommittedRoot(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	s := openTestServer(t, dir)
+	defer closeTestServer(s)
+	ctx := context.Background()
+
+	_, err := s.CreateTree(ctx, &universe.CreateTreeRequest{Name: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	update(t, s, "x", testPairs(10, 0))
+	_, err = s.Commit(ctx, &universe.CommitRequest{TreeName: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	committed := s.trieInfo["x"].committedRoot
+	uncommitted := update(t, s, "x", testPairs(10, 100))
+
+	stream := &diffStream{}
+	err = s.Diff(&universe.DiffRequest{TreeName: "x", FromRoot: committed, ToRoot: uncommitted}, stream)
+	if code := status.Code(err); code != codes.NotFound || len(stream.replies) != 0 {
+		t.Errorf("got code %v w/%d changes, expected %v", code, len(stream.replies), codes.NotFound)
+	}
+	// w/o a root, the tree must be committed
+	stream = &diffStream{}
+	err = s.Diff(&universe.DiffRequest{TreeName: "x", FromRoot: committed}, stream)
+	if code := status.Code(err); code != codes.FailedPrecondition {
+		t.Errorf("got code %v, expected %v", code, codes.FailedPrecondition)
+	}
+	_, err = s.Commit(ctx, &universe.CommitRequest{TreeName: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream = &diffStream{}
+	err = s.Diff(&universe.DiffRequest{TreeName: "x", FromRoot: committed, ToRoot: uncommitted}, stream)
+	if err != nil || len(stream.replies) != 10 {
+		t.Errorf("got %d changes, err: %v, expected 10 once committed", len(stream.replies), err)
+	}
+}
+
+// commitPairs commits a trie of pairs to store and returns its root.
+func commitPairs(t *testing.T, store db.DB, pairs []*universe.KeyValuePair) []byte {
+	t.Helper()
+	if len(pairs) == 0 {
+		return nil
+	}
+	keys, values, err := updatePairs("x", pairs, trie.HashLength, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	smt := trie.NewTrie(nil, Sha256, store)
+	root, err := smt.Update(keys, values)
+	if err == nil {
+		err = smt.Commit()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return root
+}
+
+// diffPairs returns the changes from the pairs from to the pairs to, in key
+// order.
+func diffPairs(from, to []*universe.KeyValuePair) []string {
+	old := make(map[string][]byte)
+	for _, p := range from {
+		old[string(p.Key)] = p.Value
+	}
+	changes := make(map[string]string)
+	for _, p := range to {
+		v, ok := old[string(p.Key)]
+		delete(old, string(p.Key))
+		if !ok || !bytes.Equal(v, p.Value) {
+			changes[string(p.Key)] = diffLine(p.Key, v, p.Value)
+		}
+	}
+	for k, v := range old {
+		changes[k] = diffLine([]byte(k), v, nil)
+	}
+
+	keys := make([]string, 0, len(changes))
+	for k := range changes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	lines := make([]string, len(keys))
+	for i, k := range keys {
+		lines[i] = changes[k]
+	}
+	return lines
+}
+
+// diffLine formats a change, w/an empty value for added or removed keys.
+func diffLine(key, oldValue, newValue []byte) string {
+	return fmt.Sprintf("[%x]: [%x] -> [%x]", key, oldValue, newValue)
+}
+
+// diffStream collects the replies of Diff.
+type diffStream struct {
+	grpc.ServerStream
+	replies []*universe.DiffReply
+}
+
+func (st *diffStream) Send(r *universe.DiffReply) error {
+	st.replies = append(st.replies, r)
+	return nil
+}
+
+func (st *diffStream) Context() context.Context {
+	return context.Background()
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aergoio/aergo-lib/db"
+	"github.com/aergoio/aergo/pkg/trie"
+	"github.com/dashevo/universe-tree-db/universe"
+)
+
+// errStopped is returned by a reclaim interrupted by a shutdown. The drop
+// stays pending in the meta DB and is resumed on the next start.
+var errStopped = errors.New("server is shutting down")
+
+// dropTask tracks the background reclaim of the nodes of a dropped tree.
+type dropTask struct {
+	universe.DropProgress
+	sync.Mutex
+}
+
+// progress returns a copy of the current progress.
+func (d *dropTask) progress() *universe.DropProgress {
+	d.Lock()
+	defer d.Unlock()
+
+	return &universe.DropProgress{
+		Name:         d.Name,
+		Roots:        d.Roots,
+		State:        d.State,
+		NodesDeleted: d.NodesDeleted,
+		NodesShared:  d.NodesShared,
+		Error:        d.Error,
+		StartedAt:    d.StartedAt,
+		FinishedAt:   d.FinishedAt,
+	}
+}
+
+// finished reports whether the reclaim is no longer running or queued.
+func (d *dropTask) finished() bool {
+	d.Lock()
+	defer d.Unlock()
+
+	return d.State == universe.DropState_DROP_DONE || d.State == universe.DropState_DROP_FAILED
+}
+
+// startDrop starts reclaiming the nodes of a dropped tree in the background.
+// Expected to be called w/lock.
+func (s *universeTrieServer) startDrop(dp *universe.DropProgress) {
+	d := &dropTask{DropProgress: *dp}
+	s.drops[dp.Name] = d
+	go s.reclaim(d)
+}
+
+// reclaim deletes all the nodes reachable from the roots of a dropped tree
+// which are not shared with any live tree.
+//
+// Nodes are content addressed, so a node can only be shared with another tree
+// which has the very same subtree at the very same position. The dropped tree
+// is therefore walked alongside the committed and versioned roots of every
+// live or importing tree and the walk stops at the first node one of them
+// also has.
+func (s *universeTrieServer) reclaim(d *dropTask) {
+	d.Lock()
+	d.State = universe.DropState_DROP_RUNNING
+	d.Unlock()
+	log.Printf("DropTree: reclaiming nodes of tree [%v]", d.Name)
+
+	// no commits while sweeping, a commit could write back a node which was
+	// just found to be unshared. The owners are collected w/nodeLock too: a
+	// tree created or imported later writes its nodes after the sweep.
+	s.RLock()
+	s.nodeLock.Lock()
+	trees := s.nodeOwners()
+	s.RUnlock()
+	defer s.nodeLock.Unlock()
+
+	if s.closed {
+		// shut down in the meantime, the drop is still pending in the meta DB
+		return
+	}
+
+	var peers []peerNode
+	var err error
+	for _, ti := range trees {
+		var roots [][]byte
+		roots, err = s.treeRoots(ti)
+		if err != nil {
+			break
+		}
+		for _, root := range roots {
+			peers = append(peers, peerNode{node: root})
+		}
+	}
+
+	sw := &sweeper{
+		reader: newNodeReader(s.aergoDB, trie.HashLength*8),
+		quit:   s.quit,
+		task:   d,
+	}
+	if err == nil {
+		err = sw.checkQuit()
+	}
+	if err == nil {
+		sw.bulk = s.aergoDB.NewBulk()
+		for _, root := range d.Roots {
+			err = sw.sweep(root, nil, 0, peers, sw.reader.trieHeight)
+			if err != nil {
+				break
+			}
+		}
+		sw.bulk.Flush()
+	}
+
+	d.Lock()
+	switch err {
+	case nil:
+		d.State = universe.DropState_DROP_DONE
+		d.FinishedAt = time.Now().Unix()
+	case errStopped:
+		d.State = universe.DropState_DROP_PENDING
+	default:
+		d.State = universe.DropState_DROP_FAILED
+		d.Error = err.Error()
+		d.FinishedAt = time.Now().Unix()
+	}
+	d.Unlock()
+	dp := d.progress()
+
+	log.Printf("DropTree: reclaim of tree [%v] %v, %d nodes deleted, %d nodes shared: %v", dp.Name, dp.State, dp.NodesDeleted, dp.NodesShared, err)
+	if dp.State == universe.DropState_DROP_DONE {
+		err = s.MetaDeleteDropProgress(dp.Name)
+	} else {
+		err = s.MetaSetDropProgress(dp)
+	}
+	if err != nil {
+		log.Printf("DropTree: could not save reclaim progress of tree [%v]: %v", dp.Name, err)
+	}
+}
+
+// peerNode is the node of a live tree at the same position as the node being
+// swept.
+type peerNode struct {
+	node   []byte
+	batch  [][]byte
+	iBatch int
+}
+
+// sweeper deletes the unshared nodes of a dropped tree.
+type sweeper struct {
+	reader *nodeReader
+	bulk   db.Bulk
+	quit   <-chan struct{}
+	task   *dropTask
+}
+
+// checkQuit returns errStopped once the server is shutting down.
+func (sw *sweeper) checkQuit() error {
+	select {
+	case <-sw.quit:
+		return errStopped
+	default:
+		return nil
+	}
+}
+
+// sweep deletes the subtree at root unless one of the peers has the same
+// subtree.
+func (sw *sweeper) sweep(root []byte, batch [][]byte, iBatch int, peers []peerNode, height int) error {
+	if len(root) == 0 {
+		return nil
+	}
+	for _, p := range peers {
+		if len(p.node) != 0 && bytes.Equal(p.node[:trie.HashLength], root[:trie.HashLength]) {
+			if height%4 == 0 {
+				sw.task.Lock()
+				sw.task.NodesShared++
+				sw.task.Unlock()
+			}
+			return nil
+		}
+	}
+
+	batch, iBatch, lnode, rnode, isShortcut, err := sw.reader.loadChildren(root, height, iBatch, batch)
+	if isNotFound(err) {
+		// never committed or already reclaimed
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if height%4 == 0 {
+		if err := sw.checkQuit(); err != nil {
+			return err
+		}
+		sw.bulk.Delete(root[:trie.HashLength])
+		sw.task.Lock()
+		sw.task.NodesDeleted++
+		if sw.task.NodesDeleted%10000 == 0 {
+			log.Printf("DropTree: reclaiming tree [%v], %d nodes deleted", sw.task.Name, sw.task.NodesDeleted)
+		}
+		sw.task.Unlock()
+	}
+	if isShortcut || height == 0 {
+		return nil
+	}
+
+	// many roots share most of their nodes, only follow each node once
+	var lpeers, rpeers []peerNode
+	seen := make(map[string]bool)
+	for _, p := range peers {
+		if len(p.node) == 0 || seen[string(p.node[:trie.HashLength])] {
+			continue
+		}
+		seen[string(p.node[:trie.HashLength])] = true
+		pbatch, piBatch, plnode, prnode, pIsShortcut, err := sw.reader.loadChildren(p.node, height, p.iBatch, p.batch)
+		if isNotFound(err) {
+			// lost to a revert, so there is nothing to share
+			continue
+		}
+		if err != nil {
+			// can't tell what a live tree shares, better keep everything
+			return err
+		}
+		if pIsShortcut {
+			continue
+		}
+		lpeers = append(lpeers, peerNode{node: plnode, batch: pbatch, iBatch: 2*piBatch + 1})
+		rpeers = append(rpeers, peerNode{node: prnode, batch: pbatch, iBatch: 2*piBatch + 2})
+	}
+
+	err = sw.sweep(lnode, batch, 2*iBatch+1, lpeers, height-1)
+	if err != nil {
+		return err
+	}
+	return sw.sweep(rnode, batch, 2*iBatch+2, rpeers, height-1)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/dashevo/universe-tree-db/universe"
+)
+
+func TestReclaimSharedNodes(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	s := openTestServer(t, dir)
+	defer closeTestServer(s)
+	ctx := context.Background()
+
+	// tree 'b' is forked from the first commit of tree 'a', after which both
+	// get nodes of their own
+	_, err := s.CreateTree(ctx, &universe.CreateTreeRequest{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit := func(treeName string, pairs []*universe.KeyValuePair) []byte {
+		_, err := s.Update(ctx, &universe.UpdateRequest{TreeName: treeName, KeyValuePairs: pairs, SortPairs: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = s.Commit(ctx, &universe.CommitRequest{TreeName: treeName})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s.trieInfo[treeName].committedRoot
+	}
+	shared := commit("a", testPairs(200, 0))
+	_, err = s.ForkTree(ctx, &universe.ForkTreeRequest{Name: "b", SourceTreeName: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	unshared := commit("a", testPairs(100, 1000))
+	forked := commit("b", testPairs(100, 2000))
+
+	_, err = s.DropTree(ctx, &universe.DropTreeRequest{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dp := waitDrop(t, s, "a")
+	if dp.State != universe.DropState_DROP_DONE {
+		t.Fatalf("drop ended in state %v: %v", dp.State, dp.Error)
+	}
+	if dp.NodesDeleted == 0 || dp.NodesShared == 0 {
+		t.Errorf("got %d nodes deleted and %d shared, expected both", dp.NodesDeleted, dp.NodesShared)
+	}
+
+	if len(s.aergoDB.Get(unshared)) != 0 {
+		t.Errorf("root [%x] only used by the dropped tree was kept", unshared)
+	}
+	reader := newNodeReader(s.aergoDB, s.trieInfo["b"].trie.TrieHeight)
+	for _, tt := range []struct {
+		root []byte
+		keys uint64
+	}{
+		{shared, 200},
+		{forked, 300},
+	} {
+		keys, err := reader.countLeaves(tt.root)
+		if err != nil || keys != tt.keys {
+			t.Errorf("root [%x]: got %d keys, err: %v, expected %d keys", tt.root, keys, err, tt.keys)
+		}
+	}
+}
+
+func TestRecreateDuringReclaim(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	s := openTestServer(t, dir)
+	defer closeTestServer(s)
+	ctx := context.Background()
+
+	// the recreated tree has the very same nodes as the dropped one, which
+	// must survive however its commit and the reclaim interleave
+	pairs := testPairs(300, 0)
+	for i := 0; i < 10; i++ {
+		_, err := s.CreateTree(ctx, &universe.CreateTreeRequest{Name: "a"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		update(t, s, "a", pairs)
+		_, err = s.Commit(ctx, &universe.CommitRequest{TreeName: "a"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i != 0 {
+			dp := waitDrop(t, s, "a")
+			if dp.State != universe.DropState_DROP_DONE {
+				t.Fatalf("drop ended in state %v: %v", dp.State, dp.Error)
+			}
+			root := s.trieInfo["a"].committedRoot
+			keys, err := newNodeReader(s.aergoDB, s.trieInfo["a"].trie.TrieHeight).countLeaves(root)
+			if err != nil || keys != uint64(len(pairs)) {
+				t.Fatalf("round %d: got %d keys, err: %v, expected %d keys", i, keys, err, len(pairs))
+			}
+		}
+		if i != 9 {
+			_, err = s.DropTree(ctx, &universe.DropTreeRequest{Name: "a"})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+// waitDrop waits for the reclaim of a dropped tree to finish.
+func waitDrop(t *testing.T, s *universeTrieServer, treeName string) *universe.DropProgress {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		s.RLock()
+		d := s.drops[treeName]
+		s.RUnlock()
+		if d != nil && d.finished() {
+			return d.progress()
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("reclaim of tree [%v] did not finish", treeName)
+	return nil
+}
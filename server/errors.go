@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/golang/protobuf/proto"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Errors returned to clients carry a gRPC status code and details telling
+// which tree (errdetails.ResourceInfo) and which request field, e.g.
+// "keys[3]" (errdetails.BadRequest), they are about. Any error which isn't a
+// status by the time it leaves a handler is turned into one by the status
+// interceptors.
+
+// resourceTypeTree is the resource type of the ResourceInfo of a tree.
+const resourceTypeTree = "tree"
+
+// treeError returns an error w/code c about the tree treeName.
+func treeError(c codes.Code, treeName string, format string, a ...interface{}) error {
+	return statusWithDetails(status.Newf(c, format, a...), treeResource(treeName))
+}
+
+// treeNotFound returns the error for a tree which is not in the trie map.
+func treeNotFound(treeName string) error {
+	return treeError(codes.NotFound, treeName, "tree [%v] not found", treeName)
+}
+
+// fieldError returns an InvalidArgument error about a field of a request on
+// the tree treeName, which may be empty if the request isn't about a tree.
+func fieldError(treeName, field string, format string, a ...interface{}) error {
+	msg := fmt.Sprintf(format, a...)
+	details := []proto.Message{
+		&errdetails.BadRequest{
+			FieldViolations: []*errdetails.BadRequest_FieldViolation{
+				{Field: field, Description: msg},
+			},
+		},
+	}
+	if treeName != "" {
+		details = append(details, treeResource(treeName))
+	}
+	return statusWithDetails(status.New(codes.InvalidArgument, msg), details...)
+}
+
+func treeResource(treeName string) *errdetails.ResourceInfo {
+	return &errdetails.ResourceInfo{
+		ResourceType: resourceTypeTree,
+		ResourceName: treeName,
+	}
+}
+
+// statusWithDetails returns the status w/the details attached as an error.
+func statusWithDetails(st *status.Status, details ...proto.Message) error {
+	withDetails, err := st.WithDetails(details...)
+	if err != nil {
+		// the details always marshal, but rather lose them than the error
+		return st.Err()
+	}
+	return withDetails.Err()
+}
+
+// toStatusError maps an error returned by a handler to a status error. Errors
+// which aren't a status already are Internal, unless caused by a missing trie
+// node or a cancelled call.
+func toStatusError(err error) error {
+	if err == nil {
+		return nil
+	}
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+	switch {
+	case err == context.Canceled:
+		return status.Error(codes.Canceled, err.Error())
+	case err == context.DeadlineExceeded:
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	case isNotFound(err):
+		return status.Error(codes.NotFound, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// unaryStatusInterceptor makes sure unary calls fail w/a status error.
+func unaryStatusInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	resp, err := handler(ctx, req)
+	return resp, toStatusError(err)
+}
+
+// streamStatusInterceptor makes sure streaming calls fail w/a status error.
+func streamStatusInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	return toStatusError(handler(srv, ss))
+}
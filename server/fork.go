@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+
+	"github.com/dashevo/universe-tree-db/universe"
+	"google.golang.org/grpc/codes"
+)
+
+// A fork is a new tree starting at a committed root of another tree. It
+// shares the nodes of that root w/the source tree instead of copying them.
+// Nodes are content addressed and never changed in place, so updates of
+// either tree write new nodes and leave the shared ones alone, and dropping
+// either tree only reclaims the nodes no other tree references.
+//
+// Revert however deletes the nodes of the reverted roots w/o checking other
+// trees, so it is refused for the trees of a fork group, i.e. trees which
+// were forked or are forks. RevertToVersion deletes no nodes and works
+// instead.
+
+// forkGroupBytes is the size of the random id of a fork group.
+const forkGroupBytes = 16
+
+// newForkGroup returns the id of a new fork group.
+func newForkGroup() (string, error) {
+	id := make([]byte, forkGroupBytes)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// forkSource returns the root of a source tree to fork and its key count:
+// root if set, else the root of version, else the last committed root.
+// Uncommitted changes of the source tree are never forked.
+// Expected to be called w/tree read lock.
+func (s *universeTrieServer) forkSource(ti *TreeInfo, root []byte, version uint64) ([]byte, uint64, error) {
+	var keyCount uint64
+	switch {
+	case len(root) != 0 && bytes.Equal(root, ti.committedRoot):
+		return ti.committedRoot, ti.committedKeyCount, nil
+	case len(root) != 0:
+		versions, err := s.MetaListVersions(ti.Name, 0, 0)
+		if err != nil {
+			return nil, 0, err
+		}
+		var found *universe.TreeVersion
+		for _, v := range versions {
+			if bytes.Equal(v.Root, root) {
+				found = v
+			}
+		}
+		if found == nil {
+			return nil, 0, treeError(codes.FailedPrecondition, ti.Name, "root [%x] is not a committed root of tree [%v]", root, ti.Name)
+		}
+		keyCount = found.KeyCount
+	case version != 0:
+		v, err := s.getVersion(ti.Name, version)
+		if err != nil {
+			return nil, 0, err
+		}
+		root, keyCount = v.Root, v.KeyCount
+	default:
+		return ti.committedRoot, ti.committedKeyCount, nil
+	}
+
+	if len(root) != 0 && !ti.trie.TrieRootExists(root) {
+		return nil, 0, treeError(codes.FailedPrecondition, ti.Name, "tree [%v] root [%x] is no longer in storage", ti.Name, root)
+	}
+	return root, keyCount, nil
+}
+
+// checkNotForked returns an error if a tree shares nodes w/other trees as
+// it is part of a fork group.
+// Expected to be called w/tree read lock.
+func (ti *TreeInfo) checkNotForked() error {
+	if ti.ForkGroup != "" {
+		return treeError(codes.FailedPrecondition, ti.Name, "tree [%v] shares nodes w/its forks and can't be reverted, revert it to a version instead", ti.Name)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+
+	"github.com/dashevo/universe-tree-db/universe"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestForkTree(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+
+	s := openTestServer(t, dir)
+	var versionRoots [][]byte
+	for i, treeName := range []string{"src", "other"} {
+		_, err := s.CreateTree(ctx, &universe.CreateTreeRequest{Name: treeName})
+		if err != nil {
+			t.Fatal(err)
+		}
+		update(t, s, treeName, testPairs(10, i*1000))
+		_, err = s.Commit(ctx, &universe.CommitRequest{TreeName: treeName})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	versionRoots = append(versionRoots, s.trieInfo["src"].committedRoot)
+	update(t, s, "src", testPairs(10, 100))
+	_, err := s.Commit(ctx, &universe.CommitRequest{TreeName: "src"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	versionRoots = append(versionRoots, s.trieInfo["src"].committedRoot)
+
+	// failed forks leave the source alone
+	for _, tt := range []struct {
+		name string
+		req  *universe.ForkTreeRequest
+		code codes.Code
+	}{
+		{"existing name", &universe.ForkTreeRequest{Name: "other", SourceTreeName: "src"}, codes.AlreadyExists},
+		{"source name", &universe.ForkTreeRequest{Name: "src", SourceTreeName: "src"}, codes.AlreadyExists},
+		{"unknown source", &universe.ForkTreeRequest{Name: "fork", SourceTreeName: "none"}, codes.NotFound},
+		{"root of another tree", &universe.ForkTreeRequest{Name: "fork", SourceTreeName: "src", SourceRoot: s.trieInfo["other"].committedRoot}, codes.FailedPrecondition},
+		{"unknown version", &universe.ForkTreeRequest{Name: "fork", SourceTreeName: "src", SourceVersion: 9}, codes.NotFound},
+	} {
+		_, err := s.ForkTree(ctx, tt.req)
+		if code := status.Code(err); code != tt.code {
+			t.Errorf("%s: got code %v, expected %v: %v", tt.name, code, tt.code, err)
+		}
+	}
+	if _, ok := s.trieInfo["fork"]; ok || s.trieInfo["src"].ForkGroup != "" {
+		t.Fatal("failed fork left a tree or a fork group behind")
+	}
+
+	// at the root of the first version, by version and by root
+	for _, req := range []*universe.ForkTreeRequest{
+		{Name: "fork", SourceTreeName: "src", SourceVersion: 1},
+		{Name: "fork2", SourceTreeName: "src", SourceRoot: versionRoots[0]},
+	} {
+		info, err := s.ForkTree(ctx, req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(info.GetRoot(), versionRoots[0]) || info.GetKeyCount() != 10 || info.GetForkedFrom() != "src" {
+			t.Errorf("fork [%v]: got root [%x] w/%d keys forked from [%v], expected [%x] w/10 keys from [src]", req.Name, info.GetRoot(), info.GetKeyCount(), info.GetForkedFrom(), versionRoots[0])
+		}
+	}
+	update(t, s, "fork", testPairs(10, 200))
+	_, err = s.Commit(ctx, &universe.CommitRequest{TreeName: "fork"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.Revert(ctx, &universe.RevertRequest{TreeName: "src", ToOldRoot: versionRoots[0]})
+	if code := status.Code(err); code != codes.FailedPrecondition {
+		t.Errorf("revert of a forked tree: got code %v, expected %v", code, codes.FailedPrecondition)
+	}
+	closeTestServer(s)
+
+	// the trees keep their nodes and fork group across a restart
+	s = openTestServer(t, dir)
+	defer closeTestServer(s)
+	src, fork := s.trieInfo["src"], s.trieInfo["fork"]
+	if src.ForkGroup == "" || fork.ForkGroup != src.ForkGroup || s.trieInfo["fork2"].ForkGroup != src.ForkGroup {
+		t.Errorf("got fork groups [%v], [%v] and [%v], expected the same one", src.ForkGroup, fork.ForkGroup, s.trieInfo["fork2"].ForkGroup)
+	}
+	reader := newNodeReader(s.aergoDB, src.trie.TrieHeight)
+	for _, tt := range []struct {
+		name string
+		root []byte
+		keys uint64
+	}{
+		{"src", src.committedRoot, 20},
+		{"fork", fork.committedRoot, 20},
+		{"fork2", s.trieInfo["fork2"].committedRoot, 10},
+	} {
+		keys, err := reader.countLeaves(tt.root)
+		if err != nil || keys != tt.keys {
+			t.Errorf("%s: got %d keys, err: %v, expected %d", tt.name, keys, err, tt.keys)
+		}
+	}
+	value, err := src.trie.Get(testPairs(1, 200)[0].Key)
+	if err != nil || len(value) != 0 {
+		t.Errorf("got value [%x] of a key of the fork in the source, err: %v", value, err)
+	}
+}
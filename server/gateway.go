@@ -0,0 +1,405 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/dashevo/universe-tree-db/universe"
+	"github.com/golang/protobuf/proto"
+	"github.com/golang/protobuf/protoc-gen-go/descriptor"
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// The gateway serves each RPC of the UniTreeDB service as POST
+// /v1/<method> w/the request as JSON body, see hexjson.go for the encoding.
+// Streamed requests and replies are newline delimited JSON. The OpenAPI
+// description is served at /openapi.json.
+//
+// Calls are authorized by the gateway w/the bearer token in the
+// Authorization header or the client certificate of the HTTPS connection,
+// then made to an in-process gRPC server which shares the interceptors of
+// the main server, except for the authorization.
+
+// gatewayPathPrefix is the path prefix of the RPC endpoints.
+const gatewayPathPrefix = "/v1/"
+
+// gatewayBufferSize is the size of the in-process connection to the gRPC
+// server.
+const gatewayBufferSize = 1 << 20
+
+// gatewayMethod is an RPC served by the gateway.
+type gatewayMethod struct {
+	name       string
+	fullMethod string
+	// reqType and respType are the message struct types
+	reqType       reflect.Type
+	respType      reflect.Type
+	clientStreams bool
+	serverStreams bool
+}
+
+// uniTreeDBMethods returns the RPCs of the UniTreeDB service, as described in
+// the registered universe.proto.
+func uniTreeDBMethods() ([]gatewayMethod, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(proto.FileDescriptor("universe.proto")))
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, err
+	}
+	var fd descriptor.FileDescriptorProto
+	err = proto.Unmarshal(data, &fd)
+	if err != nil {
+		return nil, err
+	}
+
+	var methods []gatewayMethod
+	for _, service := range fd.GetService() {
+		if fd.GetPackage()+"."+service.GetName() != uniTreeDBService {
+			continue
+		}
+		for _, md := range service.GetMethod() {
+			m := gatewayMethod{
+				name:          md.GetName(),
+				fullMethod:    uniTreeDBMethodPrefix + md.GetName(),
+				reqType:       proto.MessageType(strings.TrimPrefix(md.GetInputType(), ".")),
+				respType:      proto.MessageType(strings.TrimPrefix(md.GetOutputType(), ".")),
+				clientStreams: md.GetClientStreaming(),
+				serverStreams: md.GetServerStreaming(),
+			}
+			if m.reqType == nil || m.respType == nil {
+				return nil, fmt.Errorf("message types of method [%v] are not registered", m.name)
+			}
+			m.reqType, m.respType = m.reqType.Elem(), m.respType.Elem()
+			methods = append(methods, m)
+		}
+	}
+	return methods, nil
+}
+
+// gateway serves the UniTreeDB service as JSON over HTTP.
+type gateway struct {
+	conn *grpc.ClientConn
+	// auth is nil if calls aren't authenticated
+	auth    *authorizer
+	methods map[string]gatewayMethod
+	openAPI []byte
+}
+
+// serveGateway serves the gateway on addr, over HTTPS if reloader is set.
+// It returns the in-process gRPC server, which serves s w/opts.
+func serveGateway(addr string, s *universeTrieServer, auth *authorizer, reloader *certReloader, opts []grpc.ServerOption) (*grpc.Server, error) {
+	methods, err := uniTreeDBMethods()
+	if err != nil {
+		return nil, err
+	}
+	spec, err := openAPISpec(methods)
+	if err != nil {
+		return nil, err
+	}
+
+	srv := grpc.NewServer(opts...)
+	universe.RegisterUniTreeDBServer(srv, s)
+	bl := bufconn.Listen(gatewayBufferSize)
+	go srv.Serve(bl)
+	conn, err := grpc.Dial("bufconn", grpc.WithInsecure(), grpc.WithDialer(func(string, time.Duration) (net.Conn, error) {
+		return bl.Dial()
+	}))
+	if err != nil {
+		srv.Stop()
+		return nil, err
+	}
+
+	g := &gateway{
+		conn:    conn,
+		auth:    auth,
+		methods: make(map[string]gatewayMethod),
+		openAPI: spec,
+	}
+	for _, m := range methods {
+		g.methods[m.name] = m
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		srv.Stop()
+		return nil, err
+	}
+	if reloader != nil {
+		l = tls.NewListener(l, &tls.Config{
+			GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+				config, err := reloader.configForClient(hello)
+				if err != nil {
+					return nil, err
+				}
+				config = config.Clone()
+				config.NextProtos = []string{"h2", "http/1.1"}
+				return config, nil
+			},
+		})
+	}
+	go func() {
+		err := http.Serve(l, g)
+		log.Printf("gateway: stopped serving on %v: %v", addr, err)
+	}()
+	log.Printf("gateway: serving on %v, TLS enabled: %v", addr, reloader != nil)
+	return srv, nil
+}
+
+// ServeHTTP implements http.Handler.
+func (g *gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/openapi.json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(g.openAPI)
+		return
+	}
+	m, ok := g.methods[strings.TrimPrefix(r.URL.Path, gatewayPathPrefix)]
+	if !ok || !strings.HasPrefix(r.URL.Path, gatewayPathPrefix) {
+		writeError(w, status.Errorf(codes.Unimplemented, "no method at [%v]", r.URL.Path))
+		return
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var err error
+	if m.clientStreams || m.serverStreams {
+		err = g.stream(w, r, m)
+	} else {
+		err = g.unary(w, r, m)
+	}
+	if err != nil {
+		writeError(w, err)
+	}
+}
+
+// authContext returns the context to authorize a call w/, carrying the
+// bearer token and the client certificate of the request like a gRPC call.
+func authContext(r *http.Request) context.Context {
+	ctx := r.Context()
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		ctx = metadata.NewIncomingContext(ctx, metadata.Pairs("authorization", auth))
+	}
+	if r.TLS != nil {
+		ctx = peer.NewContext(ctx, &peer.Peer{AuthInfo: credentials.TLSInfo{State: *r.TLS}})
+	}
+	return ctx
+}
+
+func (g *gateway) authorize(r *http.Request, m gatewayMethod, req proto.Message) error {
+	if g.auth == nil {
+		return nil
+	}
+	return g.auth.authorize(authContext(r), m.fullMethod, req)
+}
+
+// decodeMessage reads the next message of type t from dec, returning io.EOF
+// if there is none.
+func decodeMessage(dec *json.Decoder, t reflect.Type) (proto.Message, error) {
+	var data interface{}
+	err := dec.Decode(&data)
+	if err == io.EOF {
+		return nil, err
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid JSON: %v", err)
+	}
+	v := reflect.New(t)
+	err = messageFromJSON(data, v, "")
+	if err != nil {
+		return nil, err
+	}
+	return v.Interface().(proto.Message), nil
+}
+
+func (g *gateway) unary(w http.ResponseWriter, r *http.Request, m gatewayMethod) error {
+	dec := json.NewDecoder(r.Body)
+	dec.UseNumber()
+	req, err := decodeMessage(dec, m.reqType)
+	if err == io.EOF {
+		req, err = reflect.New(m.reqType).Interface().(proto.Message), nil
+	}
+	if err != nil {
+		return err
+	}
+	err = g.authorize(r, m, req)
+	if err != nil {
+		return err
+	}
+
+	resp := reflect.New(m.respType)
+	err = g.conn.Invoke(r.Context(), m.fullMethod, req, resp.Interface())
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(messageToJSON(resp))
+}
+
+// stream makes a streaming call. Errors once the reply has started are
+// written as a last line.
+func (g *gateway) stream(w http.ResponseWriter, r *http.Request, m gatewayMethod) error {
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	dec := json.NewDecoder(bufio.NewReader(r.Body))
+	dec.UseNumber()
+	first, err := decodeMessage(dec, m.reqType)
+	if err == io.EOF {
+		if !m.clientStreams {
+			first, err = reflect.New(m.reqType).Interface().(proto.Message), nil
+		} else {
+			return status.Error(codes.InvalidArgument, "no messages to stream")
+		}
+	}
+	if err != nil {
+		return err
+	}
+	err = g.authorize(r, m, first)
+	if err != nil {
+		return err
+	}
+
+	cs, err := g.conn.NewStream(ctx, &grpc.StreamDesc{
+		StreamName:    m.name,
+		ClientStreams: m.clientStreams,
+		ServerStreams: m.serverStreams,
+	}, m.fullMethod)
+	if err != nil {
+		return err
+	}
+	err = cs.SendMsg(first)
+	for err == nil && m.clientStreams {
+		var req proto.Message
+		req, err = decodeMessage(dec, m.reqType)
+		if err == io.EOF {
+			err = nil
+			break
+		}
+		if err == nil {
+			err = cs.SendMsg(req)
+		}
+	}
+	if err != nil && err != io.EOF {
+		// io.EOF means the server ended the call, its status is received
+		return err
+	}
+	err = cs.CloseSend()
+	if err != nil {
+		return err
+	}
+
+	if m.serverStreams {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	enc := json.NewEncoder(w)
+	flusher, _ := w.(http.Flusher)
+	for started := false; ; started = true {
+		resp := reflect.New(m.respType)
+		err = cs.RecvMsg(resp.Interface())
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil && !started {
+			return err
+		}
+		if err != nil {
+			return enc.Encode(map[string]interface{}{"error": statusJSON(status.Convert(err))})
+		}
+		err = enc.Encode(messageToJSON(resp))
+		if err != nil {
+			return nil
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if !m.serverStreams {
+			return nil
+		}
+	}
+}
+
+// statusJSON returns the JSON value of a status, w/its details.
+func statusJSON(st *status.Status) map[string]interface{} {
+	var details []interface{}
+	for _, d := range st.Details() {
+		m, ok := d.(proto.Message)
+		if !ok {
+			continue
+		}
+		detail, _ := messageToJSON(reflect.ValueOf(m)).(map[string]interface{})
+		if detail == nil {
+			continue
+		}
+		detail["@type"] = proto.MessageName(m)
+		details = append(details, detail)
+	}
+	return map[string]interface{}{
+		"code":    int(st.Code()),
+		"message": st.Message(),
+		"details": details,
+	}
+}
+
+// writeError writes a failed call w/the HTTP status matching its code.
+func writeError(w http.ResponseWriter, err error) {
+	st := status.Convert(toStatusError(err))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(httpStatus(st.Code()))
+	json.NewEncoder(w).Encode(statusJSON(st))
+}
+
+// httpStatus maps a gRPC status code to an HTTP status code the way
+// grpc-gateway does.
+func httpStatus(c codes.Code) int {
+	switch c {
+	case codes.OK:
+		return http.StatusOK
+	case codes.Canceled:
+		return 499
+	case codes.InvalidArgument, codes.FailedPrecondition, codes.OutOfRange:
+		return http.StatusBadRequest
+	case codes.DeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case codes.NotFound:
+		return http.StatusNotFound
+	case codes.AlreadyExists, codes.Aborted:
+		return http.StatusConflict
+	case codes.PermissionDenied:
+		return http.StatusForbidden
+	case codes.Unauthenticated:
+		return http.StatusUnauthorized
+	case codes.ResourceExhausted:
+		return http.StatusTooManyRequests
+	case codes.Unimplemented:
+		return http.StatusNotImplemented
+	case codes.Unavailable:
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusInternalServerError
+}
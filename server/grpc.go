@@ -2,31 +2,25 @@ package main
 
 import (
 	"context"
-	"fmt"
+	"io"
 	"log"
+	"time"
 
 	"github.com/aergoio/aergo/pkg/trie"
 	"github.com/dashevo/universe-tree-db/universe"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func (s *universeTrieServer) ListTrees(ctx context.Context, req *universe.Void) (*universe.ListTreesReply, error) {
-	s.Lock()
-	defer s.Unlock()
-
 	var resp universe.ListTreesReply
 
-	listTreeInfo := make([]*universe.TreeInfo, len(s.trieInfo))
-	i := 0
-	for name, ti := range s.trieInfo {
-		listTreeInfo[i] = &universe.TreeInfo{
-			Name:             name,
-			Root:             ti.trie.Root,
-			TrieHeight:       uint32(ti.trie.TrieHeight),
-			LoadDbCounter:    uint32(ti.trie.LoadDbCounter),
-			LoadCacheCounter: uint32(ti.trie.LoadCacheCounter),
-			CacheHeightLimit: uint32(ti.trie.CacheHeightLimit),
-		}
-		i++
+	trees := s.trees()
+	listTreeInfo := make([]*universe.TreeInfo, len(trees))
+	for i, ti := range trees {
+		ti.RLock()
+		listTreeInfo[i] = ti.info()
+		ti.RUnlock()
 	}
 
 	resp.List = listTreeInfo
@@ -37,84 +31,342 @@ func (s *universeTrieServer) CreateTree(ctx context.Context, req *universe.Creat
 	var resp universe.CreateTreeReply
 
 	treeName := req.GetName()
+	if treeName == "" {
+		return nil, fieldError("", "name", "tree name is empty")
+	}
+
+	hash, err := hashFunc(req.GetHashAlgorithm())
+	if err != nil {
+		return nil, fieldError(treeName, "hash_algorithm", "%v", err)
+	}
 
 	s.Lock()
 	defer s.Unlock()
 
-	_, ok := s.trieInfo[treeName]
-	if ok {
-		log.Printf("CreateTree: tree [%v] already exists", treeName)
-	} else {
-		log.Printf("CreateTree: creating tree [%v]", treeName)
-		t := trie.NewTrie(nil, Sha256, s.aergoDB)
-		t.CacheHeightLimit = int(req.GetCacheHeightLimit())
-		ti := TreeInfo{
-			trie: t,
-			TreeInfo: universe.TreeInfo{
-				Name:             treeName,
-				CacheHeightLimit: uint32(t.CacheHeightLimit),
-			},
-		}
-		s.trieInfo[treeName] = ti
-		resp.Created = true
-		s.syncMeta()
+	if _, ok := s.trieInfo[treeName]; ok {
+		return nil, treeError(codes.AlreadyExists, treeName, "tree [%v] already exists", treeName)
+	}
+	if _, ok := s.imports[treeName]; ok {
+		return nil, treeError(codes.AlreadyExists, treeName, "tree [%v] is being imported", treeName)
+	}
+
+	log.Printf("CreateTree: creating tree [%v] w/hash algorithm [%v]", treeName, req.GetHashAlgorithm())
+	t := trie.NewTrie(nil, hash, s.aergoDB)
+	t.CacheHeightLimit = int(req.GetCacheHeightLimit())
+	if t.CacheHeightLimit == 0 {
+		t.CacheHeightLimit = int(s.treeDefaults.CacheHeightLimit)
+	}
+	ti := &TreeInfo{
+		trie: t,
+		TreeInfo: universe.TreeInfo{
+			Name:             treeName,
+			CacheHeightLimit: uint32(t.CacheHeightLimit),
+			HashAlgorithm:    req.GetHashAlgorithm(),
+			AutoCommit:       req.GetAutoCommit(),
+		},
+		lastCommit: time.Now(),
+	}
+	if ti.AutoCommit == nil {
+		ti.AutoCommit = s.treeDefaults.autoCommitPolicy()
+	}
+	// replaces any log left by a tree of the same name
+	err = s.resetLog(ti)
+	if err != nil {
+		return nil, err
 	}
+	s.trieInfo[treeName] = ti
+	err = s.syncTreeMeta(ti)
+	if err == nil {
+		err = s.syncTreeList()
+	}
+	if err != nil {
+		// the tree would be gone after a restart
+		delete(s.trieInfo, treeName)
+		s.removeLog(ti)
+		return nil, err
+	}
+	s.checkTreeHealth(ti)
+	resp.Created = true
 
 	return &resp, nil
 }
 
+func (s *universeTrieServer) ForkTree(ctx context.Context, req *universe.ForkTreeRequest) (*universe.TreeInfo, error) {
+	treeName := req.GetName()
+	sourceName := req.GetSourceTreeName()
+	if treeName == "" {
+		return nil, fieldError("", "name", "tree name is empty")
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.trieInfo[treeName]; ok {
+		return nil, treeError(codes.AlreadyExists, treeName, "tree [%v] already exists", treeName)
+	}
+	if _, ok := s.imports[treeName]; ok {
+		return nil, treeError(codes.AlreadyExists, treeName, "tree [%v] is being imported", treeName)
+	}
+	src, ok := s.trieInfo[sourceName]
+	if !ok {
+		return nil, treeNotFound(sourceName)
+	}
+
+	src.Lock()
+	defer src.Unlock()
+
+	root, keyCount, err := s.forkSource(src, req.GetSourceRoot(), req.GetSourceVersion())
+	if err != nil {
+		return nil, err
+	}
+	if src.ForkGroup == "" {
+		group, err := newForkGroup()
+		if err != nil {
+			return nil, err
+		}
+		src.ForkGroup = group
+		err = s.syncTreeMeta(src)
+		if err != nil {
+			src.ForkGroup = ""
+			return nil, err
+		}
+	}
+	hash, err := hashFunc(src.HashAlgorithm)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("ForkTree: forking tree [%v] from tree [%v] root [%x]", treeName, sourceName, root)
+	t := trie.NewTrie(root, hash, s.aergoDB)
+	t.CacheHeightLimit = src.trie.CacheHeightLimit
+	ti := &TreeInfo{
+		trie: t,
+		TreeInfo: universe.TreeInfo{
+			Name:             treeName,
+			CacheHeightLimit: uint32(t.CacheHeightLimit),
+			HashAlgorithm:    src.HashAlgorithm,
+			KeyCount:         keyCount,
+			AutoCommit:       req.GetAutoCommit(),
+			ForkedFrom:       sourceName,
+			ForkRoot:         root,
+			ForkGroup:        src.ForkGroup,
+		},
+		committedRoot:     root,
+		committedKeyCount: keyCount,
+		lastCommit:        time.Now(),
+	}
+	if ti.AutoCommit == nil {
+		ti.AutoCommit = s.treeDefaults.autoCommitPolicy()
+	}
+	// the fork root is the first version of the fork
+	err = s.appendVersion(ti, nil)
+	if err != nil {
+		return nil, err
+	}
+	// replaces any log left by a tree of the same name
+	err = s.resetLog(ti)
+	if err != nil {
+		return nil, err
+	}
+	s.trieInfo[treeName] = ti
+	s.checkTreeHealth(ti)
+	err = s.syncTreeList()
+	if err != nil {
+		return nil, err
+	}
+	s.notify(treeName, universe.TreeOperation_FORK, nil, root)
+
+	return ti.info(), nil
+}
+
+func (s *universeTrieServer) RenameTree(ctx context.Context, req *universe.RenameTreeRequest) (*universe.TreeInfo, error) {
+	treeName := req.GetTreeName()
+	newName := req.GetNewName()
+	if newName == "" {
+		return nil, fieldError(treeName, "new_name", "new tree name is empty")
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	ti, ok := s.trieInfo[treeName]
+	if !ok {
+		return nil, treeNotFound(treeName)
+	}
+	if _, ok := s.trieInfo[newName]; ok {
+		return nil, treeError(codes.AlreadyExists, newName, "tree [%v] already exists", newName)
+	}
+	if _, ok := s.imports[newName]; ok {
+		return nil, treeError(codes.AlreadyExists, newName, "tree [%v] is being imported", newName)
+	}
+
+	ti.Lock()
+	defer ti.Unlock()
+
+	l, err := s.copyLog(ti, newName)
+	if err != nil {
+		return nil, err
+	}
+
+	// the reclaim of dropped trees reads the names of the live trees w/
+	// nodeLock
+	s.nodeLock.Lock()
+	ti.Name = newName
+	ti.syncFromTrie()
+	delete(s.trieInfo, treeName)
+	s.trieInfo[newName] = ti
+	err = s.MetaRenameTree(treeName, ti, s.listTrees())
+	if err != nil {
+		delete(s.trieInfo, newName)
+		s.trieInfo[treeName] = ti
+		ti.Name = treeName
+		s.nodeLock.Unlock()
+		s.discardLogCopy(newName, l)
+		return nil, err
+	}
+	s.nodeLock.Unlock()
+
+	s.switchLog(ti, treeName, l)
+	s.removeTreeHealth(treeName)
+	s.checkTreeHealth(ti)
+	countOperation(treeName, universe.TreeOperation_RENAME)
+	moveOperations(treeName, newName)
+	s.watch.publish(&universe.TreeEvent{
+		TreeName:    treeName,
+		Operation:   universe.TreeOperation_RENAME,
+		OldRoot:     ti.trie.Root,
+		NewRoot:     ti.trie.Root,
+		Timestamp:   time.Now().Unix(),
+		NewTreeName: newName,
+	})
+
+	log.Printf("RenameTree: tree [%v] renamed to [%v]", treeName, newName)
+	return ti.info(), nil
+}
+
 func (s *universeTrieServer) DropTree(ctx context.Context, req *universe.DropTreeRequest) (*universe.DropTreeReply, error) {
 	var resp universe.DropTreeReply
 
 	treeName := req.GetName()
 
+	// the name stays taken until the drop is recorded, so that a new tree of
+	// the same name can't lose its meta records or log to the drop
 	s.Lock()
 	defer s.Unlock()
 
-	_, ok := s.trieInfo[treeName]
+	ti, ok := s.trieInfo[treeName]
 	if !ok {
 		log.Printf("DropTree: Tree [%v] not found", treeName)
-	} else {
-		log.Printf("DropTree: Deleting Tree [%v]", treeName)
-		delete(s.trieInfo, treeName)
-		resp.Deleted = true
-		s.syncMeta()
+		return nil, treeNotFound(treeName)
 	}
+	if d, ok := s.drops[treeName]; ok && !d.finished() {
+		return nil, treeError(codes.FailedPrecondition, treeName, "tree [%v] is still being dropped", treeName)
+	}
+	log.Printf("DropTree: Deleting Tree [%v]", treeName)
+
+	// wait for calls already using the tree before reclaiming its nodes
+	ti.Lock()
+	defer ti.Unlock()
 
+	roots, err := s.treeRoots(ti)
+	if err != nil {
+		return nil, err
+	}
+	dp := &universe.DropProgress{
+		Name:      treeName,
+		Roots:     roots,
+		StartedAt: time.Now().Unix(),
+	}
+	delete(s.trieInfo, treeName)
+	err = s.MetaDropTree(treeName, dp, s.listTrees())
+	if err != nil {
+		s.trieInfo[treeName] = ti
+		return nil, err
+	}
+
+	ti.dropped = true
+	s.notify(treeName, universe.TreeOperation_DROP, ti.trie.Root, nil)
+	s.removeTreeHealth(treeName)
+	s.removeLog(ti)
+	s.startDrop(dp)
+
+	resp.Deleted = true
 	return &resp, nil
 }
 
+func (s *universeTrieServer) ListDrops(ctx context.Context, req *universe.Void) (*universe.ListDropsReply, error) {
+	var resp universe.ListDropsReply
+
+	s.RLock()
+	defer s.RUnlock()
+
+	for _, d := range s.drops {
+		resp.List = append(resp.List, d.progress())
+	}
+	return &resp, nil
+}
+
+func (s *universeTrieServer) SetAutoCommit(ctx context.Context, req *universe.SetAutoCommitRequest) (*universe.TreeInfo, error) {
+	treeName := req.GetTreeName()
+
+	ti, ok := s.getTree(treeName)
+	if !ok {
+		return nil, treeNotFound(treeName)
+	}
+
+	ti.Lock()
+	defer ti.Unlock()
+
+	ti.AutoCommit = req.GetAutoCommit()
+	err := s.syncTreeMeta(ti)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Printf("SetAutoCommit: trie [%v] auto commit policy [%v]", treeName, ti.AutoCommit)
+	return ti.info(), nil
+}
+
 func (s *universeTrieServer) Update(ctx context.Context, req *universe.UpdateRequest) (*universe.UpdateReply, error) {
 	var resp universe.UpdateReply
 
 	treeName := req.GetTreeName()
 
-	s.Lock()
-	defer s.Unlock()
-
-	val, ok := s.trieInfo[treeName]
+	val, ok := s.getTree(treeName)
 	if !ok {
-		return nil, fmt.Errorf("tree [%v] not found", treeName)
+		return nil, treeNotFound(treeName)
 	}
 
-	pairs := req.KeyValuePairs
-	keys := make([][]byte, len(pairs))
-	values := make([][]byte, len(pairs))
-	for i, pair := range pairs {
-		keys[i] = pair.GetKey()
-		values[i] = pair.GetValue()
-	}
+	val.Lock()
+	defer val.Unlock()
 
 	trie := val.trie
+	keys, values, err := updatePairs(treeName, req.GetKeyValuePairs(), trie.TrieHeight/8, s.limits.MaxUpdatePairs, req.GetSortPairs())
+	if err != nil {
+		return nil, err
+	}
+	delta, err := keyCountDelta(trie, keys, values)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := s.logUpdate(val, keys, values, false, 0)
+	if err != nil {
+		return nil, err
+	}
 	log.Printf("Update: trie.Root BEFORE update: [%x]", trie.Root)
+	oldRoot := trie.Root
 	root, err := trie.Update(keys, values)
 	if err != nil {
+		s.unlogUpdate(val, offset)
 		return nil, err
 	}
+	s.notify(treeName, universe.TreeOperation_UPDATE, oldRoot, root)
+	val.KeyCount = uint64(int64(val.KeyCount) + delta)
+	s.countUpdate(val, len(keys))
 	log.Printf("Update: trie.Root AFTER  update: [%x]", trie.Root)
 	resp.Root = root
 
-	err = s.syncMeta()
+	err = s.syncTreeMeta(val)
 	if err != nil {
 		return nil, err
 	}
@@ -127,36 +379,76 @@ func (s *universeTrieServer) AtomicUpdate(ctx context.Context, req *universe.Upd
 
 	treeName := req.GetTreeName()
 
-	s.Lock()
-	defer s.Unlock()
-
-	val, ok := s.trieInfo[treeName]
+	val, ok := s.getTree(treeName)
 	if !ok {
-		return nil, fmt.Errorf("tree [%v] not found", treeName)
+		return nil, treeNotFound(treeName)
 	}
 
-	pairs := req.KeyValuePairs
-	keys := make([][]byte, len(pairs))
-	values := make([][]byte, len(pairs))
-	for i, pair := range pairs {
-		keys[i] = pair.GetKey()
-		values[i] = pair.GetValue()
-	}
+	val.Lock()
+	defer val.Unlock()
 
 	trie := val.trie
+	keys, values, err := updatePairs(treeName, req.GetKeyValuePairs(), trie.TrieHeight/8, s.limits.MaxUpdatePairs, req.GetSortPairs())
+	if err != nil {
+		return nil, err
+	}
+	delta, err := keyCountDelta(trie, keys, values)
+	if err != nil {
+		return nil, err
+	}
+	offset, err := s.logUpdate(val, keys, values, true, 0)
+	if err != nil {
+		return nil, err
+	}
 	log.Printf("AtomicUpdate: trie.Root BEFORE update: [%x]", trie.Root)
+	oldRoot := trie.Root
 	root, err := trie.AtomicUpdate(keys, values)
 	if err != nil {
+		s.unlogUpdate(val, offset)
 		return nil, err
 	}
+	s.notify(treeName, universe.TreeOperation_ATOMIC_UPDATE, oldRoot, root)
+	val.KeyCount = uint64(int64(val.KeyCount) + delta)
+	s.countUpdate(val, len(keys))
 	log.Printf("AtomicUpdate: trie.Root AFTER  update: [%x]", trie.Root)
 	resp.Root = root
 
-	err = s.syncMeta()
+	err = s.syncTreeMeta(val)
+	if err != nil {
+		return nil, err
+	}
+
+	return &resp, nil
+}
+
+func (s *universeTrieServer) MultiUpdate(ctx context.Context, req *universe.MultiUpdateRequest) (*universe.MultiUpdateReply, error) {
+	var resp universe.MultiUpdateReply
+
+	batches, err := s.lockMultiUpdate(req.GetUpdates())
+	if err != nil {
+		return nil, err
+	}
+	defer unlockMultiUpdate(batches)
+
+	err = s.applyMultiUpdate(batches, req.GetAtomic())
 	if err != nil {
 		return nil, err
 	}
 
+	op := universe.TreeOperation_UPDATE
+	if req.GetAtomic() {
+		op = universe.TreeOperation_ATOMIC_UPDATE
+	}
+	for _, b := range batches {
+		s.notify(b.ti.Name, op, b.oldRoot, b.ti.trie.Root)
+		s.countUpdate(b.ti, len(b.keys))
+		resp.Roots = append(resp.Roots, &universe.TreeRoot{
+			TreeName: b.ti.Name,
+			Root:     b.ti.trie.Root,
+		})
+		log.Printf("MultiUpdate: trie [%v] root [%x]", b.ti.Name, b.ti.trie.Root)
+	}
+
 	return &resp, nil
 }
 
@@ -171,18 +463,21 @@ func (s *universeTrieServer) SyncMeta(ctx context.Context, in *universe.Void) (*
 func (s *universeTrieServer) Commit(ctx context.Context, req *universe.CommitRequest) (*universe.Void, error) {
 	treeName := req.GetTreeName()
 
-	s.Lock()
-	defer s.Unlock()
-
-	ti, ok := s.trieInfo[treeName]
+	ti, ok := s.getTree(treeName)
 	if !ok {
-		return nil, fmt.Errorf("tree [%v] not found", treeName)
+		return nil, treeNotFound(treeName)
 	}
-	trie := ti.trie
-	err := trie.Commit()
+
+	ti.Lock()
+	defer ti.Unlock()
+
+	oldRoot := ti.committedRoot
+	err := s.commitTree(ti)
 	if err != nil {
 		return nil, err
 	}
+	s.notify(treeName, universe.TreeOperation_COMMIT, oldRoot, ti.committedRoot)
+	s.checkTreeHealth(ti)
 
 	log.Printf("Commit: trie [%v] committed", treeName)
 	return &universe.Void{}, nil
@@ -194,16 +489,28 @@ func (s *universeTrieServer) Get(ctx context.Context, req *universe.GetRequest)
 	treeName := req.GetTreeName()
 	key := req.GetKey()
 
-	s.Lock()
-	defer s.Unlock()
-
-	ti, ok := s.trieInfo[treeName]
+	ti, ok := s.getTree(treeName)
 	if !ok {
-		return nil, fmt.Errorf("tree [%v] not found", treeName)
+		return nil, treeNotFound(treeName)
+	}
+
+	ti.RLock()
+	defer ti.RUnlock()
+
+	var val []byte
+	var err error
+	if version := req.GetVersion(); version != 0 {
+		log.Printf("Get: key [%x] at version [%d]", key, version)
+		var v *universe.TreeVersion
+		v, err = s.getVersion(treeName, version)
+		if err != nil {
+			return nil, err
+		}
+		val, err = newNodeReader(s.aergoDB, ti.trie.TrieHeight).get(v.Root, key)
+	} else {
+		log.Printf("Get: key [%x]", key)
+		val, err = ti.trie.Get(key)
 	}
-	log.Printf("Get: key [%x]", key)
-	trie := ti.trie
-	val, err := trie.Get(key)
 	if err != nil {
 		return nil, err
 	}
@@ -213,21 +520,78 @@ func (s *universeTrieServer) Get(ctx context.Context, req *universe.GetRequest)
 	return &resp, nil
 }
 
-func (s *universeTrieServer) Stash(ctx context.Context, req *universe.StashRequest) (*universe.Void, error) {
+func (s *universeTrieServer) BatchGet(ctx context.Context, req *universe.BatchGetRequest) (*universe.BatchGetReply, error) {
+	var resp universe.BatchGetReply
+
 	treeName := req.GetTreeName()
+	keys := req.GetKeys()
+	if max := s.limits.MaxBatchGetKeys; max != 0 && len(keys) > max {
+		return nil, fieldError(treeName, "keys", "batch has [%d] keys, the limit is [%d]", len(keys), max)
+	}
 
-	s.Lock()
-	defer s.Unlock()
+	ti, ok := s.getTree(treeName)
+	if !ok {
+		return nil, treeNotFound(treeName)
+	}
 
-	ti, ok := s.trieInfo[treeName]
+	// hold the lock for the whole batch so all keys are read from one root
+	ti.RLock()
+	defer ti.RUnlock()
+
+	get := ti.trie.Get
+	resp.Root = ti.trie.Root
+	if len(req.GetRoot()) != 0 || req.GetVersion() != 0 {
+		root, err := s.resolveRoot(ti, req.GetRoot(), req.GetVersion())
+		if err != nil {
+			return nil, err
+		}
+		reader := newNodeReader(s.aergoDB, ti.trie.TrieHeight)
+		get = func(key []byte) ([]byte, error) {
+			return reader.get(root, key)
+		}
+		resp.Root = root
+	}
+
+	resp.Values = make([]*universe.BatchGetValue, len(keys))
+	for i, key := range keys {
+		val, err := get(key)
+		if err != nil {
+			return nil, err
+		}
+		resp.Values[i] = &universe.BatchGetValue{
+			Value: val,
+			Found: len(val) != 0,
+		}
+	}
+
+	log.Printf("BatchGet: trie [%v] root [%x] got %d keys", treeName, resp.Root, len(keys))
+	return &resp, nil
+}
+
+func (s *universeTrieServer) Stash(ctx context.Context, req *universe.StashRequest) (*universe.Void, error) {
+	treeName := req.GetTreeName()
+
+	ti, ok := s.getTree(treeName)
 	if !ok {
-		return nil, fmt.Errorf("tree [%v] not found", treeName)
+		return nil, treeNotFound(treeName)
 	}
+
+	ti.Lock()
+	defer ti.Unlock()
+
 	trie := ti.trie
+	oldRoot := trie.Root
 	err := trie.Stash(req.GetRollbackCache())
 	if err != nil {
 		return nil, err
 	}
+	ti.KeyCount = ti.committedKeyCount
+	ti.clearPending()
+	s.notify(treeName, universe.TreeOperation_STASH, oldRoot, trie.Root)
+	err = s.resetLog(ti)
+	if err != nil {
+		return nil, err
+	}
 
 	log.Printf("Stash: trie [%v] stashed", treeName)
 	return &universe.Void{}, nil
@@ -237,18 +601,20 @@ func (s *universeTrieServer) Revert(ctx context.Context, req *universe.RevertReq
 	treeName := req.GetTreeName()
 	toOldRoot := req.GetToOldRoot()
 
-	s.Lock()
-	defer s.Unlock()
-
-	ti, ok := s.trieInfo[treeName]
+	ti, ok := s.getTree(treeName)
 	if !ok {
-		return nil, fmt.Errorf("tree [%v] not found", treeName)
+		return nil, treeNotFound(treeName)
 	}
-	trie := ti.trie
-	err := trie.Revert(toOldRoot)
+
+	ti.Lock()
+	defer ti.Unlock()
+
+	oldRoot := ti.trie.Root
+	err := s.revertTree(ti, toOldRoot)
 	if err != nil {
 		return nil, err
 	}
+	s.notify(treeName, universe.TreeOperation_REVERT, oldRoot, ti.trie.Root)
 
 	log.Printf("Revert: trie [%v] reverted to old root [%x]", treeName, toOldRoot)
 	return &universe.Void{}, nil
@@ -258,15 +624,28 @@ func (s *universeTrieServer) MerkleProof(ctx context.Context, req *universe.GetR
 	treeName := req.GetTreeName()
 	key := req.GetKey()
 
-	s.Lock()
-	defer s.Unlock()
-
-	ti, ok := s.trieInfo[treeName]
+	ti, ok := s.getTree(treeName)
 	if !ok {
-		return nil, fmt.Errorf("tree [%v] not found", treeName)
+		return nil, treeNotFound(treeName)
+	}
+
+	ti.RLock()
+	defer ti.RUnlock()
+
+	var auditPath [][]byte
+	var included bool
+	var proofKey, proofValue []byte
+	var err error
+	if version := req.GetVersion(); version != 0 {
+		var v *universe.TreeVersion
+		v, err = s.getVersion(treeName, version)
+		if err != nil {
+			return nil, err
+		}
+		auditPath, included, proofKey, proofValue, err = ti.trie.MerkleProofR(key, v.Root)
+	} else {
+		auditPath, included, proofKey, proofValue, err = ti.trie.MerkleProof(key)
 	}
-	trie := ti.trie
-	auditPath, included, proofKey, proofValue, err := trie.MerkleProof(key)
 	if err != nil {
 		return nil, err
 	}
@@ -274,10 +653,11 @@ func (s *universeTrieServer) MerkleProof(ctx context.Context, req *universe.GetR
 	log.Printf("MerkleProof: trie [%v] key [%x] auditPath: %v, included: %v, proofKey [%x], proofValue [%x]\n", treeName, key, auditPath, included, proofKey, proofValue)
 	return &universe.MerkleProofReply{
 		MerkleProof: &universe.MerkleProof{
-			AuditPath:  auditPath,
-			Included:   included,
-			ProofKey:   proofKey,
-			ProofValue: proofValue,
+			AuditPath:     auditPath,
+			Included:      included,
+			ProofKey:      proofKey,
+			ProofValue:    proofValue,
+			HashAlgorithm: ti.HashAlgorithm,
 		},
 	}, nil
 }
@@ -286,15 +666,30 @@ func (s *universeTrieServer) MerkleProofCompressed(ctx context.Context, req *uni
 	treeName := req.GetTreeName()
 	key := req.GetKey()
 
-	s.Lock()
-	defer s.Unlock()
-
-	ti, ok := s.trieInfo[treeName]
+	ti, ok := s.getTree(treeName)
 	if !ok {
-		return nil, fmt.Errorf("tree [%v] not found", treeName)
+		return nil, treeNotFound(treeName)
+	}
+
+	ti.RLock()
+	defer ti.RUnlock()
+
+	var bitmap []byte
+	var auditPath [][]byte
+	var height int
+	var included bool
+	var proofKey, proofValue []byte
+	var err error
+	if version := req.GetVersion(); version != 0 {
+		var v *universe.TreeVersion
+		v, err = s.getVersion(treeName, version)
+		if err != nil {
+			return nil, err
+		}
+		bitmap, auditPath, height, included, proofKey, proofValue, err = ti.trie.MerkleProofCompressedR(key, v.Root)
+	} else {
+		bitmap, auditPath, height, included, proofKey, proofValue, err = ti.trie.MerkleProofCompressed(key)
 	}
-	trie := ti.trie
-	bitmap, auditPath, height, included, proofKey, proofValue, err := trie.MerkleProofCompressed(key)
 	if err != nil {
 		return nil, err
 	}
@@ -302,12 +697,13 @@ func (s *universeTrieServer) MerkleProofCompressed(ctx context.Context, req *uni
 	log.Printf("MerkleProofCompressed: trie [%v] key [%x] bitmap: [%x], auditPath: %v, height: %d, included: %v, proofKey [%x], proofValue [%x]\n", treeName, key, bitmap, auditPath, height, included, proofKey, proofValue)
 	return &universe.MerkleProofCompressedReply{
 		MerkleProof: &universe.MerkleProofCompressed{
-			Bitmap:     bitmap,
-			AuditPath:  auditPath,
-			Height:     uint32(height),
-			Included:   included,
-			ProofKey:   proofKey,
-			ProofValue: proofValue,
+			Bitmap:        bitmap,
+			AuditPath:     auditPath,
+			Height:        uint32(height),
+			Included:      included,
+			ProofKey:      proofKey,
+			ProofValue:    proofValue,
+			HashAlgorithm: ti.HashAlgorithm,
 		},
 	}, nil
 }
@@ -317,14 +713,24 @@ func (s *universeTrieServer) MerkleProofR(ctx context.Context, req *universe.Mer
 	key := req.GetKey()
 	root := req.GetRoot()
 
-	s.Lock()
-	defer s.Unlock()
-
-	ti, ok := s.trieInfo[treeName]
+	ti, ok := s.getTree(treeName)
 	if !ok {
-		return nil, fmt.Errorf("tree [%v] not found", treeName)
+		return nil, treeNotFound(treeName)
 	}
+
+	ti.RLock()
+	defer ti.RUnlock()
+
 	trie := ti.trie
+	if len(root) != 0 {
+		err := s.checkTreeRoot(ti, root)
+		if err != nil {
+			return nil, err
+		}
+		if !trie.TrieRootExists(root) {
+			return nil, treeError(codes.NotFound, treeName, "tree [%v] root [%x] not found", treeName, root)
+		}
+	}
 	auditPath, included, proofKey, proofValue, err := trie.MerkleProofR(key, root)
 	if err != nil {
 		return nil, err
@@ -333,10 +739,11 @@ func (s *universeTrieServer) MerkleProofR(ctx context.Context, req *universe.Mer
 	log.Printf("MerkleProofR: trie [%v] key [%x] auditPath: %v, included: %v, proofKey [%x], proofValue [%x]\n", treeName, key, auditPath, included, proofKey, proofValue)
 	return &universe.MerkleProofReply{
 		MerkleProof: &universe.MerkleProof{
-			AuditPath:  auditPath,
-			Included:   included,
-			ProofKey:   proofKey,
-			ProofValue: proofValue,
+			AuditPath:     auditPath,
+			Included:      included,
+			ProofKey:      proofKey,
+			ProofValue:    proofValue,
+			HashAlgorithm: ti.HashAlgorithm,
 		},
 	}, nil
 }
@@ -346,14 +753,24 @@ func (s *universeTrieServer) MerkleProofCompressedR(ctx context.Context, req *un
 	key := req.GetKey()
 	root := req.GetRoot()
 
-	s.Lock()
-	defer s.Unlock()
-
-	ti, ok := s.trieInfo[treeName]
+	ti, ok := s.getTree(treeName)
 	if !ok {
-		return nil, fmt.Errorf("tree [%v] not found", treeName)
+		return nil, treeNotFound(treeName)
 	}
+
+	ti.RLock()
+	defer ti.RUnlock()
+
 	trie := ti.trie
+	if len(root) != 0 {
+		err := s.checkTreeRoot(ti, root)
+		if err != nil {
+			return nil, err
+		}
+		if !trie.TrieRootExists(root) {
+			return nil, treeError(codes.NotFound, treeName, "tree [%v] root [%x] not found", treeName, root)
+		}
+	}
 	bitmap, auditPath, height, included, proofKey, proofValue, err := trie.MerkleProofCompressedR(key, root)
 	if err != nil {
 		return nil, err
@@ -362,16 +779,52 @@ func (s *universeTrieServer) MerkleProofCompressedR(ctx context.Context, req *un
 	log.Printf("MerkleProofCompressedR: trie [%v] key [%x] bitmap: [%x], auditPath: %v, height: %d, included: %v, proofKey [%x], proofValue [%x]\n", treeName, key, bitmap, auditPath, height, included, proofKey, proofValue)
 	return &universe.MerkleProofCompressedReply{
 		MerkleProof: &universe.MerkleProofCompressed{
-			Bitmap:     bitmap,
-			AuditPath:  auditPath,
-			Height:     uint32(height),
-			Included:   included,
-			ProofKey:   proofKey,
-			ProofValue: proofValue,
+			Bitmap:        bitmap,
+			AuditPath:     auditPath,
+			Height:        uint32(height),
+			Included:      included,
+			ProofKey:      proofKey,
+			ProofValue:    proofValue,
+			HashAlgorithm: ti.HashAlgorithm,
 		},
 	}, nil
 }
 
+func (s *universeTrieServer) BatchMerkleProof(ctx context.Context, req *universe.BatchMerkleProofRequest) (*universe.BatchMerkleProofReply, error) {
+	treeName := req.GetTreeName()
+
+	ti, ok := s.getTree(treeName)
+	if !ok {
+		return nil, treeNotFound(treeName)
+	}
+
+	ti.RLock()
+	trieHeight := ti.trie.TrieHeight
+	hashAlgorithm := ti.HashAlgorithm
+	keys, err := proofKeys(treeName, req.GetKeys(), trieHeight/8, s.limits.MaxBatchProofKeys)
+	var root []byte
+	if err == nil {
+		root, err = s.resolveRoot(ti, req.GetRoot(), req.GetVersion())
+	}
+	ti.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+
+	// committed nodes never change, so the tree isn't locked while proving
+	bp, err := newNodeReader(s.aergoDB, trieHeight).batchProof(root, keys)
+	if err != nil {
+		return nil, err
+	}
+	bp.HashAlgorithm = hashAlgorithm
+
+	log.Printf("BatchMerkleProof: trie [%v] root [%x] proved %d keys w/%d leaves, auditPath: %d", treeName, root, len(keys), len(bp.Leaves), len(bp.AuditPath))
+	return &universe.BatchMerkleProofReply{
+		Root:        root,
+		MerkleProof: bp,
+	}, nil
+}
+
 func (s *universeTrieServer) VerifyInclusion(ctx context.Context, req *universe.VerifyInclusionRequest) (*universe.VerifyInclusionReply, error) {
 	treeName := req.GetTreeName()
 	mp := req.GetMerkleProof()
@@ -380,13 +833,19 @@ func (s *universeTrieServer) VerifyInclusion(ctx context.Context, req *universe.
 	key := mp.GetProofKey()
 	value := mp.GetProofValue()
 
-	s.Lock()
-	defer s.Unlock()
-
-	ti, ok := s.trieInfo[treeName]
+	ti, ok := s.getTree(treeName)
 	if !ok {
-		return nil, fmt.Errorf("tree [%v] not found", treeName)
+		return nil, treeNotFound(treeName)
+	}
+
+	ti.RLock()
+	defer ti.RUnlock()
+
+	err := ti.checkHashAlgorithm(mp.GetHashAlgorithm())
+	if err != nil {
+		return nil, err
 	}
+
 	included := ti.trie.VerifyInclusion(auditPath, key, value)
 
 	log.Printf("VerifyInclusion: trie [%v] auditPath: %v, key [%x], value: [%x], included: %v\n", treeName, auditPath, key, value, included)
@@ -404,13 +863,19 @@ func (s *universeTrieServer) VerifyNonInclusion(ctx context.Context, req *univer
 	key := mp.GetProofKey()
 	value := mp.GetProofValue()
 
-	s.Lock()
-	defer s.Unlock()
-
-	ti, ok := s.trieInfo[treeName]
+	ti, ok := s.getTree(treeName)
 	if !ok {
-		return nil, fmt.Errorf("tree [%v] not found", treeName)
+		return nil, treeNotFound(treeName)
 	}
+
+	ti.RLock()
+	defer ti.RUnlock()
+
+	err := ti.checkHashAlgorithm(mp.GetHashAlgorithm())
+	if err != nil {
+		return nil, err
+	}
+
 	included := ti.trie.VerifyNonInclusion(auditPath, key, value, proofKey)
 
 	log.Printf("VerifyNonInclusion: trie [%v] auditPath: %v, key [%x], value: [%x], proofKey: [%x], included: %v\n", treeName, auditPath, key, value, proofKey, included)
@@ -429,13 +894,19 @@ func (s *universeTrieServer) VerifyInclusionC(ctx context.Context, req *universe
 	auditPath := mp.GetAuditPath()
 	length := mp.GetHeight()
 
-	s.Lock()
-	defer s.Unlock()
-
-	ti, ok := s.trieInfo[treeName]
+	ti, ok := s.getTree(treeName)
 	if !ok {
-		return nil, fmt.Errorf("tree [%v] not found", treeName)
+		return nil, treeNotFound(treeName)
 	}
+
+	ti.RLock()
+	defer ti.RUnlock()
+
+	err := ti.checkHashAlgorithm(mp.GetHashAlgorithm())
+	if err != nil {
+		return nil, err
+	}
+
 	included := ti.trie.VerifyInclusionC(bitmap, key, value, auditPath, int(length))
 
 	log.Printf("VerifyInclusionC: trie [%v] bitmap: [%x], key: [%x], value: [%x], auditPath: %v, length: %d, included: %v\n", treeName, bitmap, key, value, auditPath, length, included)
@@ -455,13 +926,19 @@ func (s *universeTrieServer) VerifyNonInclusionC(ctx context.Context, req *unive
 	auditPath := mp.GetAuditPath()
 	length := mp.GetHeight()
 
-	s.Lock()
-	defer s.Unlock()
-
-	ti, ok := s.trieInfo[treeName]
+	ti, ok := s.getTree(treeName)
 	if !ok {
-		return nil, fmt.Errorf("tree [%v] not found", treeName)
+		return nil, treeNotFound(treeName)
+	}
+
+	ti.RLock()
+	defer ti.RUnlock()
+
+	err := ti.checkHashAlgorithm(mp.GetHashAlgorithm())
+	if err != nil {
+		return nil, err
 	}
+
 	included := ti.trie.VerifyNonInclusionC(auditPath, int(length), bitmap, key, value, proofKey)
 
 	log.Printf("VerifyNonInclusionC: trie [%v] auditPath: %v, length: %d, bitmap: [%x], key: [%x], value: [%x], proofKey: [%x], included: %v\n", treeName, auditPath, length, bitmap, key, value, proofKey, included)
@@ -469,3 +946,292 @@ func (s *universeTrieServer) VerifyNonInclusionC(ctx context.Context, req *unive
 		Included: included,
 	}, nil
 }
+
+func (s *universeTrieServer) ListVersions(ctx context.Context, req *universe.ListVersionsRequest) (*universe.ListVersionsReply, error) {
+	treeName := req.GetTreeName()
+
+	_, ok := s.getTree(treeName)
+	if !ok {
+		return nil, treeNotFound(treeName)
+	}
+
+	list, err := s.MetaListVersions(treeName, req.GetFromVersion(), int(req.GetLimit()))
+	if err != nil {
+		return nil, err
+	}
+
+	return &universe.ListVersionsReply{
+		List: list,
+	}, nil
+}
+
+func (s *universeTrieServer) GetVersion(ctx context.Context, req *universe.GetVersionRequest) (*universe.TreeVersion, error) {
+	treeName := req.GetTreeName()
+
+	_, ok := s.getTree(treeName)
+	if !ok {
+		return nil, treeNotFound(treeName)
+	}
+
+	if version := req.GetVersion(); version != 0 {
+		return s.getVersion(treeName, version)
+	}
+	return s.versionAt(treeName, req.GetAtTime())
+}
+
+func (s *universeTrieServer) RevertToVersion(ctx context.Context, req *universe.RevertToVersionRequest) (*universe.TreeVersion, error) {
+	treeName := req.GetTreeName()
+
+	ti, ok := s.getTree(treeName)
+	if !ok {
+		return nil, treeNotFound(treeName)
+	}
+
+	ti.Lock()
+	defer ti.Unlock()
+
+	v, err := s.getVersion(treeName, req.GetVersion())
+	if err != nil {
+		return nil, err
+	}
+
+	oldRoot := ti.trie.Root
+	err = s.revertTreeToVersion(ti, v)
+	if err != nil {
+		return nil, err
+	}
+	s.notify(treeName, universe.TreeOperation_REVERT_TO_VERSION, oldRoot, ti.trie.Root)
+	s.checkTreeHealth(ti)
+
+	log.Printf("RevertToVersion: trie [%v] reverted to version [%d] root [%x] as version [%d]", treeName, v.Version, v.Root, ti.Version)
+	return s.getVersion(treeName, ti.Version)
+}
+
+func (s *universeTrieServer) Iterate(req *universe.IterateRequest, stream universe.UniTreeDB_IterateServer) error {
+	treeName := req.GetTreeName()
+
+	ti, ok := s.getTree(treeName)
+	if !ok {
+		return treeNotFound(treeName)
+	}
+
+	var root, after []byte
+	var err error
+	ti.RLock()
+	trieHeight := ti.trie.TrieHeight
+	if token := req.GetResumeToken(); len(token) != 0 {
+		root, after, err = decodeResumeToken(token)
+		if err == nil {
+			err = s.checkTreeRoot(ti, root)
+		}
+	} else {
+		root, err = s.resolveRoot(ti, req.GetRoot(), req.GetVersion())
+	}
+	ti.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	// committed nodes never change, so the tree isn't locked while streaming
+	var sent int
+	err = newNodeReader(s.aergoDB, trieHeight).walkLeavesAfter(root, after, func(key, value []byte) error {
+		if err := stream.Context().Err(); err != nil {
+			return err
+		}
+		sent++
+		return stream.Send(&universe.IterateReply{
+			Key:         key,
+			Value:       value,
+			ResumeToken: encodeResumeToken(root, key),
+		})
+	})
+
+	log.Printf("Iterate: trie [%v] root [%x] after [%x] sent %d leaves, err: %v", treeName, root, after, sent, err)
+	return err
+}
+
+func (s *universeTrieServer) Diff(req *universe.DiffRequest, stream universe.UniTreeDB_DiffServer) error {
+	treeName := req.GetTreeName()
+
+	ti, ok := s.getTree(treeName)
+	if !ok {
+		return treeNotFound(treeName)
+	}
+
+	var from, to []byte
+	ti.RLock()
+	trieHeight := ti.trie.TrieHeight
+	from, err := s.resolveRoot(ti, req.GetFromRoot(), req.GetFromVersion())
+	if err == nil {
+		to, err = s.resolveRoot(ti, req.GetToRoot(), req.GetToVersion())
+	}
+	ti.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	// committed nodes never change, so the tree isn't locked while streaming
+	var sent int
+	err = newNodeReader(s.aergoDB, trieHeight).diff(from, to, func(key, oldValue, newValue []byte) error {
+		if err := stream.Context().Err(); err != nil {
+			return err
+		}
+		change := universe.DiffChange_DIFF_MODIFIED
+		switch {
+		case oldValue == nil:
+			change = universe.DiffChange_DIFF_ADDED
+		case newValue == nil:
+			change = universe.DiffChange_DIFF_REMOVED
+		}
+		sent++
+		return stream.Send(&universe.DiffReply{
+			Key:      key,
+			Change:   change,
+			OldValue: oldValue,
+			NewValue: newValue,
+		})
+	})
+
+	log.Printf("Diff: trie [%v] from root [%x] to root [%x] sent %d keys, err: %v", treeName, from, to, sent, err)
+	return err
+}
+
+func (s *universeTrieServer) ExportTree(req *universe.ExportTreeRequest, stream universe.UniTreeDB_ExportTreeServer) error {
+	treeName := req.GetTreeName()
+
+	ti, ok := s.getTree(treeName)
+	if !ok {
+		return treeNotFound(treeName)
+	}
+
+	ti.RLock()
+	trieHeight := ti.trie.TrieHeight
+	header := &universe.SnapshotHeader{
+		FormatVersion: snapshotFormatVersion,
+		Name:          ti.Name,
+		HashAlgorithm: ti.HashAlgorithm,
+	}
+	root, err := s.resolveRoot(ti, req.GetRoot(), req.GetVersion())
+	ti.RUnlock()
+	if err != nil {
+		return err
+	}
+	header.Root = root
+
+	err = stream.Send(&universe.SnapshotChunk{Header: header})
+	if err != nil {
+		return err
+	}
+
+	// committed nodes never change, so the tree isn't locked while streaming
+	var sent int
+	chunk := &universe.SnapshotChunk{}
+	err = newNodeReader(s.aergoDB, trieHeight).walkLeaves(root, func(key, value []byte) error {
+		chunk.Keys = append(chunk.Keys, key)
+		chunk.Values = append(chunk.Values, value)
+		if len(chunk.Keys) < snapshotChunkLeaves {
+			return nil
+		}
+		sent += len(chunk.Keys)
+		err := stream.Send(chunk)
+		chunk = &universe.SnapshotChunk{}
+		return err
+	})
+	if err == nil && len(chunk.Keys) != 0 {
+		sent += len(chunk.Keys)
+		err = stream.Send(chunk)
+	}
+
+	log.Printf("ExportTree: trie [%v] root [%x] sent %d leaves, err: %v", treeName, root, sent, err)
+	return err
+}
+
+func (s *universeTrieServer) ImportTree(stream universe.UniTreeDB_ImportTreeServer) error {
+	chunk, err := stream.Recv()
+	if err == io.EOF {
+		return fieldError("", "header", "snapshot is empty")
+	}
+	if err != nil {
+		return err
+	}
+	if chunk.GetHeader() == nil {
+		return fieldError("", "header", "snapshot does not start w/a header")
+	}
+
+	imp, err := s.startImport(chunk.GetHeader())
+	if err != nil {
+		return err
+	}
+	log.Printf("ImportTree: importing tree [%v] root [%x]", imp.header.GetName(), imp.header.GetRoot())
+
+	info, err := func() (*universe.TreeInfo, error) {
+		for {
+			chunk, err := stream.Recv()
+			if err == io.EOF {
+				return imp.finish()
+			}
+			if err != nil {
+				return nil, err
+			}
+			if chunk.GetHeader() != nil {
+				return nil, fieldError(imp.ti.Name, "header", "snapshot has more than one header")
+			}
+			err = imp.add(chunk.GetKeys(), chunk.GetValues())
+			if err != nil {
+				return nil, err
+			}
+		}
+	}()
+	if err != nil {
+		log.Printf("ImportTree: import of tree [%v] failed: %v", imp.header.GetName(), err)
+		imp.abort()
+		return err
+	}
+
+	s.notify(info.Name, universe.TreeOperation_IMPORT, nil, info.Root)
+	log.Printf("ImportTree: imported tree [%v] w/%d keys", info.Name, info.KeyCount)
+	return stream.SendAndClose(info)
+}
+
+func (s *universeTrieServer) WatchTree(req *universe.WatchTreeRequest, stream universe.UniTreeDB_WatchTreeServer) error {
+	treeName := req.GetTreeName()
+
+	// a resumed watch may still have to deliver the drop of the tree
+	if treeName != "" && req.GetFromSequence() == 0 {
+		if _, ok := s.getTree(treeName); !ok {
+			return treeNotFound(treeName)
+		}
+	}
+
+	w, backlog, next, err := s.watch.subscribe(treeName, req.GetFromSequence())
+	if err != nil {
+		return err
+	}
+	defer s.watch.unsubscribe(w)
+	log.Printf("WatchTree: watching tree [%v] from sequence [%d]", treeName, next)
+
+	for _, ev := range backlog {
+		err := stream.Send(ev)
+		if err != nil {
+			return err
+		}
+		next = ev.Sequence + 1
+	}
+	for {
+		select {
+		case ev, ok := <-w.events:
+			if !ok {
+				return status.Errorf(codes.Aborted, "watcher fell behind, resume from sequence [%d]", next)
+			}
+			err := stream.Send(ev)
+			if err != nil {
+				return err
+			}
+			next = ev.Sequence + 1
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		case <-s.quit:
+			return status.Errorf(codes.Unavailable, "server is shutting down, resume from sequence [%d]", next)
+		}
+	}
+}
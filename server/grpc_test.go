@@ -0,0 +1,94 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+
+	"github.com/dashevo/universe-tree-db/universe"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRenameTree(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+
+	s := openTestServer(t, dir)
+	for _, treeName := range []string{"old", "other"} {
+		_, err := s.CreateTree(ctx, &universe.CreateTreeRequest{Name: treeName})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var versionRoots [][]byte
+	for i := 0; i < 2; i++ {
+		update(t, s, "old", testPairs(10, i*100))
+		_, err := s.Commit(ctx, &universe.CommitRequest{TreeName: "old"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		versionRoots = append(versionRoots, s.trieInfo["old"].committedRoot)
+	}
+	// an update only in the log
+	root := update(t, s, "old", testPairs(10, 200))
+
+	_, err := s.RenameTree(ctx, &universe.RenameTreeRequest{TreeName: "old", NewName: "other"})
+	if code := status.Code(err); code != codes.AlreadyExists {
+		t.Errorf("rename to an existing tree: got code %v, expected %v", code, codes.AlreadyExists)
+	}
+	_, err = s.RenameTree(ctx, &universe.RenameTreeRequest{TreeName: "old", NewName: "new"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.RenameTree(ctx, &universe.RenameTreeRequest{TreeName: "old", NewName: "newer"})
+	if code := status.Code(err); code != codes.NotFound {
+		t.Errorf("rename of the old name: got code %v, expected %v", code, codes.NotFound)
+	}
+	_, err = s.ListVersions(ctx, &universe.ListVersionsRequest{TreeName: "old"})
+	if code := status.Code(err); code != codes.NotFound {
+		t.Errorf("versions of the old name: got code %v, expected %v", code, codes.NotFound)
+	}
+	crashTestServer(s)
+
+	s = openTestServer(t, dir)
+	defer closeTestServer(s)
+	if _, ok := s.trieInfo["old"]; ok {
+		t.Error("tree is still there under the old name after a restart")
+	}
+	if _, err := os.Stat(s.walPath("old")); !os.IsNotExist(err) {
+		t.Errorf("log of the old name is still there, err: %v", err)
+	}
+	ti := s.trieInfo["new"]
+	if ti == nil {
+		t.Fatal("tree is gone under the new name after a restart")
+	}
+	if !bytes.Equal(ti.trie.Root, root) || !bytes.Equal(ti.committedRoot, versionRoots[1]) || ti.KeyCount != 30 {
+		t.Errorf("got root [%x] committed [%x] w/%d keys, expected [%x] committed [%x] w/30 keys", ti.trie.Root, ti.committedRoot, ti.KeyCount, root, versionRoots[1])
+	}
+	resp, err := s.ListVersions(ctx, &universe.ListVersionsRequest{TreeName: "new"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions := resp.GetList()
+	if len(versions) != len(versionRoots) {
+		t.Fatalf("got %d versions, expected %d", len(versions), len(versionRoots))
+	}
+	for i, v := range versions {
+		if !bytes.Equal(v.GetRoot(), versionRoots[i]) {
+			t.Errorf("version %d: got root [%x], expected [%x]", v.GetVersion(), v.GetRoot(), versionRoots[i])
+		}
+	}
+
+	// the old name is free again, w/o any of the versions
+	_, err = s.CreateTree(ctx, &universe.CreateTreeRequest{Name: "old"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err = s.ListVersions(ctx, &universe.ListVersionsRequest{TreeName: "old"})
+	if err != nil || len(resp.GetList()) != 0 {
+		t.Errorf("got %d versions of the new tree under the old name, err: %v, expected none", len(resp.GetList()), err)
+	}
+}
@@ -2,8 +2,11 @@ package main
 
 import (
 	"crypto/sha256"
+	"fmt"
 
+	"github.com/dashevo/universe-tree-db/universe"
 	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/sha3"
 )
 
 // Sha256 exports single sha256 hash function for trie
@@ -23,3 +26,26 @@ var Blake2b = func(data ...[]byte) []byte {
 	}
 	return hasher.Sum(nil)
 }
+
+// Keccak256 exports the (legacy, pre-SHA3) Keccak-256 hash function for trie,
+// as used by Ethereum and Solidity's keccak256.
+var Keccak256 = func(data ...[]byte) []byte {
+	hasher := sha3.NewLegacyKeccak256()
+	for i := 0; i < len(data); i++ {
+		hasher.Write(data[i])
+	}
+	return hasher.Sum(nil)
+}
+
+// hashFunc returns the trie hash function for the given algorithm.
+func hashFunc(alg universe.HashAlgorithm) (func(data ...[]byte) []byte, error) {
+	switch alg {
+	case universe.HashAlgorithm_SHA256:
+		return Sha256, nil
+	case universe.HashAlgorithm_BLAKE2B:
+		return Blake2b, nil
+	case universe.HashAlgorithm_KECCAK256:
+		return Keccak256, nil
+	}
+	return nil, fmt.Errorf("unknown hash algorithm [%v]", alg)
+}
@@ -0,0 +1,32 @@
+package main_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	main "github.com/dashevo/universe-tree-db/server"
+)
+
+func TestHashes(t *testing.T) {
+	tests := []struct {
+		name string
+		hash func(data ...[]byte) []byte
+		want string
+	}{
+		{"sha256", main.Sha256, "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+		{"blake2b", main.Blake2b, "0e5751c026e543b2e8ab2eb06099daa1d1e5df47778f7787faab45cdf12fe3a8"},
+		{"keccak256", main.Keccak256, "c5d2460186f7233c927e7db2dcc703c0e500b653ca82273b7bfad8045d85a470"},
+	}
+
+	for _, tt := range tests {
+		got := hex.EncodeToString(tt.hash([]byte{}))
+		if got != tt.want {
+			t.Errorf("%s: got %v, expected %v", tt.name, got, tt.want)
+		}
+		// multiple chunks hash the same as the concatenation
+		if !bytes.Equal(tt.hash([]byte("ab"), []byte("c")), tt.hash([]byte("abc"))) {
+			t.Errorf("%s: chunked input hashes differently", tt.name)
+		}
+	}
+}
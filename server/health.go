@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"log"
+	"strings"
+	"sync/atomic"
+
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+)
+
+// The server reports its health through the standard grpc.health.v1 service,
+// for the server as a whole under "" and uniTreeDBService, and for each tree
+// under treeHealthService(name). The server is NOT_SERVING until its trees
+// are loaded and once it starts shutting down. A tree is NOT_SERVING
+// (degraded) if its committed root node is missing from the aergo DB, and
+// SERVICE_UNKNOWN once dropped.
+
+// uniTreeDBService is the name of the UniTreeDB service.
+const uniTreeDBService = "universe.UniTreeDB"
+
+// healthMethodPrefix is the prefix of the full names of the methods of the
+// health service.
+const healthMethodPrefix = "/grpc.health.v1.Health/"
+
+// treeHealthService returns the name the health of a tree is reported under.
+func treeHealthService(treeName string) string {
+	return "tree/" + treeName
+}
+
+// newHealthServer returns the health service of a server still starting.
+func newHealthServer() *health.Server {
+	h := health.NewServer()
+	h.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	h.SetServingStatus(uniTreeDBService, healthpb.HealthCheckResponse_NOT_SERVING)
+	return h
+}
+
+// setReady starts serving calls, once the trees are loaded, unless the
+// server is already shutting down.
+func (s *universeTrieServer) setReady() {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.shutdown {
+		return
+	}
+	atomic.StoreInt32(&s.ready, 1)
+	s.health.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+	s.health.SetServingStatus(uniTreeDBService, healthpb.HealthCheckResponse_SERVING)
+	log.Print("Serving")
+}
+
+// setNotReady stops serving calls when shutting down.
+func (s *universeTrieServer) setNotReady() {
+	atomic.StoreInt32(&s.ready, 0)
+	s.health.Shutdown()
+}
+
+// checkTreeHealth reports a tree as degraded if its committed root node is
+// missing. The tree lock must be held.
+func (s *universeTrieServer) checkTreeHealth(ti *TreeInfo) {
+	st := healthpb.HealthCheckResponse_SERVING
+	if len(ti.committedRoot) != 0 && !ti.trie.TrieRootExists(ti.committedRoot) {
+		log.Printf("Health: tree [%v] is degraded, root node [%x] is missing", ti.Name, ti.committedRoot)
+		st = healthpb.HealthCheckResponse_NOT_SERVING
+	}
+	s.health.SetServingStatus(treeHealthService(ti.Name), st)
+}
+
+// removeTreeHealth reports a dropped tree as unknown.
+func (s *universeTrieServer) removeTreeHealth(treeName string) {
+	s.health.SetServingStatus(treeHealthService(treeName), healthpb.HealthCheckResponse_SERVICE_UNKNOWN)
+}
+
+// readyUnaryInterceptor fails unary calls to the UniTreeDB service w/
+// Unavailable while the server isn't ready.
+func (s *universeTrieServer) readyUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	err := s.checkReady(info.FullMethod)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// readyStreamInterceptor fails streaming calls to the UniTreeDB service w/
+// Unavailable while the server isn't ready.
+func (s *universeTrieServer) readyStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	err := s.checkReady(info.FullMethod)
+	if err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+func (s *universeTrieServer) checkReady(fullMethod string) error {
+	if atomic.LoadInt32(&s.ready) == 0 && strings.HasPrefix(fullMethod, uniTreeDBMethodPrefix) {
+		return status.Error(codes.Unavailable, "server is starting or shutting down")
+	}
+	return nil
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// The gateway encodes messages as JSON objects keyed by the proto field
+// names, like jsonpb w/OrigName set, except that bytes are hex rather than
+// base64 so that keys and roots read the same as in the log. 64-bit integers
+// are strings, enums are their names.
+
+var bytesType = reflect.TypeOf([]byte(nil))
+
+// messageToJSON returns the JSON value of the message v points to.
+func messageToJSON(v reflect.Value) interface{} {
+	if v.IsNil() {
+		return nil
+	}
+	v = v.Elem()
+	props := proto.GetProperties(v.Type())
+	obj := make(map[string]interface{})
+	for i, p := range props.Prop {
+		if strings.HasPrefix(p.Name, "XXX_") {
+			continue
+		}
+		obj[p.OrigName] = valueToJSON(v.Field(i), p)
+	}
+	return obj
+}
+
+func valueToJSON(v reflect.Value, p *proto.Properties) interface{} {
+	switch {
+	case v.Type() == bytesType:
+		return hex.EncodeToString(v.Bytes())
+	case v.Kind() == reflect.Slice:
+		list := make([]interface{}, v.Len())
+		for i := range list {
+			list[i] = valueToJSON(v.Index(i), p)
+		}
+		return list
+	case v.Kind() == reflect.Ptr:
+		return messageToJSON(v)
+	case p.Enum != "":
+		return v.Interface().(fmt.Stringer).String()
+	case v.Kind() == reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case v.Kind() == reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10)
+	}
+	return v.Interface()
+}
+
+// messageFromJSON sets the message v points to from its JSON value, as
+// decoded w/json.Decoder.UseNumber. Fields may also be given by their JSON
+// (lowerCamelCase) name. Errors name the invalid field.
+func messageFromJSON(data interface{}, v reflect.Value, path string) error {
+	obj, ok := data.(map[string]interface{})
+	if !ok {
+		return fieldError("", fieldPath(path, ""), "expected a JSON object")
+	}
+	v = v.Elem()
+	props := proto.GetProperties(v.Type())
+	for key, val := range obj {
+		i := fieldIndex(props, key)
+		if i < 0 {
+			return fieldError("", fieldPath(path, key), "unknown field [%v]", key)
+		}
+		if val == nil {
+			continue
+		}
+		p := props.Prop[i]
+		err := valueFromJSON(val, v.Field(i), p, fieldPath(path, p.OrigName))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fieldIndex returns the index of the struct field of a proto field, or -1.
+func fieldIndex(props *proto.StructProperties, name string) int {
+	for i, p := range props.Prop {
+		if strings.HasPrefix(p.Name, "XXX_") {
+			continue
+		}
+		if p.OrigName == name || p.JSONName == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func fieldPath(path, field string) string {
+	if path == "" || field == "" {
+		return path + field
+	}
+	return path + "." + field
+}
+
+func valueFromJSON(data interface{}, v reflect.Value, p *proto.Properties, path string) error {
+	switch {
+	case v.Type() == bytesType:
+		s, ok := data.(string)
+		if !ok {
+			return fieldError("", path, "expected a hex string")
+		}
+		b, err := hex.DecodeString(s)
+		if err != nil {
+			return fieldError("", path, "invalid hex: %v", err)
+		}
+		v.SetBytes(b)
+		return nil
+	case v.Kind() == reflect.Slice:
+		list, ok := data.([]interface{})
+		if !ok {
+			return fieldError("", path, "expected a JSON array")
+		}
+		v.Set(reflect.MakeSlice(v.Type(), len(list), len(list)))
+		for i, elem := range list {
+			err := valueFromJSON(elem, v.Index(i), p, fmt.Sprintf("%v[%d]", path, i))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	case v.Kind() == reflect.Ptr:
+		v.Set(reflect.New(v.Type().Elem()))
+		return messageFromJSON(data, v, path)
+	case p.Enum != "":
+		if s, ok := data.(string); ok {
+			n, ok := proto.EnumValueMap(p.Enum)[s]
+			if !ok {
+				return fieldError("", path, "unknown %v [%v]", p.Enum, s)
+			}
+			v.SetInt(int64(n))
+			return nil
+		}
+	case v.Kind() == reflect.Bool:
+		b, ok := data.(bool)
+		if !ok {
+			return fieldError("", path, "expected a boolean")
+		}
+		v.SetBool(b)
+		return nil
+	case v.Kind() == reflect.String:
+		s, ok := data.(string)
+		if !ok {
+			return fieldError("", path, "expected a string")
+		}
+		v.SetString(s)
+		return nil
+	}
+
+	// numbers, which may be quoted
+	var s string
+	switch n := data.(type) {
+	case json.Number:
+		s = n.String()
+	case string:
+		s = n
+	default:
+		return fieldError("", path, "expected a number")
+	}
+	switch v.Kind() {
+	case reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(s, 10, v.Type().Bits())
+		if err != nil {
+			return fieldError("", path, "invalid integer: %v", err)
+		}
+		v.SetInt(n)
+	case reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(s, 10, v.Type().Bits())
+		if err != nil {
+			return fieldError("", path, "invalid integer: %v", err)
+		}
+		v.SetUint(n)
+	default:
+		return fieldError("", path, "unsupported field type %v", v.Type())
+	}
+	return nil
+}
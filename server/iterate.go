@@ -0,0 +1,24 @@
+package main
+
+import (
+	"github.com/aergoio/aergo/pkg/trie"
+)
+
+// A resume token is the root being iterated followed by the last key sent, so
+// a resumed stream continues over the same root even if the tree has changed
+// in the meantime.
+
+// encodeResumeToken returns the resume token after key in the trie at root.
+func encodeResumeToken(root, key []byte) []byte {
+	token := make([]byte, 0, 2*trie.HashLength)
+	token = append(token, root[:trie.HashLength]...)
+	return append(token, key...)
+}
+
+// decodeResumeToken returns the root and the last key of a resume token.
+func decodeResumeToken(token []byte) ([]byte, []byte, error) {
+	if len(token) != 2*trie.HashLength {
+		return nil, nil, fieldError("", "resume_token", "invalid resume token [%x]", token)
+	}
+	return token[:trie.HashLength], token[trie.HashLength:], nil
+}
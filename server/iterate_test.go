@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/dashevo/universe-tree-db/universe"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestIteratePages(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	s := openTestServer(t, dir)
+	defer closeTestServer(s)
+	ctx := context.Background()
+
+	tests := []struct {
+		name string
+		keys int
+		page int
+	}{
+		{"empty tree", 0, 1},
+		// w/few keys every leaf is a shortcut high up in the trie
+		{"shortcut leaves", 2, 1},
+		{"single page", 50, 100},
+		{"many pages", 50, 7},
+	}
+
+	for i, tt := range tests {
+		_, err := s.CreateTree(ctx, &universe.CreateTreeRequest{Name: tt.name})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var want [][]byte
+		if tt.keys != 0 {
+			pairs := testPairs(tt.keys, i*1000)
+			update(t, s, tt.name, pairs)
+			_, err = s.Commit(ctx, &universe.CommitRequest{TreeName: tt.name})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, p := range pairs {
+				want = append(want, p.Key)
+			}
+			sort.Slice(want, func(i, j int) bool {
+				return bytes.Compare(want[i], want[j]) < 0
+			})
+		}
+
+		// each page resumes after the last key of the previous one
+		var got [][]byte
+		req := &universe.IterateRequest{TreeName: tt.name}
+		for pages := 0; ; pages++ {
+			if pages > tt.keys {
+				t.Fatalf("%s: iteration doesn't end", tt.name)
+			}
+			stream := &iterateStream{limit: tt.page}
+			err = s.Iterate(req, stream)
+			if err != nil && err != errPageFull {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			for _, r := range stream.replies {
+				got = append(got, r.Key)
+			}
+			if err == nil {
+				break
+			}
+			req = &universe.IterateRequest{TreeName: tt.name, ResumeToken: stream.replies[len(stream.replies)-1].ResumeToken}
+		}
+		if !equalBytes(got, want) {
+			t.Errorf("%s: got keys %x, expected %x", tt.name, got, want)
+		}
+	}
+}
+
+func TestIterateInvalidToken(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	s := openTestServer(t, dir)
+	defer closeTestServer(s)
+	ctx := context.Background()
+
+	_, err := s.CreateTree(ctx, &universe.CreateTreeRequest{Name: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	update(t, s, "x", testPairs(10, 0))
+	_, err = s.Commit(ctx, &universe.CommitRequest{TreeName: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := s.trieInfo["x"].committedRoot
+	key := testPairs(1, 0)[0].Key
+
+	tests := []struct {
+		name  string
+		token []byte
+		code  codes.Code
+	}{
+		{"truncated", encodeResumeToken(root, key)[:40], codes.InvalidArgument},
+		{"too long", append(encodeResumeToken(root, key), 0), codes.InvalidArgument},
+		{"unknown root", encodeResumeToken(Sha256([]byte("root")), key), codes.NotFound},
+		{"valid", encodeResumeToken(root, key), codes.OK},
+	}
+	for _, tt := range tests {
+		err := s.Iterate(&universe.IterateRequest{TreeName: "x", ResumeToken: tt.token}, &iterateStream{})
+		if code := status.Code(err); code != tt.code {
+			t.Errorf("%s: got code %v, expected %v: %v", tt.name, code, tt.code, err)
+		}
+	}
+}
+
+// errPageFull ends an iteration once a page is full.
+var errPageFull = errors.New("page full")
+
+// iterateStream collects the replies of Iterate, up to limit unless it is 0.
+type iterateStream struct {
+	grpc.ServerStream
+	replies []*universe.IterateReply
+	limit   int
+}
+
+func (st *iterateStream) Send(r *universe.IterateReply) error {
+	if st.limit != 0 && len(st.replies) == st.limit {
+		return errPageFull
+	}
+	st.replies = append(st.replies, r)
+	return nil
+}
+
+func (st *iterateStream) Context() context.Context {
+	return context.Background()
+}
@@ -1,33 +1,80 @@
 package main
 
 import (
+	"flag"
 	"log"
 	"net"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"sync"
 	"syscall"
 
-	"github.com/aergoio/aergo-lib/db"
 	"github.com/dashevo/universe-tree-db/universe"
 	"github.com/dgraph-io/badger"
 	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/reflection"
 )
 
 func main() {
-	if !dbDirValid(baseDBDir()) {
-		log.Fatal("invalid dir for db")
+	cfg, printConfig, err := loadConfig(os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if printConfig {
+		err = cfg.print(os.Stdout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	badgerLog, err := cfg.Log.setupLog()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, dir := range []string{cfg.AergoDB.Dir, cfg.MetaDB.Dir} {
+		if dir == "" || !dbDirValid(filepath.Dir(dir)) {
+			log.Fatalf("invalid dir for db [%v], set data_dir", dir)
+		}
 	}
 
 	uniTreeSrv := newUniverseTrieServer()
+	uniTreeSrv.treeDefaults = cfg.Trees
+	uniTreeSrv.limits = cfg.Limits
+	uniTreeSrv.wal = cfg.WAL
+	if cfg.WAL.Dir != "" {
+		err = os.MkdirAll(cfg.WAL.Dir, 0755)
+		if err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		log.Print("WAL disabled, updates not committed are lost on a crash")
+	}
 
 	// aergo db
-	aergoDB := db.NewDB(db.BadgerImpl, aergoDBSubDir())
+	aergoOpts, err := cfg.AergoDB.options(badgerLog)
+	if err != nil {
+		log.Fatalf("aergo_db: %v", err)
+	}
+	aergoDB, err := newBadgerDB(aergoOpts)
+	if err != nil {
+		log.Fatal(err)
+	}
 	defer aergoDB.Close()
 	uniTreeSrv.aergoDB = aergoDB
 
 	// meta db
-	metaDB, err := badger.Open(badger.DefaultOptions(metaDBSubDir()))
+	metaOpts, err := cfg.MetaDB.options(badgerLog)
+	if err != nil {
+		log.Fatalf("meta_db: %v", err)
+	}
+	metaDB, err := badger.Open(metaOpts)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -38,23 +85,85 @@ func main() {
 	var handler CloseHandler
 	handler.RegisterShutdownHandler(uniTreeSrv)
 
-	// Load tries from meta
-	err = uniTreeSrv.init()
-	if err != nil {
-		log.Fatal(err)
-	}
 	defer uniTreeSrv.GracefulStop()
 
-	strListen := srvListenAddr()
-	srv := grpc.NewServer()
+	if cfg.MetricsListen != "" {
+		err = serveMetrics(cfg.MetricsListen, uniTreeSrv, map[string]string{
+			"aergo": cfg.AergoDB.Dir,
+			"meta":  cfg.MetaDB.Dir,
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	unaryInterceptors := []grpc.UnaryServerInterceptor{metricsUnaryInterceptor, unaryStatusInterceptor, uniTreeSrv.readyUnaryInterceptor}
+	streamInterceptors := []grpc.StreamServerInterceptor{metricsStreamInterceptor, streamStatusInterceptor, uniTreeSrv.readyStreamInterceptor}
+	// the gateway authorizes calls itself
+	gatewayOpts := append([]grpc.ServerOption{
+		grpc.UnaryInterceptor(chainUnaryInterceptors(unaryInterceptors...)),
+		grpc.StreamInterceptor(chainStreamInterceptors(streamInterceptors...)),
+	}, cfg.Limits.serverOptions()...)
+	var auth *authorizer
+	if cfg.ACLFile != "" {
+		auth, err = newAuthorizer(cfg.ACLFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		unaryInterceptors = append(unaryInterceptors, auth.unaryInterceptor)
+		streamInterceptors = append(streamInterceptors, auth.streamInterceptor)
+		log.Printf("ACL policy [%v] enabled", cfg.ACLFile)
+	} else {
+		log.Print("ACL policy disabled, all calls are allowed")
+	}
+	opts := []grpc.ServerOption{
+		grpc.UnaryInterceptor(chainUnaryInterceptors(unaryInterceptors...)),
+		grpc.StreamInterceptor(chainStreamInterceptors(streamInterceptors...)),
+	}
+	opts = append(opts, cfg.Limits.serverOptions()...)
+	var reloader *certReloader
+	if cfg.TLS.Cert != "" || cfg.TLS.Key != "" || cfg.TLS.ClientCA != "" {
+		if cfg.TLS.Cert == "" || cfg.TLS.Key == "" {
+			log.Fatal("TLS needs both a certificate and a key")
+		}
+		reloader, err = newCertReloader(cfg.TLS.Cert, cfg.TLS.Key, cfg.TLS.ClientCA)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts = append(opts, grpc.Creds(credentials.NewTLS(reloader.tlsConfig())))
+		log.Printf("TLS enabled, client certificates required: %v", cfg.TLS.ClientCA != "")
+	} else {
+		log.Print("TLS disabled, serving plaintext")
+	}
+	srv := grpc.NewServer(opts...)
 	universe.RegisterUniTreeDBServer(srv, uniTreeSrv)
+	healthpb.RegisterHealthServer(srv, uniTreeSrv.health)
+	reflection.Register(srv)
 	handler.RegisterShutdownHandler(srv)
+
+	if cfg.GatewayListen != "" {
+		gatewaySrv, err := serveGateway(cfg.GatewayListen, uniTreeSrv, auth, reloader, gatewayOpts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		handler.RegisterShutdownHandler(gatewaySrv)
+	}
 	handler.Init()
 
-	l, err := net.Listen("tcp", strListen)
+	l, err := net.Listen("tcp", cfg.Listen)
 	if err != nil {
-		log.Fatalf("could not listen on %s: %v", strListen, err)
+		log.Fatalf("could not listen on %s: %v", cfg.Listen, err)
 	}
+
+	// serve health checks while the tries are loaded from meta, other calls
+	// fail w/Unavailable until they are
+	go func() {
+		err := uniTreeSrv.init()
+		if err != nil {
+			log.Fatal(err)
+		}
+		uniTreeSrv.setReady()
+	}()
 	err = srv.Serve(l)
 	if err != nil {
 		log.Fatal(err)
@@ -72,30 +181,6 @@ func dbDirValid(dir string) bool {
 	return true
 }
 
-// srvListenAddr returns the IP / port to listen on
-func srvListenAddr() string {
-	listen := os.Getenv("UNIDB_LISTEN")
-	if len(listen) == 0 {
-		listen = "127.0.0.1:9002"
-	}
-	return listen
-}
-
-func baseDBDir() string {
-	dbDirVar := "UNIDB_DIR"
-	dbDir := os.Getenv(dbDirVar)
-	if len(dbDir) == 0 {
-		log.Printf("db dir %s not set in environment", dbDirVar)
-	}
-	return dbDir
-}
-func aergoDBSubDir() string {
-	return baseDBDir() + "/aergo"
-}
-func metaDBSubDir() string {
-	return baseDBDir() + "/meta"
-}
-
 // Graceful is an interface services implement to shutdown gracefully.
 type Graceful interface {
 	GracefulStop()
@@ -1,32 +1,93 @@
 package main
 
 import (
-	"bytes"
-	"encoding/gob"
+	"encoding/binary"
+	"fmt"
 
+	"github.com/dashevo/universe-tree-db/universe"
 	"github.com/dgraph-io/badger"
+	"github.com/golang/protobuf/proto"
 )
 
 // keys for metadb
 const (
-	KeyTrees      = "tries"
-	KeyInfoPrefix = "info:"
+	KeyTrees         = "tries"
+	KeyInfoPrefix    = "info:"
+	KeyDropPrefix    = "drop:"
+	KeyVersionPrefix = "version:"
+	KeyWatchSequence = "watchseq"
+	KeySchemaVersion = "schema"
+	KeyMultiPrefix   = "multi:"
 )
 
-// SerializeStringSlice serializes a list of strings to bytes.
-func SerializeStringSlice(slc []string) []byte {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	enc.Encode(slc)
-	return buf.Bytes()
+// versionDigits is the width of the zero padded version number in version
+// keys, so that the versions of a tree sort in order.
+const versionDigits = 20
+
+// versionPrefix returns the key prefix of all versions of a tree.
+func versionPrefix(treeName string) []byte {
+	return []byte(KeyVersionPrefix + treeName + ":")
+}
+
+// versionKey returns the meta DB key of a version of a tree.
+func versionKey(treeName string, version uint64) []byte {
+	return []byte(fmt.Sprintf("%s%s:%0*d", KeyVersionPrefix, treeName, versionDigits, version))
+}
+
+// multiUpdateKey returns the meta DB key of the marker of a multi-tree
+// update.
+func multiUpdateKey(id uint64) []byte {
+	return []byte(fmt.Sprintf("%s%0*d", KeyMultiPrefix, versionDigits, id))
 }
 
-// DeserializeStringSlice constructs a list of strings from bytes.
-func DeserializeStringSlice(data []byte) []string {
-	var slc []string
-	dec := gob.NewDecoder(bytes.NewReader(data))
-	dec.Decode(&slc)
-	return slc
+// SerializeTreeList serializes a list of tree names to bytes.
+func SerializeTreeList(names []string) ([]byte, error) {
+	return proto.Marshal(&universe.TreeList{Names: names})
+}
+
+// DeserializeTreeList constructs a list of tree names from bytes.
+func DeserializeTreeList(data []byte) ([]string, error) {
+	var list universe.TreeList
+	err := proto.Unmarshal(data, &list)
+	if err != nil {
+		return nil, err
+	}
+	return list.Names, nil
+}
+
+// SerializeDropProgress serializes a drop progress record to bytes.
+func SerializeDropProgress(dp *universe.DropProgress) ([]byte, error) {
+	return proto.Marshal(dp)
+}
+
+// DeserializeDropProgress constructs a drop progress record from bytes.
+func DeserializeDropProgress(data []byte) (*universe.DropProgress, error) {
+	var dp universe.DropProgress
+	err := proto.Unmarshal(data, &dp)
+	if err != nil {
+		return nil, err
+	}
+	return &dp, nil
+}
+
+// SerializeTreeVersion serializes a version record to bytes.
+func SerializeTreeVersion(v *universe.TreeVersion) ([]byte, error) {
+	return proto.Marshal(v)
+}
+
+// DeserializeTreeVersion constructs a version record from bytes.
+func DeserializeTreeVersion(data []byte) (*universe.TreeVersion, error) {
+	var v universe.TreeVersion
+	err := proto.Unmarshal(data, &v)
+	if err != nil {
+		return nil, err
+	}
+	return &v, nil
+}
+
+// recordError describes a meta DB record which could not be decoded.
+func recordError(key []byte, err error) error {
+	return fmt.Errorf("invalid meta DB record [%s]: %w", key, err)
 }
 
 // MetaListTrees retrieves the trees list from the meta DB.
@@ -40,11 +101,13 @@ func (s *universeTrieServer) MetaListTrees() ([]string, error) {
 			}
 			return nil
 		}
-		err = item.Value(func(val []byte) error {
-			list = DeserializeStringSlice(val)
+		return item.Value(func(val []byte) error {
+			list, err = DeserializeTreeList(val)
+			if err != nil {
+				return recordError(item.Key(), err)
+			}
 			return nil
 		})
-		return err
 	})
 	if err != nil {
 		return nil, err
@@ -53,8 +116,8 @@ func (s *universeTrieServer) MetaListTrees() ([]string, error) {
 }
 
 // MetaGetTreeInfo retrieves a tree info object from the meta DB.
-func (s *universeTrieServer) MetaGetTreeInfo(treeName string) (TreeInfo, error) {
-	var info TreeInfo
+func (s *universeTrieServer) MetaGetTreeInfo(treeName string) (*TreeInfo, error) {
+	info := &TreeInfo{}
 	err := s.metaDB.View(func(txn *badger.Txn) error {
 		item, err := txn.Get([]byte(KeyInfoPrefix + treeName))
 		if err != nil {
@@ -63,32 +126,431 @@ func (s *universeTrieServer) MetaGetTreeInfo(treeName string) (TreeInfo, error)
 			}
 			return nil
 		}
-		err = item.Value(func(val []byte) error {
-			info = TreeInfoFromBytes(val)
+		return item.Value(func(val []byte) error {
+			info, err = TreeInfoFromBytes(val)
+			if err != nil {
+				return recordError(item.Key(), err)
+			}
 			return nil
 		})
-		return err
 	})
 	if err != nil {
-		return TreeInfo{}, err
+		return nil, err
 	}
 	return info, nil
 }
 
 // MetaSaveTrees updates the list of trees in the meta DB.
 func (s *universeTrieServer) MetaSaveTrees(trees []string) error {
-	err := s.metaDB.Update(func(txn *badger.Txn) error {
-		err := txn.Set([]byte(KeyTrees), SerializeStringSlice(trees))
+	val, err := SerializeTreeList(trees)
+	if err != nil {
+		return err
+	}
+	err = s.metaDB.Update(func(txn *badger.Txn) error {
+		err := txn.Set([]byte(KeyTrees), val)
 		return err
 	})
 	return err
 }
 
 // MetaSetTreeInfo saves a tree info object to the meta DB.
-func (s *universeTrieServer) MetaSetTreeInfo(treeName string, ti TreeInfo) error {
+func (s *universeTrieServer) MetaSetTreeInfo(treeName string, ti *TreeInfo) error {
+	val, err := ti.Serialize()
+	if err != nil {
+		return err
+	}
+	err = s.metaDB.Update(func(txn *badger.Txn) error {
+		err := txn.Set([]byte(KeyInfoPrefix+treeName), val)
+		return err
+	})
+	return err
+}
+
+// MetaDropTree removes a tree info object from the meta DB, saves the tree
+// list w/o it and records the pending reclaim of its nodes, all in one
+// transaction.
+func (s *universeTrieServer) MetaDropTree(treeName string, dp *universe.DropProgress, trees []string) error {
+	val, err := SerializeDropProgress(dp)
+	if err != nil {
+		return err
+	}
+	treesVal, err := SerializeTreeList(trees)
+	if err != nil {
+		return err
+	}
+	err = s.metaDB.Update(func(txn *badger.Txn) error {
+		err := txn.Delete([]byte(KeyInfoPrefix + treeName))
+		if err != nil {
+			return err
+		}
+		err = txn.Set([]byte(KeyTrees), treesVal)
+		if err != nil {
+			return err
+		}
+		err = deleteVersions(txn, treeName)
+		if err != nil {
+			return err
+		}
+		return txn.Set([]byte(KeyDropPrefix+treeName), val)
+	})
+	return err
+}
+
+// MetaRenameTree moves the tree info object and the version records of a
+// tree from oldName to the name of ti, and saves the tree list, all in one
+// transaction.
+func (s *universeTrieServer) MetaRenameTree(oldName string, ti *TreeInfo, trees []string) error {
+	infoVal, err := ti.Serialize()
+	if err != nil {
+		return err
+	}
+	listVal, err := SerializeTreeList(trees)
+	if err != nil {
+		return err
+	}
+	err = s.metaDB.Update(func(txn *badger.Txn) error {
+		err := txn.Delete([]byte(KeyInfoPrefix + oldName))
+		if err != nil {
+			return err
+		}
+		err = txn.Set([]byte(KeyInfoPrefix+ti.Name), infoVal)
+		if err != nil {
+			return err
+		}
+		err = moveVersions(txn, oldName, ti.Name)
+		if err != nil {
+			return err
+		}
+		return txn.Set([]byte(KeyTrees), listVal)
+	})
+	return err
+}
+
+// MetaSetDropProgress saves a drop progress record to the meta DB.
+func (s *universeTrieServer) MetaSetDropProgress(dp *universe.DropProgress) error {
+	val, err := SerializeDropProgress(dp)
+	if err != nil {
+		return err
+	}
+	err = s.metaDB.Update(func(txn *badger.Txn) error {
+		err := txn.Set([]byte(KeyDropPrefix+dp.Name), val)
+		return err
+	})
+	return err
+}
+
+// MetaDeleteDropProgress removes a drop progress record from the meta DB.
+func (s *universeTrieServer) MetaDeleteDropProgress(treeName string) error {
+	err := s.metaDB.Update(func(txn *badger.Txn) error {
+		err := txn.Delete([]byte(KeyDropPrefix + treeName))
+		return err
+	})
+	return err
+}
+
+// MetaListDropProgress retrieves all drop progress records from the meta DB.
+func (s *universeTrieServer) MetaListDropProgress() ([]*universe.DropProgress, error) {
+	var list []*universe.DropProgress
+	err := s.metaDB.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := []byte(KeyDropPrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			err := it.Item().Value(func(val []byte) error {
+				dp, err := DeserializeDropProgress(val)
+				if err != nil {
+					return recordError(it.Item().Key(), err)
+				}
+				list = append(list, dp)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// MetaAppendVersion saves a new version record of a tree along with the tree
+// info object which references it.
+func (s *universeTrieServer) MetaAppendVersion(ti *TreeInfo, v *universe.TreeVersion) error {
+	versionVal, err := SerializeTreeVersion(v)
+	if err != nil {
+		return err
+	}
+	infoVal, err := ti.Serialize()
+	if err != nil {
+		return err
+	}
+	err = s.metaDB.Update(func(txn *badger.Txn) error {
+		err := txn.Set(versionKey(ti.Name, v.Version), versionVal)
+		if err != nil {
+			return err
+		}
+		return txn.Set([]byte(KeyInfoPrefix+ti.Name), infoVal)
+	})
+	return err
+}
+
+// MetaRevertTree saves a reverted tree and deletes the versions whose roots
+// were lost in one transaction.
+func (s *universeTrieServer) MetaRevertTree(ti *TreeInfo, versions []uint64) error {
+	infoVal, err := ti.Serialize()
+	if err != nil {
+		return err
+	}
+	err = s.metaDB.Update(func(txn *badger.Txn) error {
+		for _, version := range versions {
+			err := txn.Delete(versionKey(ti.Name, version))
+			if err != nil {
+				return err
+			}
+		}
+		return txn.Set([]byte(KeyInfoPrefix+ti.Name), infoVal)
+	})
+	return err
+}
+
+// MetaGetVersion retrieves a version record of a tree from the meta DB. It
+// returns nil if there is no such version.
+func (s *universeTrieServer) MetaGetVersion(treeName string, version uint64) (*universe.TreeVersion, error) {
+	var v *universe.TreeVersion
+	err := s.metaDB.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(versionKey(treeName, version))
+		if err != nil {
+			if err != badger.ErrKeyNotFound {
+				return err
+			}
+			return nil
+		}
+		return item.Value(func(val []byte) error {
+			v, err = DeserializeTreeVersion(val)
+			if err != nil {
+				return recordError(item.Key(), err)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// MetaListVersions retrieves up to limit version records of a tree, starting
+// at version from. A limit of 0 retrieves all of them.
+func (s *universeTrieServer) MetaListVersions(treeName string, from uint64, limit int) ([]*universe.TreeVersion, error) {
+	var list []*universe.TreeVersion
+	err := s.metaDB.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		prefix := versionPrefix(treeName)
+		for it.Seek(versionKey(treeName, from)); it.ValidForPrefix(prefix); it.Next() {
+			if limit > 0 && len(list) >= limit {
+				break
+			}
+			// skip the versions of other trees whose name starts w/treeName + ":"
+			if len(it.Item().Key()) != len(prefix)+versionDigits {
+				continue
+			}
+			err := it.Item().Value(func(val []byte) error {
+				v, err := DeserializeTreeVersion(val)
+				if err != nil {
+					return recordError(it.Item().Key(), err)
+				}
+				list = append(list, v)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// deleteVersions deletes all version records of a tree.
+func deleteVersions(txn *badger.Txn, treeName string) error {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	var keys [][]byte
+	prefix := versionPrefix(treeName)
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		if len(it.Item().Key()) != len(prefix)+versionDigits {
+			continue
+		}
+		keys = append(keys, it.Item().KeyCopy(nil))
+	}
+	for _, key := range keys {
+		err := txn.Delete(key)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveVersions moves all version records of a tree to another name.
+func moveVersions(txn *badger.Txn, oldName, newName string) error {
+	it := txn.NewIterator(badger.DefaultIteratorOptions)
+	defer it.Close()
+
+	var keys, vals [][]byte
+	prefix := versionPrefix(oldName)
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		if len(it.Item().Key()) != len(prefix)+versionDigits {
+			continue
+		}
+		val, err := it.Item().ValueCopy(nil)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, it.Item().KeyCopy(nil))
+		vals = append(vals, val)
+	}
+	for i, key := range keys {
+		err := txn.Delete(key)
+		if err != nil {
+			return err
+		}
+		err = txn.Set(append(versionPrefix(newName), key[len(prefix):]...), vals[i])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// MetaGetWatchSequence retrieves the sequence reserved for tree events from
+// the meta DB, 0 if none was reserved yet.
+func (s *universeTrieServer) MetaGetWatchSequence() (uint64, error) {
+	var seq uint64
+	err := s.metaDB.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(KeyWatchSequence))
+		if err != nil {
+			if err != badger.ErrKeyNotFound {
+				return err
+			}
+			return nil
+		}
+		return item.Value(func(val []byte) error {
+			if len(val) != 8 {
+				return fmt.Errorf("invalid watch sequence [%x]", val)
+			}
+			seq = binary.BigEndian.Uint64(val)
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	return seq, nil
+}
+
+// MetaSetWatchSequence saves the sequence reserved for tree events to the
+// meta DB.
+func (s *universeTrieServer) MetaSetWatchSequence(seq uint64) error {
+	val := make([]byte, 8)
+	binary.BigEndian.PutUint64(val, seq)
+	err := s.metaDB.Update(func(txn *badger.Txn) error {
+		err := txn.Set([]byte(KeyWatchSequence), val)
+		return err
+	})
+	return err
+}
+
+// MetaSetMultiUpdate saves the tree info objects of the trees of a multi-tree
+// update in one transaction, along w/the marker of the update unless id is 0.
+func (s *universeTrieServer) MetaSetMultiUpdate(tis []*TreeInfo, id uint64) error {
+	vals := make([][]byte, len(tis))
+	for i, ti := range tis {
+		val, err := ti.Serialize()
+		if err != nil {
+			return err
+		}
+		vals[i] = val
+	}
 	err := s.metaDB.Update(func(txn *badger.Txn) error {
-		err := txn.Set([]byte(KeyInfoPrefix+treeName), ti.Serialize())
+		for i, ti := range tis {
+			err := txn.Set([]byte(KeyInfoPrefix+ti.Name), vals[i])
+			if err != nil {
+				return err
+			}
+		}
+		if id == 0 {
+			return nil
+		}
+		return txn.Set(multiUpdateKey(id), nil)
+	})
+	return err
+}
+
+// MetaHasMultiUpdate checks whether the marker of a multi-tree update is in
+// the meta DB.
+func (s *universeTrieServer) MetaHasMultiUpdate(id uint64) (bool, error) {
+	found := false
+	err := s.metaDB.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(multiUpdateKey(id))
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		found = err == nil
 		return err
 	})
+	return found, err
+}
+
+// MetaListMultiUpdates retrieves the ids of all multi-tree update markers
+// from the meta DB.
+func (s *universeTrieServer) MetaListMultiUpdates() ([]uint64, error) {
+	var ids []uint64
+	err := s.metaDB.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		prefix := []byte(KeyMultiPrefix)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			var id uint64
+			_, err := fmt.Sscanf(string(it.Item().Key()[len(prefix):]), "%d", &id)
+			if err != nil {
+				return recordError(it.Item().Key(), err)
+			}
+			ids = append(ids, id)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// MetaDeleteMultiUpdates removes multi-tree update markers from the meta DB.
+func (s *universeTrieServer) MetaDeleteMultiUpdates(ids []uint64) error {
+	err := s.metaDB.Update(func(txn *badger.Txn) error {
+		for _, id := range ids {
+			err := txn.Delete(multiUpdateKey(id))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 	return err
 }
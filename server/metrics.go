@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dashevo/universe-tree-db/universe"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+const metricsNamespace = "unidb"
+
+var (
+	rpcDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "rpc_duration_seconds",
+		Help:      "Duration of RPCs, streams included.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+	rpcErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rpc_errors_total",
+		Help:      "Failed RPCs by status code.",
+	}, []string{"method", "code"})
+	treeOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "tree_operations_total",
+		Help:      "Changes of a tree by operation, e.g. updates and commits.",
+	}, []string{"tree", "operation"})
+)
+
+// countOperation counts a change of a tree. The counters of a dropped tree
+// are removed.
+func countOperation(treeName string, op universe.TreeOperation) {
+	if op != universe.TreeOperation_DROP {
+		treeOperations.WithLabelValues(treeName, op.String()).Inc()
+		return
+	}
+	for name := range universe.TreeOperation_value {
+		treeOperations.DeleteLabelValues(treeName, name)
+	}
+}
+
+// moveOperations moves the counters of a renamed tree to its new name.
+func moveOperations(oldName, newName string) {
+	for name := range universe.TreeOperation_value {
+		c, err := treeOperations.GetMetricWithLabelValues(oldName, name)
+		if err != nil {
+			continue
+		}
+		var m dto.Metric
+		if c.Write(&m) == nil && m.GetCounter().GetValue() != 0 {
+			treeOperations.WithLabelValues(newName, name).Add(m.GetCounter().GetValue())
+		}
+		treeOperations.DeleteLabelValues(oldName, name)
+	}
+}
+
+// metricsUnaryInterceptor times unary calls and counts their errors.
+func metricsUnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	observeRPC(info.FullMethod, start, err)
+	return resp, err
+}
+
+// metricsStreamInterceptor times streaming calls and counts their errors.
+func metricsStreamInterceptor(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	start := time.Now()
+	err := handler(srv, ss)
+	observeRPC(info.FullMethod, start, err)
+	return err
+}
+
+func observeRPC(fullMethod string, start time.Time, err error) {
+	method := path.Base(fullMethod)
+	rpcDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	if err != nil {
+		rpcErrors.WithLabelValues(method, status.Code(err).String()).Inc()
+	}
+}
+
+// serverCollector exports the state of the trees and the size of the DBs at
+// scrape time.
+type serverCollector struct {
+	s *universeTrieServer
+	// dbDirs maps the name of each badger DB to its dir
+	dbDirs map[string]string
+
+	loadDbCounter    *prometheus.Desc
+	loadCacheCounter *prometheus.Desc
+	keys             *prometheus.Desc
+	uncommitted      *prometheus.Desc
+	uncommittedKeys  *prometheus.Desc
+	sinceCommit      *prometheus.Desc
+	updatedNodes     *prometheus.Desc
+	lsmSize          *prometheus.Desc
+	vlogSize         *prometheus.Desc
+}
+
+// newServerCollector creates a serverCollector for the trees of s.
+func newServerCollector(s *universeTrieServer, dbDirs map[string]string) *serverCollector {
+	treeDesc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "tree", name), help, []string{"tree"}, nil)
+	}
+	dbDesc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "badger", name), help, []string{"db"}, nil)
+	}
+	return &serverCollector{
+		s:                s,
+		dbDirs:           dbDirs,
+		loadDbCounter:    treeDesc("load_db_counter", "Nodes loaded from the aergo DB by the last update of the trie."),
+		loadCacheCounter: treeDesc("load_cache_counter", "Nodes loaded from the cache by the last update of the trie."),
+		keys:             treeDesc("keys", "Keys in the current root of the tree."),
+		uncommitted:      treeDesc("uncommitted", "1 if the current root of the tree is not committed, 0 otherwise."),
+		uncommittedKeys:  treeDesc("uncommitted_keys", "Keys added (or removed, if negative) since the last commit of the tree."),
+		sinceCommit:      treeDesc("seconds_since_commit", "Seconds since the last commit of the tree."),
+		updatedNodes:     treeDesc("updated_nodes_bytes", "Estimated memory held by the updated nodes of the tree until the next commit."),
+		lsmSize:          dbDesc("lsm_size_bytes", "Size of the LSM tree of the badger DB."),
+		vlogSize:         dbDesc("vlog_size_bytes", "Size of the value log of the badger DB."),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *serverCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.loadDbCounter
+	ch <- c.loadCacheCounter
+	ch <- c.keys
+	ch <- c.uncommitted
+	ch <- c.uncommittedKeys
+	ch <- c.sinceCommit
+	ch <- c.updatedNodes
+	ch <- c.lsmSize
+	ch <- c.vlogSize
+}
+
+// Collect implements prometheus.Collector.
+func (c *serverCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, ti := range c.s.trees() {
+		ti.RLock()
+		info := ti.info()
+		var uncommitted float64
+		if !bytes.Equal(ti.trie.Root, ti.committedRoot) {
+			uncommitted = 1
+		}
+		uncommittedKeys := float64(int64(ti.KeyCount) - int64(ti.committedKeyCount))
+		sinceCommit := time.Since(ti.lastCommit).Seconds()
+		updatedNodes := float64(ti.updatedNodesBytes())
+		ti.RUnlock()
+
+		ch <- prometheus.MustNewConstMetric(c.loadDbCounter, prometheus.GaugeValue, float64(info.LoadDbCounter), info.Name)
+		ch <- prometheus.MustNewConstMetric(c.loadCacheCounter, prometheus.GaugeValue, float64(info.LoadCacheCounter), info.Name)
+		ch <- prometheus.MustNewConstMetric(c.keys, prometheus.GaugeValue, float64(info.KeyCount), info.Name)
+		ch <- prometheus.MustNewConstMetric(c.uncommitted, prometheus.GaugeValue, uncommitted, info.Name)
+		ch <- prometheus.MustNewConstMetric(c.uncommittedKeys, prometheus.GaugeValue, uncommittedKeys, info.Name)
+		ch <- prometheus.MustNewConstMetric(c.sinceCommit, prometheus.GaugeValue, sinceCommit, info.Name)
+		ch <- prometheus.MustNewConstMetric(c.updatedNodes, prometheus.GaugeValue, updatedNodes, info.Name)
+	}
+
+	for name, dir := range c.dbDirs {
+		lsm, vlog, err := badgerSize(dir)
+		if err != nil {
+			log.Printf("metrics: could not get size of %v DB: %v", name, err)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.lsmSize, prometheus.GaugeValue, float64(lsm), name)
+		ch <- prometheus.MustNewConstMetric(c.vlogSize, prometheus.GaugeValue, float64(vlog), name)
+	}
+}
+
+// badgerSize returns the size of the LSM tree and of the value log of the
+// badger DB in dir, the same way badger sums up its files.
+func badgerSize(dir string) (int64, int64, error) {
+	var lsm, vlog int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		switch {
+		case strings.HasSuffix(path, ".sst"):
+			lsm += info.Size()
+		case strings.HasSuffix(path, ".vlog"):
+			vlog += info.Size()
+		}
+		return nil
+	})
+	return lsm, vlog, err
+}
+
+// serveMetrics serves the metrics of s over HTTP at /metrics.
+func serveMetrics(addr string, s *universeTrieServer, dbDirs map[string]string) error {
+	reg := prometheus.NewRegistry()
+	err := reg.Register(prometheus.NewGoCollector())
+	if err == nil {
+		err = reg.Register(prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	}
+	for _, c := range []prometheus.Collector{rpcDuration, rpcErrors, treeOperations, newServerCollector(s, dbDirs)} {
+		if err == nil {
+			err = reg.Register(c)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
+	go func() {
+		err := http.Serve(l, mux)
+		log.Printf("metrics: stopped serving on %v: %v", addr, err)
+	}()
+	log.Printf("metrics: serving on %v/metrics", addr)
+	return nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/dashevo/universe-tree-db/universe"
+	"github.com/dgraph-io/badger"
+	"github.com/golang/protobuf/proto"
+)
+
+// The schema version of the meta DB records is stored under
+// KeySchemaVersion. A meta DB w/records but w/o a schema version is from
+// before versioning, i.e. version 1. On startup, the migrations up to
+// metaSchemaVersion are run in order, each one recording its version once
+// done.
+
+// metaSchemaVersion is the schema version of the meta DB records written.
+const metaSchemaVersion = 2
+
+// metaMigration upgrades the meta DB records from the previous schema
+// version to version.
+type metaMigration struct {
+	version uint32
+	name    string
+	migrate func(db *badger.DB) error
+}
+
+var metaMigrations = []metaMigration{
+	{version: 2, name: "gob to protobuf", migrate: migrateGobToProto},
+}
+
+// migrateMeta upgrades the meta DB to the current schema version.
+func (s *universeTrieServer) migrateMeta() error {
+	version, err := s.MetaGetSchemaVersion()
+	if err != nil {
+		return err
+	}
+	if version == 0 {
+		empty, err := metaEmpty(s.metaDB)
+		if err != nil {
+			return err
+		}
+		if empty {
+			return s.MetaSetSchemaVersion(metaSchemaVersion)
+		}
+		version = 1
+	}
+	if version > metaSchemaVersion {
+		return fmt.Errorf("meta DB schema version [%d] is newer than the supported version [%d]", version, metaSchemaVersion)
+	}
+
+	for _, m := range metaMigrations {
+		if m.version <= version {
+			continue
+		}
+		log.Printf("migrateMeta: migrating meta DB from schema version [%d] to [%d]: %v", version, m.version, m.name)
+		err := m.migrate(s.metaDB)
+		if err != nil {
+			return fmt.Errorf("could not migrate meta DB to schema version [%d]: %w", m.version, err)
+		}
+		err = s.MetaSetSchemaVersion(m.version)
+		if err != nil {
+			return err
+		}
+		version = m.version
+	}
+	return nil
+}
+
+// metaEmpty reports whether the meta DB has no records at all.
+func metaEmpty(db *badger.DB) (bool, error) {
+	empty := true
+	err := db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		it.Rewind()
+		empty = !it.Valid()
+		return nil
+	})
+	return empty, err
+}
+
+// MetaGetSchemaVersion retrieves the schema version of the meta DB records,
+// 0 if none was recorded yet.
+func (s *universeTrieServer) MetaGetSchemaVersion() (uint32, error) {
+	var version uint32
+	err := s.metaDB.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(KeySchemaVersion))
+		if err != nil {
+			if err != badger.ErrKeyNotFound {
+				return err
+			}
+			return nil
+		}
+		return item.Value(func(val []byte) error {
+			if len(val) != 4 {
+				return recordError(item.Key(), fmt.Errorf("invalid schema version [%x]", val))
+			}
+			version = binary.BigEndian.Uint32(val)
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	return version, nil
+}
+
+// MetaSetSchemaVersion saves the schema version of the meta DB records.
+func (s *universeTrieServer) MetaSetSchemaVersion(version uint32) error {
+	val := make([]byte, 4)
+	binary.BigEndian.PutUint32(val, version)
+	err := s.metaDB.Update(func(txn *badger.Txn) error {
+		err := txn.Set([]byte(KeySchemaVersion), val)
+		return err
+	})
+	return err
+}
+
+// migrateGobToProto re-encodes the gob records of schema version 1 as
+// protobuf. A migration interrupted by a crash is simply run again, so
+// records which are already protobuf are left as they are.
+func migrateGobToProto(db *badger.DB) error {
+	type record struct {
+		key, val []byte
+	}
+	var records []record
+	err := db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			v, msg := gobRecord(string(item.Key()))
+			if v == nil {
+				continue
+			}
+
+			err := item.Value(func(val []byte) error {
+				gobErr := gob.NewDecoder(bytes.NewReader(val)).Decode(v)
+				if gobErr != nil {
+					if proto.Unmarshal(val, msg()) == nil {
+						// already migrated
+						return nil
+					}
+					return recordError(item.Key(), gobErr)
+				}
+				data, err := proto.Marshal(msg())
+				if err != nil {
+					return err
+				}
+				records = append(records, record{item.KeyCopy(nil), data})
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// the records may not fit in one transaction
+	txn := db.NewTransaction(true)
+	for _, r := range records {
+		err := txn.Set(r.key, r.val)
+		if err == badger.ErrTxnTooBig {
+			err = txn.Commit()
+			if err != nil {
+				return err
+			}
+			txn = db.NewTransaction(true)
+			err = txn.Set(r.key, r.val)
+		}
+		if err != nil {
+			txn.Discard()
+			return err
+		}
+	}
+	err = txn.Commit()
+	if err != nil {
+		return err
+	}
+	log.Printf("migrateMeta: re-encoded [%d] records", len(records))
+	return nil
+}
+
+// gobRecord returns the value to gob decode a record of schema version 1
+// into, and a func returning the decoded value as a proto message. The value
+// is nil for records which weren't gob encoded.
+func gobRecord(key string) (interface{}, func() proto.Message) {
+	switch {
+	case key == KeyTrees:
+		var names []string
+		return &names, func() proto.Message {
+			return &universe.TreeList{Names: names}
+		}
+	case strings.HasPrefix(key, KeyInfoPrefix):
+		info := &universe.TreeInfo{}
+		return info, func() proto.Message { return info }
+	case strings.HasPrefix(key, KeyDropPrefix):
+		dp := &universe.DropProgress{}
+		return dp, func() proto.Message { return dp }
+	case strings.HasPrefix(key, KeyVersionPrefix):
+		v := &universe.TreeVersion{}
+		return v, func() proto.Message { return v }
+	}
+	return nil, nil
+}
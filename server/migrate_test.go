@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dashevo/universe-tree-db/universe"
+	"github.com/dgraph-io/badger"
+)
+
+func TestMigrateGobToProto(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	metaDB, err := badger.Open(badger.DefaultOptions(filepath.Join(dir, "meta")).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer metaDB.Close()
+	s := newUniverseTrieServer()
+	s.metaDB = metaDB
+
+	root := Sha256([]byte("root"))
+	info := &universe.TreeInfo{Name: "x", Root: root, TrieHeight: 256, KeyCount: 3, Version: 2, HashAlgorithm: universe.HashAlgorithm_KECCAK256}
+	version := &universe.TreeVersion{Version: 2, Root: root, Timestamp: 1500000000, KeyCount: 3}
+	// the records of schema version 1
+	records := map[string]interface{}{
+		KeyTrees:                   []string{"x"},
+		KeyInfoPrefix + "x":        info,
+		string(versionKey("x", 2)): version,
+	}
+	writeGob := func(key string) {
+		var buf bytes.Buffer
+		err := gob.NewEncoder(&buf).Encode(records[key])
+		if err == nil {
+			err = metaDB.Update(func(txn *badger.Txn) error {
+				return txn.Set([]byte(key), buf.Bytes())
+			})
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for key := range records {
+		writeGob(key)
+	}
+
+	check := func(run string) {
+		schema, err := s.MetaGetSchemaVersion()
+		if err != nil || schema != metaSchemaVersion {
+			t.Fatalf("%s: got schema version %d, err: %v, expected %d", run, schema, err, metaSchemaVersion)
+		}
+		trees, err := s.MetaListTrees()
+		if err != nil || len(trees) != 1 || trees[0] != "x" {
+			t.Errorf("%s: got trees %v, err: %v", run, trees, err)
+		}
+		ti, err := s.MetaGetTreeInfo("x")
+		if err != nil || ti.Name != "x" || !bytes.Equal(ti.Root, root) || ti.KeyCount != 3 || ti.HashAlgorithm != universe.HashAlgorithm_KECCAK256 {
+			t.Errorf("%s: got tree info %v, err: %v", run, ti, err)
+		}
+		v, err := s.MetaGetVersion("x", 2)
+		if err != nil || v == nil || !bytes.Equal(v.Root, root) || v.Timestamp != version.Timestamp {
+			t.Errorf("%s: got version %v, err: %v", run, v, err)
+		}
+	}
+
+	err = s.migrateMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("migration")
+
+	// a migration interrupted after re-encoding some records runs again
+	writeGob(KeyInfoPrefix + "x")
+	err = s.MetaSetSchemaVersion(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.migrateMeta()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("rerun")
+}
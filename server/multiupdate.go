@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/dashevo/universe-tree-db/universe"
+)
+
+// A multi-tree update applies a batch to each of several trees, all or
+// nothing. The trees are always locked in the same order, so that multi-tree
+// updates of overlapping trees can't deadlock. All batches are checked before
+// any is applied. If a batch still fails, or the new roots can't be saved to
+// the meta DB, the batches already applied are undone by setting their keys
+// back to the old values, which restores the old roots. An update deletes
+// the uncommitted nodes it replaces, so a tree whose batch can't be undone
+// that way is rebuilt from its log instead.
+
+// multiUpdateBatch is the batch of one tree in a multi-tree update.
+type multiUpdateBatch struct {
+	ti     *TreeInfo
+	keys   [][]byte
+	values [][]byte
+	// old are the values of the keys before the update, delta the change of
+	// the key count
+	old   [][]byte
+	delta int64
+	// oldRoot is the root before the update, offset the size of the log
+	// before the batch was logged
+	oldRoot []byte
+	offset  int64
+	logged  bool
+	applied bool
+}
+
+// lockMultiUpdate looks up and locks the trees of a multi-tree update and
+// checks their batches. It returns the batches in the order of the updates,
+// w/their trees locked unless there is an error.
+func (s *universeTrieServer) lockMultiUpdate(updates []*universe.UpdateRequest) ([]*multiUpdateBatch, error) {
+	if len(updates) == 0 {
+		return nil, fieldError("", "updates", "multi-tree update has no updates")
+	}
+	batches := make([]*multiUpdateBatch, len(updates))
+	seen := make(map[string]bool, len(updates))
+	for i, u := range updates {
+		treeName := u.GetTreeName()
+		if seen[treeName] {
+			return nil, fieldError(treeName, fmt.Sprintf("updates[%d].tree_name", i), "tree [%v] is updated more than once", treeName)
+		}
+		seen[treeName] = true
+	}
+
+	// the trees are locked w/the server lock, so they can't be renamed in
+	// the meantime
+	s.RLock()
+	locked := make([]*multiUpdateBatch, 0, len(batches))
+	for i, u := range updates {
+		ti, ok := s.trieInfo[u.GetTreeName()]
+		if !ok {
+			s.RUnlock()
+			return nil, treeNotFound(u.GetTreeName())
+		}
+		batches[i] = &multiUpdateBatch{ti: ti}
+		locked = append(locked, batches[i])
+	}
+	sort.Slice(locked, func(i, j int) bool {
+		return locked[i].ti.Name < locked[j].ti.Name
+	})
+	for _, b := range locked {
+		b.ti.Lock()
+	}
+	s.RUnlock()
+
+	for i, b := range batches {
+		err := s.checkMultiUpdateBatch(b, updates[i])
+		if err != nil {
+			unlockMultiUpdate(batches)
+			return nil, err
+		}
+	}
+	return batches, nil
+}
+
+// checkMultiUpdateBatch checks the batch of one tree and reads the old values
+// of its keys.
+// Expected to be called w/tree lock.
+func (s *universeTrieServer) checkMultiUpdateBatch(b *multiUpdateBatch, u *universe.UpdateRequest) error {
+	ti := b.ti
+	keys, values, err := updatePairs(ti.Name, u.GetKeyValuePairs(), ti.trie.TrieHeight/8, s.limits.MaxUpdatePairs, u.GetSortPairs())
+	if err != nil {
+		return err
+	}
+	old, delta, err := oldValues(ti.trie, keys, values)
+	if err != nil {
+		return err
+	}
+	b.keys, b.values, b.old, b.delta = keys, values, old, delta
+	return nil
+}
+
+// unlockMultiUpdate unlocks the trees of a multi-tree update.
+func unlockMultiUpdate(batches []*multiUpdateBatch) {
+	for _, b := range batches {
+		b.ti.Unlock()
+	}
+}
+
+// applyMultiUpdate logs and applies the batches of a multi-tree update and
+// saves the new roots in one meta DB transaction. On error, none of the
+// trees are changed.
+// Expected to be called w/the tree locks of all batches.
+func (s *universeTrieServer) applyMultiUpdate(batches []*multiUpdateBatch, atomic bool) error {
+	var id uint64
+	if s.wal.Dir != "" {
+		id = s.newMultiUpdateID()
+	}
+
+	for _, b := range batches {
+		offset, err := s.logUpdate(b.ti, b.keys, b.values, atomic, id)
+		if err != nil {
+			s.undoMultiUpdate(batches)
+			return err
+		}
+		b.offset = offset
+		b.logged = true
+	}
+
+	for _, b := range batches {
+		t := b.ti.trie
+		b.oldRoot = t.Root
+		var err error
+		if atomic {
+			_, err = t.AtomicUpdate(b.keys, b.values)
+		} else {
+			_, err = t.Update(b.keys, b.values)
+		}
+		if err != nil {
+			log.Printf("MultiUpdate: could not update tree [%v]: %v", b.ti.Name, err)
+			s.undoMultiUpdate(batches)
+			return err
+		}
+		b.applied = true
+		b.ti.KeyCount = uint64(int64(b.ti.KeyCount) + b.delta)
+	}
+
+	tis := make([]*TreeInfo, len(batches))
+	for i, b := range batches {
+		b.ti.syncFromTrie()
+		tis[i] = b.ti
+	}
+	err := s.MetaSetMultiUpdate(tis, id)
+	if err != nil {
+		log.Printf("MultiUpdate: could not save the roots of the trees: %v", err)
+		s.undoMultiUpdate(batches)
+		return err
+	}
+
+	if id != 0 {
+		for _, b := range batches {
+			s.holdMultiUpdates(b.ti.wal, []uint64{id})
+		}
+	}
+	return nil
+}
+
+// undoMultiUpdate undoes the batches of a multi-tree update which were
+// applied or logged.
+// Expected to be called w/the tree locks of all batches.
+func (s *universeTrieServer) undoMultiUpdate(batches []*multiUpdateBatch) {
+	for i := len(batches) - 1; i >= 0; i-- {
+		b := batches[i]
+		if b.applied {
+			t := b.ti.trie
+			root, err := t.Update(b.keys, b.old)
+			if err == nil && !bytes.Equal(root, b.oldRoot) {
+				err = fmt.Errorf("undo led to root [%x]", root)
+			}
+			b.applied = false
+			if err != nil {
+				// the uncommitted nodes of the old root may be gone
+				log.Printf("MultiUpdate: could not undo update of tree [%v], rebuilding it from its log: %v", b.ti.Name, err)
+				if b.logged {
+					s.unlogUpdate(b.ti, b.offset)
+					b.logged = false
+				}
+				err = s.rebuildTree(b.ti)
+				if err != nil {
+					log.Printf("MultiUpdate: could not rebuild tree [%v]: %v", b.ti.Name, err)
+				}
+				continue
+			}
+			b.ti.KeyCount = uint64(int64(b.ti.KeyCount) - b.delta)
+			b.ti.syncFromTrie()
+		}
+		if b.logged {
+			s.unlogUpdate(b.ti, b.offset)
+			b.logged = false
+		}
+	}
+}
+
+// newMultiUpdateID returns a new id for a multi-tree update, which is unique
+// across restarts as long as the clock doesn't go back.
+func (s *universeTrieServer) newMultiUpdateID() uint64 {
+	s.multiLock.Lock()
+	defer s.multiLock.Unlock()
+
+	id := uint64(time.Now().UnixNano())
+	if id <= s.lastMultiUpdate {
+		id = s.lastMultiUpdate + 1
+	}
+	s.lastMultiUpdate = id
+	return id
+}
+
+// checkMultiUpdate returns an error if a logged batch is part of a multi-tree
+// update whose marker is missing from the meta DB, i.e. the update wasn't
+// completed.
+func (s *universeTrieServer) checkMultiUpdate(id uint64) error {
+	if id == 0 {
+		return nil
+	}
+	found, err := s.MetaHasMultiUpdate(id)
+	if err != nil {
+		return err
+	}
+	if !found {
+		return fmt.Errorf("multi-tree update [%d] was not completed", id)
+	}
+	return nil
+}
+
+// holdMultiUpdates records that a log holds batches of the multi-tree
+// updates ids.
+// Expected to be called w/tree lock.
+func (s *universeTrieServer) holdMultiUpdates(l *treeLog, ids []uint64) {
+	if l == nil || len(ids) == 0 {
+		return
+	}
+	s.multiLock.Lock()
+	defer s.multiLock.Unlock()
+
+	for _, id := range ids {
+		s.multiUpdates[id]++
+	}
+	l.multiUpdates = append(l.multiUpdates, ids...)
+}
+
+// releaseMultiUpdates drops the hold of a discarded log on its multi-tree
+// updates, and removes the markers of the updates no log holds anymore.
+// Expected to be called w/tree lock.
+func (s *universeTrieServer) releaseMultiUpdates(l *treeLog) {
+	if l == nil || len(l.multiUpdates) == 0 {
+		return
+	}
+	var done []uint64
+	s.multiLock.Lock()
+	for _, id := range l.multiUpdates {
+		s.multiUpdates[id]--
+		if s.multiUpdates[id] <= 0 {
+			delete(s.multiUpdates, id)
+			done = append(done, id)
+		}
+	}
+	s.multiLock.Unlock()
+	l.multiUpdates = nil
+
+	if len(done) == 0 {
+		return
+	}
+	err := s.MetaDeleteMultiUpdates(done)
+	if err != nil {
+		// removed on the next startup
+		log.Printf("WAL: could not remove markers of multi-tree updates %v: %v", done, err)
+	}
+}
+
+// pruneMultiUpdates removes the markers of the multi-tree updates which no
+// log holds anymore, once the logs are replayed on startup.
+func (s *universeTrieServer) pruneMultiUpdates() error {
+	ids, err := s.MetaListMultiUpdates()
+	if err != nil {
+		return err
+	}
+
+	s.multiLock.Lock()
+	var stale []uint64
+	for _, id := range ids {
+		if id > s.lastMultiUpdate {
+			s.lastMultiUpdate = id
+		}
+		if s.multiUpdates[id] == 0 {
+			stale = append(stale, id)
+		}
+	}
+	s.multiLock.Unlock()
+
+	if len(stale) == 0 {
+		return nil
+	}
+	log.Printf("loadTries: removing [%d] markers of multi-tree updates no log holds", len(stale))
+	return s.MetaDeleteMultiUpdates(stale)
+}
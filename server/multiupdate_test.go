@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+
+	"github.com/aergoio/aergo/pkg/trie"
+	"github.com/dashevo/universe-tree-db/universe"
+)
+
+func TestMultiUpdateRollback(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+
+	s := openTestServer(t, dir)
+	for i, treeName := range []string{"a", "b"} {
+		_, err := s.CreateTree(ctx, &universe.CreateTreeRequest{Name: treeName})
+		if err != nil {
+			t.Fatal(err)
+		}
+		update(t, s, treeName, testPairs(10, i*100))
+	}
+	closeTestServer(s)
+
+	// the nodes are only in the DB after a restart, so the root node of 'b'
+	// can be taken away once the batches are checked
+	s = openTestServer(t, dir)
+	defer closeTestServer(s)
+	root := update(t, s, "a", testPairs(10, 200))
+	bRoot := s.trieInfo["b"].committedRoot
+
+	batches, err := s.lockMultiUpdate([]*universe.UpdateRequest{
+		{TreeName: "a", KeyValuePairs: testPairs(10, 300), SortPairs: true},
+		{TreeName: "b", KeyValuePairs: testPairs(10, 400), SortPairs: true},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	node := s.aergoDB.Get(bRoot)
+	s.aergoDB.Delete(bRoot)
+	err = s.applyMultiUpdate(batches, false)
+	s.aergoDB.Set(bRoot, node)
+	unlockMultiUpdate(batches)
+	if err == nil {
+		t.Fatal("multi-tree update w/a missing node succeeded")
+	}
+
+	// 'a' is back at its uncommitted root, w/all its nodes
+	ti := s.trieInfo["a"]
+	if !bytes.Equal(ti.trie.Root, root) || ti.KeyCount != 20 {
+		t.Errorf("got root [%x] w/%d keys, expected [%x] w/20 keys", ti.trie.Root, ti.KeyCount, root)
+	}
+	_, batchesLogged, _, _, err := s.readLog("a")
+	if err != nil || len(batchesLogged) != 1 {
+		t.Errorf("got %d logged updates, err: %v, expected 1", len(batchesLogged), err)
+	}
+	_, err = s.Commit(ctx, &universe.CommitRequest{TreeName: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := newNodeReader(s.aergoDB, ti.trie.TrieHeight).countLeaves(ti.committedRoot)
+	if err != nil || keys != 20 {
+		t.Errorf("got %d committed keys, err: %v, expected 20", keys, err)
+	}
+}
+
+func TestRebuildTree(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	s := openTestServer(t, dir)
+	defer closeTestServer(s)
+	ctx := context.Background()
+
+	_, err := s.CreateTree(ctx, &universe.CreateTreeRequest{Name: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	update(t, s, "x", testPairs(10, 0))
+	_, err = s.Commit(ctx, &universe.CommitRequest{TreeName: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	update(t, s, "x", testPairs(10, 100))
+	root := update(t, s, "x", testPairs(10, 200))
+
+	// the trie lost the nodes of its uncommitted root
+	ti := s.trieInfo["x"]
+	ti.Lock()
+	defer ti.Unlock()
+	hash, _ := hashFunc(ti.HashAlgorithm)
+	ti.trie = trie.NewTrie(root, hash, s.aergoDB)
+	err = s.rebuildTree(ti)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ti.trie.Root, root) || ti.KeyCount != 30 || ti.pendingUpdates != 2 {
+		t.Errorf("got root [%x] w/%d keys and %d pending updates, expected [%x] w/30 keys and 2", ti.trie.Root, ti.KeyCount, ti.pendingUpdates, root)
+	}
+	value, err := ti.trie.Get(testPairs(1, 200)[0].Key)
+	if err != nil || !bytes.Equal(value, testPairs(1, 200)[0].Value) {
+		t.Errorf("got value [%x], err: %v, expected [%x]", value, err, testPairs(1, 200)[0].Value)
+	}
+}
+
+func TestReplayMultiUpdate(t *testing.T) {
+	tests := []struct {
+		name string
+		// completed is whether the marker of the multi-tree update is saved
+		completed bool
+		// logged is the number of updates left in each log
+		logged int
+	}{
+		{"completed", true, 2},
+		{"marker missing", false, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := testDir(t)
+			defer os.RemoveAll(dir)
+			ctx := context.Background()
+
+			s := openTestServer(t, dir)
+			roots := make(map[string][]byte)
+			for i, treeName := range []string{"a", "b"} {
+				_, err := s.CreateTree(ctx, &universe.CreateTreeRequest{Name: treeName})
+				if err != nil {
+					t.Fatal(err)
+				}
+				roots[treeName] = update(t, s, treeName, testPairs(10, i*100))
+			}
+			resp, err := s.MultiUpdate(ctx, &universe.MultiUpdateRequest{Updates: []*universe.UpdateRequest{
+				{TreeName: "a", KeyValuePairs: testPairs(10, 200), SortPairs: true},
+				{TreeName: "b", KeyValuePairs: testPairs(10, 300), SortPairs: true},
+			}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.completed {
+				for _, r := range resp.GetRoots() {
+					roots[r.GetTreeName()] = r.GetRoot()
+				}
+			} else {
+				err = s.MetaDeleteMultiUpdates(s.trieInfo["a"].wal.multiUpdates)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			crashTestServer(s)
+
+			s = openTestServer(t, dir)
+			defer closeTestServer(s)
+			for treeName, root := range roots {
+				ti := s.trieInfo[treeName]
+				if !bytes.Equal(ti.trie.Root, root) {
+					t.Errorf("tree [%v]: got root [%x], expected [%x]", treeName, ti.trie.Root, root)
+				}
+				_, batches, _, _, err := s.readLog(treeName)
+				if err != nil || len(batches) != tt.logged {
+					t.Errorf("tree [%v]: got %d logged updates, err: %v, expected %d", treeName, len(batches), err, tt.logged)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/aergoio/aergo-lib/db"
+	"github.com/aergoio/aergo/pkg/trie"
+)
+
+// errNodeNotFound is returned when a trie node is not stored in the aergo DB,
+// e.g. because it was never committed or has already been reclaimed.
+var errNodeNotFound = errors.New("trie node not found")
+
+// nodeReader reads committed trie nodes straight from the aergo DB.
+//
+// The aergo trie does not expose its nodes, so this mirrors the node layout
+// of github.com/aergoio/aergo/pkg/trie: every 4 levels of the tree are stored
+// together as one batch under the hash of the batch root. Each node in a batch
+// is a 32 byte hash followed by a flag byte: 0 for an interior node, 1 for a
+// shortcut (a subtree holding a single key) and 2 for the key and value of a
+// shortcut.
+type nodeReader struct {
+	store      db.DB
+	trieHeight int
+}
+
+// newNodeReader creates a nodeReader for tries of the given height.
+func newNodeReader(store db.DB, trieHeight int) *nodeReader {
+	return &nodeReader{
+		store:      store,
+		trieHeight: trieHeight,
+	}
+}
+
+// loadBatch fetches and decodes the batch stored under root.
+func (r *nodeReader) loadBatch(root []byte) ([][]byte, error) {
+	val := r.store.Get(root[:trie.HashLength])
+	if len(val) == 0 {
+		return nil, fmt.Errorf("%w: %x", errNodeNotFound, root[:trie.HashLength])
+	}
+	return parseBatch(val), nil
+}
+
+// loadChildren returns the children of the node at iBatch in batch, loading a
+// new batch from the DB when height is on a batch boundary. It returns the
+// batch and index the children belong to and whether the node is a shortcut,
+// in which case the children are the key and the value.
+func (r *nodeReader) loadChildren(root []byte, height, iBatch int, batch [][]byte) ([][]byte, int, []byte, []byte, bool, error) {
+	isShortcut := false
+	if height%4 == 0 {
+		var err error
+		batch, err = r.loadBatch(root)
+		if err != nil {
+			return nil, 0, nil, nil, false, err
+		}
+		iBatch = 0
+		if batch[0][0] == 1 {
+			isShortcut = true
+		}
+	} else {
+		if len(batch[iBatch]) != 0 && batch[iBatch][trie.HashLength] == 1 {
+			isShortcut = true
+		}
+	}
+	return batch, iBatch, batch[2*iBatch+1], batch[2*iBatch+2], isShortcut, nil
+}
+
+// get fetches the value of a key by going down the trie from root.
+func (r *nodeReader) get(root, key []byte) ([]byte, error) {
+	return r.getNode(root, key, nil, 0, r.trieHeight)
+}
+
+func (r *nodeReader) getNode(root, key []byte, batch [][]byte, iBatch, height int) ([]byte, error) {
+	if len(root) == 0 {
+		// the trie does not contain the key
+		return nil, nil
+	}
+	batch, iBatch, lnode, rnode, isShortcut, err := r.loadChildren(root, height, iBatch, batch)
+	if err != nil {
+		return nil, err
+	}
+	if isShortcut || height == 0 {
+		if bytes.Equal(lnode[:trie.HashLength], key) {
+			return rnode[:trie.HashLength], nil
+		}
+		return nil, nil
+	}
+	if bitIsSet(key, r.trieHeight-height) {
+		return r.getNode(rnode, key, batch, 2*iBatch+2, height-1)
+	}
+	return r.getNode(lnode, key, batch, 2*iBatch+1, height-1)
+}
+
+// walkLeaves calls fn for every key/value in the trie at root, in key order.
+func (r *nodeReader) walkLeaves(root []byte, fn func(key, value []byte) error) error {
+	return r.walkLeavesAfter(root, nil, fn)
+}
+
+// walkLeavesAfter calls fn for every key/value in the trie at root whose key
+// is greater than after, in key order. Subtrees which only hold smaller keys
+// are skipped without being loaded.
+func (r *nodeReader) walkLeavesAfter(root, after []byte, fn func(key, value []byte) error) error {
+	return r.walkNode(root, after, nil, 0, r.trieHeight, fn)
+}
+
+func (r *nodeReader) walkNode(root, after []byte, batch [][]byte, iBatch, height int, fn func(key, value []byte) error) error {
+	if len(root) == 0 {
+		return nil
+	}
+	batch, iBatch, lnode, rnode, isShortcut, err := r.loadChildren(root, height, iBatch, batch)
+	if err != nil {
+		return err
+	}
+	if isShortcut || height == 0 {
+		key := lnode[:trie.HashLength]
+		if after != nil && bytes.Compare(key, after) <= 0 {
+			return nil
+		}
+		return fn(key, rnode[:trie.HashLength])
+	}
+	if after != nil && bitIsSet(after, r.trieHeight-height) {
+		// every key on the left is smaller than after
+		return r.walkNode(rnode, after, batch, 2*iBatch+2, height-1, fn)
+	}
+	err = r.walkNode(lnode, after, batch, 2*iBatch+1, height-1, fn)
+	if err != nil {
+		return err
+	}
+	// every key on the right is greater than after
+	return r.walkNode(rnode, nil, batch, 2*iBatch+2, height-1, fn)
+}
+
+// countLeaves returns the number of keys in the trie at root.
+func (r *nodeReader) countLeaves(root []byte) (uint64, error) {
+	var n uint64
+	err := r.walkLeaves(root, func(key, value []byte) error {
+		n++
+		return nil
+	})
+	return n, err
+}
+
+// isNotFound reports whether err was caused by a missing trie node.
+func isNotFound(err error) bool {
+	return err != nil && errors.Is(err, errNodeNotFound)
+}
+
+// parseBatch decodes the byte data into a slice of nodes and bitmap, the same
+// way the aergo trie does.
+func parseBatch(val []byte) [][]byte {
+	batch := make([][]byte, 31)
+	bitmap := val[:4]
+	// check if the batch root is a shortcut
+	if bitIsSet(val, 31) {
+		batch[0] = []byte{1}
+		batch[1] = val[4 : 4+33]
+		batch[2] = val[4+33 : 4+33*2]
+	} else {
+		batch[0] = []byte{0}
+		j := 0
+		for i := 1; i <= 30; i++ {
+			if bitIsSet(bitmap, i-1) {
+				batch[i] = val[4+33*j : 4+33*(j+1)]
+				j++
+			}
+		}
+	}
+	return batch
+}
+
+// bitIsSet reports whether bit i (counting from the most significant bit of
+// the first byte) is set.
+func bitIsSet(bits []byte, i int) bool {
+	return bits[i/8]&(1<<uint(7-i%8)) != 0
+}
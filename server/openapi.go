@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/golang/protobuf/proto"
+)
+
+// openAPISpec returns the OpenAPI 3 description of the gateway endpoints of
+// methods.
+func openAPISpec(methods []gatewayMethod) ([]byte, error) {
+	schemas := map[string]interface{}{
+		"Status": map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"code":    map[string]interface{}{"type": "integer", "description": "gRPC status code"},
+				"message": map[string]interface{}{"type": "string"},
+				"details": map[string]interface{}{
+					"type":  "array",
+					"items": map[string]interface{}{"type": "object", "description": "detail w/its proto message name in @type"},
+				},
+			},
+		},
+	}
+	errorResponse := map[string]interface{}{
+		"description": "the gRPC status of a failed call",
+		"content": map[string]interface{}{
+			"application/json": map[string]interface{}{"schema": schemaRef("Status")},
+		},
+	}
+
+	paths := make(map[string]interface{})
+	for _, m := range methods {
+		reqContent, respContent := "application/json", "application/json"
+		if m.clientStreams {
+			reqContent = "application/x-ndjson"
+		}
+		desc := "the reply"
+		if m.serverStreams {
+			respContent = "application/x-ndjson"
+			desc = "a reply per line, the last line is {\"error\": Status} if the call fails once started"
+		}
+		paths[gatewayPathPrefix+m.name] = map[string]interface{}{
+			"post": map[string]interface{}{
+				"operationId": m.name,
+				"requestBody": map[string]interface{}{
+					"required": true,
+					"content": map[string]interface{}{
+						reqContent: map[string]interface{}{"schema": messageSchema(schemas, m.reqType)},
+					},
+				},
+				"responses": map[string]interface{}{
+					"200": map[string]interface{}{
+						"description": desc,
+						"content": map[string]interface{}{
+							respContent: map[string]interface{}{"schema": messageSchema(schemas, m.respType)},
+						},
+					},
+					"default": errorResponse,
+				},
+			},
+		}
+	}
+
+	return json.MarshalIndent(map[string]interface{}{
+		"openapi": "3.0.0",
+		"info": map[string]interface{}{
+			"title":       "UniTreeDB JSON gateway",
+			"version":     "1",
+			"description": "Every RPC of the UniTreeDB service, w/bytes as hex strings and 64-bit integers as decimal strings. Bearer tokens go in the Authorization header.",
+		},
+		"paths":      paths,
+		"components": map[string]interface{}{"schemas": schemas},
+	}, "", "  ")
+}
+
+func schemaRef(name string) map[string]interface{} {
+	return map[string]interface{}{"$ref": "#/components/schemas/" + name}
+}
+
+// messageSchema adds the schema of the message struct type t, and of the
+// messages it contains, to schemas and returns a reference to it.
+func messageSchema(schemas map[string]interface{}, t reflect.Type) map[string]interface{} {
+	name := proto.MessageName(reflect.New(t).Interface().(proto.Message))
+	if _, ok := schemas[name]; ok {
+		return schemaRef(name)
+	}
+	properties := make(map[string]interface{})
+	schemas[name] = map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+	}
+	props := proto.GetProperties(t)
+	for i, p := range props.Prop {
+		if strings.HasPrefix(p.Name, "XXX_") {
+			continue
+		}
+		properties[p.OrigName] = fieldSchema(schemas, t.Field(i).Type, p)
+	}
+	return schemaRef(name)
+}
+
+func fieldSchema(schemas map[string]interface{}, t reflect.Type, p *proto.Properties) map[string]interface{} {
+	switch {
+	case t == bytesType:
+		return map[string]interface{}{"type": "string", "format": "hex", "pattern": "^([0-9a-fA-F]{2})*$"}
+	case t.Kind() == reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": fieldSchema(schemas, t.Elem(), p)}
+	case t.Kind() == reflect.Ptr:
+		return messageSchema(schemas, t.Elem())
+	case p.Enum != "":
+		values := proto.EnumValueMap(p.Enum)
+		names := make([]string, 0, len(values))
+		for name := range values {
+			names = append(names, name)
+		}
+		sort.Slice(names, func(i, j int) bool {
+			return values[names[i]] < values[names[j]]
+		})
+		return map[string]interface{}{"type": "string", "enum": names}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int32:
+		return map[string]interface{}{"type": "integer", "format": "int32"}
+	case reflect.Uint32:
+		return map[string]interface{}{"type": "integer", "format": "int64", "minimum": 0}
+	case reflect.Int64:
+		return map[string]interface{}{"type": "string", "format": "int64"}
+	case reflect.Uint64:
+		return map[string]interface{}{"type": "string", "format": "uint64"}
+	}
+	return map[string]interface{}{"type": "string"}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/aergoio/aergo/pkg/trie"
+	"github.com/dashevo/universe-tree-db/universe"
+	"google.golang.org/grpc/codes"
+)
+
+// snapshotFormatVersion is the version of the snapshot chunks sent by
+// ExportTree and accepted by ImportTree.
+const snapshotFormatVersion = 1
+
+// snapshotChunkLeaves is the number of leaves sent in one snapshot chunk.
+const snapshotChunkLeaves = 1000
+
+// importCommitLeaves is the number of leaves after which an import commits
+// its updated nodes, so that big trees aren't held in memory.
+const importCommitLeaves = 100000
+
+// treeImport rebuilds a tree from the leaves of a snapshot. The tree only
+// joins the trie map once all its leaves are in and its root matches the
+// snapshot root.
+type treeImport struct {
+	s      *universeTrieServer
+	ti     *TreeInfo
+	header *universe.SnapshotHeader
+	// lastKey is the greatest key imported so far
+	lastKey []byte
+	pending int
+	// roots are the roots committed so far, reclaimed if the import fails
+	roots [][]byte
+}
+
+// startImport checks a snapshot header and reserves the name of the tree to
+// import.
+func (s *universeTrieServer) startImport(header *universe.SnapshotHeader) (*treeImport, error) {
+	if header.GetFormatVersion() != snapshotFormatVersion {
+		return nil, fieldError(header.GetName(), "header.format_version", "snapshot format version [%d] is not supported", header.GetFormatVersion())
+	}
+	treeName := header.GetName()
+	if treeName == "" {
+		return nil, fieldError("", "header.name", "snapshot has no tree name")
+	}
+	hash, err := hashFunc(header.GetHashAlgorithm())
+	if err != nil {
+		return nil, fieldError(treeName, "header.hash_algorithm", "%v", err)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.trieInfo[treeName]; ok {
+		return nil, treeError(codes.AlreadyExists, treeName, "tree [%v] already exists", treeName)
+	}
+	if _, ok := s.imports[treeName]; ok {
+		return nil, treeError(codes.AlreadyExists, treeName, "tree [%v] is already being imported", treeName)
+	}
+	if d, ok := s.drops[treeName]; ok && !d.finished() {
+		return nil, treeError(codes.FailedPrecondition, treeName, "tree [%v] is still being dropped", treeName)
+	}
+
+	// the trie keeps the aergo default of not caching nodes, an import only
+	// goes through each node once
+	ti := &TreeInfo{
+		trie: trie.NewTrie(nil, hash, s.aergoDB),
+		TreeInfo: universe.TreeInfo{
+			Name:          treeName,
+			HashAlgorithm: header.GetHashAlgorithm(),
+		},
+	}
+	s.imports[treeName] = ti
+	return &treeImport{s: s, ti: ti, header: header}, nil
+}
+
+// add imports the next leaves of the snapshot, which must come in key order.
+func (imp *treeImport) add(keys, values [][]byte) error {
+	if len(keys) != len(values) {
+		return fieldError(imp.ti.Name, "values", "snapshot chunk has [%d] keys but [%d] values", len(keys), len(values))
+	}
+	for i, key := range keys {
+		if len(key) != trie.HashLength {
+			return fieldError(imp.ti.Name, fmt.Sprintf("keys[%d]", i), "snapshot key [%x] has length [%d], expected [%d]", key, len(key), trie.HashLength)
+		}
+		if bytes.Compare(key, imp.lastKey) <= 0 {
+			return fieldError(imp.ti.Name, fmt.Sprintf("keys[%d]", i), "snapshot key [%x] is out of order", key)
+		}
+		if len(values[i]) != trie.HashLength {
+			return fieldError(imp.ti.Name, fmt.Sprintf("values[%d]", i), "snapshot value [%x] of key [%x] has length [%d], expected [%d]", values[i], key, len(values[i]), trie.HashLength)
+		}
+		imp.lastKey = key
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	_, err := imp.ti.trie.Update(keys, values)
+	if err != nil {
+		return err
+	}
+	imp.ti.KeyCount += uint64(len(keys))
+	imp.pending += len(keys)
+	if imp.pending >= importCommitLeaves {
+		return imp.commit()
+	}
+	return nil
+}
+
+// commit writes the nodes updated so far to the aergo DB.
+func (imp *treeImport) commit() error {
+	imp.s.nodeLock.RLock()
+	defer imp.s.nodeLock.RUnlock()
+
+	err := imp.ti.trie.Commit()
+	if err != nil {
+		return err
+	}
+	imp.ti.committedRoot = imp.ti.trie.Root
+	imp.ti.committedKeyCount = imp.ti.KeyCount
+	imp.pending = 0
+	if len(imp.ti.committedRoot) != 0 {
+		imp.roots = append(imp.roots, imp.ti.committedRoot)
+	}
+	return nil
+}
+
+// finish checks the imported root and adds the tree to the trie map.
+func (imp *treeImport) finish() (*universe.TreeInfo, error) {
+	err := imp.commit()
+	if err != nil {
+		return nil, err
+	}
+	ti := imp.ti
+	if !bytes.Equal(ti.committedRoot, imp.header.GetRoot()) {
+		return nil, fieldError(ti.Name, "header.root", "imported root [%x] does not match snapshot root [%x]", ti.committedRoot, imp.header.GetRoot())
+	}
+
+	s := imp.s
+	s.Lock()
+	defer s.Unlock()
+
+	if _, ok := s.trieInfo[ti.Name]; ok {
+		return nil, treeError(codes.AlreadyExists, ti.Name, "tree [%v] already exists", ti.Name)
+	}
+
+	ti.Lock()
+	defer ti.Unlock()
+
+	ti.AutoCommit = s.treeDefaults.autoCommitPolicy()
+	ti.lastCommit = time.Now()
+	// replaces any log left by a tree of the same name
+	err = s.resetLog(ti)
+	if err != nil {
+		return nil, err
+	}
+	delete(s.imports, ti.Name)
+	s.trieInfo[ti.Name] = ti
+	// the info is saved w/the version before the tree joins the tree list
+	err = s.appendVersion(ti, nil)
+	if err == nil {
+		err = s.syncTreeList()
+	}
+	if err != nil {
+		// the tree would be gone after a restart, its nodes are reclaimed
+		// by the abort
+		delete(s.trieInfo, ti.Name)
+		s.imports[ti.Name] = ti
+		s.removeLog(ti)
+		return nil, err
+	}
+	s.checkTreeHealth(ti)
+	return ti.info(), nil
+}
+
+// abort gives up the import, reclaiming the nodes it has already committed.
+func (imp *treeImport) abort() {
+	s := imp.s
+	s.Lock()
+	defer s.Unlock()
+
+	if s.imports[imp.ti.Name] != imp.ti {
+		// already added to the trie map
+		return
+	}
+	delete(s.imports, imp.ti.Name)
+	if len(imp.roots) == 0 {
+		return
+	}
+	if d, ok := s.drops[imp.ti.Name]; ok && !d.finished() {
+		log.Printf("ImportTree: not reclaiming nodes of tree [%v], it is still being dropped", imp.ti.Name)
+		return
+	}
+
+	dp := &universe.DropProgress{
+		Name:      imp.ti.Name,
+		Roots:     imp.roots,
+		StartedAt: time.Now().Unix(),
+	}
+	err := s.MetaSetDropProgress(dp)
+	if err != nil {
+		log.Printf("ImportTree: could not save reclaim of tree [%v]: %v", imp.ti.Name, err)
+		return
+	}
+	s.startDrop(dp)
+}
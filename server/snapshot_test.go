@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/dashevo/universe-tree-db/universe"
+	"google.golang.org/grpc"
+)
+
+func TestExportImport(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+
+	src := openTestServer(t, filepath.Join(dir, "src"))
+	defer closeTestServer(src)
+	_, err := src.CreateTree(ctx, &universe.CreateTreeRequest{Name: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// more leaves than fit in one chunk
+	update(t, src, "x", testPairs(2500, 0))
+	_, err = src.Commit(ctx, &universe.CommitRequest{TreeName: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	root := src.trieInfo["x"].committedRoot
+	export := &snapshotStream{}
+	err = src.ExportTree(&universe.ExportTreeRequest{TreeName: "x"}, export)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dst := openTestServer(t, filepath.Join(dir, "dst"))
+	dst.treeDefaults.AutoCommitUpdates = 10
+	err = dst.ImportTree(export)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := export.info
+	if !bytes.Equal(info.GetRoot(), root) || info.GetKeyCount() != 2500 || info.GetAutoCommit().GetUpdates() != 10 {
+		t.Errorf("got root [%x] w/%d keys and auto commit %v, expected [%x] w/2500 keys and the defaults", info.GetRoot(), info.GetKeyCount(), info.GetAutoCommit(), root)
+	}
+
+	// the imported tree survives a restart
+	closeTestServer(dst)
+	dst = openTestServer(t, filepath.Join(dir, "dst"))
+	defer closeTestServer(dst)
+	ti := dst.trieInfo["x"]
+	if ti == nil {
+		t.Fatal("imported tree is gone after a restart")
+	}
+	keys, err := newNodeReader(dst.aergoDB, ti.trie.TrieHeight).countLeaves(ti.committedRoot)
+	if !bytes.Equal(ti.committedRoot, root) || ti.KeyCount != 2500 || err != nil || keys != 2500 {
+		t.Errorf("got root [%x] w/%d keys, %d in the trie, err: %v, expected [%x] w/2500 keys", ti.committedRoot, ti.KeyCount, keys, err, root)
+	}
+	versions, err := dst.MetaListVersions("x", 0, 0)
+	if err != nil || len(versions) != 1 || !bytes.Equal(versions[0].Root, root) {
+		t.Errorf("got versions %v, err: %v, expected one at root [%x]", versions, err, root)
+	}
+}
+
+// snapshotStream records the chunks of an export and plays them back to an
+// import.
+type snapshotStream struct {
+	grpc.ServerStream
+	chunks []*universe.SnapshotChunk
+	info   *universe.TreeInfo
+}
+
+func (st *snapshotStream) Send(chunk *universe.SnapshotChunk) error {
+	st.chunks = append(st.chunks, chunk)
+	return nil
+}
+
+func (st *snapshotStream) Recv() (*universe.SnapshotChunk, error) {
+	if len(st.chunks) == 0 {
+		return nil, io.EOF
+	}
+	chunk := st.chunks[0]
+	st.chunks = st.chunks[1:]
+	return chunk, nil
+}
+
+func (st *snapshotStream) SendAndClose(info *universe.TreeInfo) error {
+	st.info = info
+	return nil
+}
+
+func (st *snapshotStream) Context() context.Context {
+	return context.Background()
+}
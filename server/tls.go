@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// tlsReloadInterval is the minimum time between checks of the certificate
+// files for changes.
+const tlsReloadInterval = 5 * time.Second
+
+// certReloader serves the server certificate and, for mutual TLS, the CAs of
+// client certificates from files, reloading them once they change so that
+// certificates can be renewed w/o a restart.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	// caFile is empty unless client certificates are required
+	caFile string
+
+	sync.Mutex
+	// checked is when the files were last checked for changes
+	checked  time.Time
+	modTimes []time.Time
+	config   *tls.Config
+}
+
+// newCertReloader loads the certificate, its key and, if caFile is set, the
+// CAs to verify client certificates with.
+func newCertReloader(certFile, keyFile, caFile string) (*certReloader, error) {
+	r := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		caFile:   caFile,
+	}
+	modTimes, err := r.statFiles()
+	if err != nil {
+		return nil, err
+	}
+	err = r.load(modTimes)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// files returns the files to watch.
+func (r *certReloader) files() []string {
+	files := []string{r.certFile, r.keyFile}
+	if r.caFile != "" {
+		files = append(files, r.caFile)
+	}
+	return files
+}
+
+// statFiles returns the modification times of the files to watch.
+func (r *certReloader) statFiles() ([]time.Time, error) {
+	var modTimes []time.Time
+	for _, file := range r.files() {
+		stat, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		modTimes = append(modTimes, stat.ModTime())
+	}
+	return modTimes, nil
+}
+
+// load reads the files and builds the TLS config used for new connections.
+func (r *certReloader) load(modTimes []time.Time) error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("could not load certificate [%v] w/key [%v]: %v", r.certFile, r.keyFile, err)
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   []string{"h2"},
+	}
+	if r.caFile != "" {
+		pem, err := ioutil.ReadFile(r.caFile)
+		if err != nil {
+			return err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no CA certificates found in [%v]", r.caFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	r.config = config
+	r.modTimes = modTimes
+	r.checked = time.Now()
+	return nil
+}
+
+// configForClient returns the TLS config for a new connection, reloading the
+// files first if they changed. If they can't be reloaded, e.g. while being
+// replaced, the previous config is kept.
+func (r *certReloader) configForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if time.Since(r.checked) < tlsReloadInterval {
+		return r.config, nil
+	}
+	r.checked = time.Now()
+	modTimes, err := r.statFiles()
+	if err != nil {
+		log.Printf("TLS: could not check certificate files: %v", err)
+		return r.config, nil
+	}
+	for i := range modTimes {
+		if modTimes[i].Equal(r.modTimes[i]) {
+			continue
+		}
+		err = r.load(modTimes)
+		if err != nil {
+			log.Printf("TLS: could not reload certificate files, keeping previous ones: %v", err)
+		} else {
+			log.Printf("TLS: reloaded certificate files %v", r.files())
+		}
+		break
+	}
+	return r.config, nil
+}
+
+// tlsConfig returns the server TLS config, which picks up reloaded files.
+func (r *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: r.configForClient,
+	}
+}
@@ -2,39 +2,102 @@ package main
 
 import (
 	"bytes"
-	"encoding/gob"
+	"sync"
+	"time"
 
 	"github.com/aergoio/aergo/pkg/trie"
 	"github.com/dashevo/universe-tree-db/universe"
+	"github.com/golang/protobuf/proto"
 )
 
 // TreeInfo has a trie pointer and meta info about the trie.
+//
+// The embedded lock guards the trie and the meta info. Read-only trie
+// operations may share the read lock, anything which changes the trie root or
+// the cached nodes needs the write lock. The name is only changed w/the
+// server lock and nodeLock as well.
 type TreeInfo struct {
 	trie *trie.Trie
 	universe.TreeInfo
+	sync.RWMutex
+	// committedRoot is the root of the last commit, i.e. the newest root
+	// whose nodes are all in the aergo DB. Only changed w/nodeLock.
+	committedRoot []byte
+	// committedKeyCount is the number of keys at committedRoot
+	committedKeyCount uint64
+	// pendingUpdates counts the updates since the last commit and
+	// pendingPairs their pairs, pendingSince is the time of the first of them
+	pendingUpdates uint64
+	pendingPairs   uint64
+	pendingSince   time.Time
+	// lastCommit is the time of the last commit
+	lastCommit time.Time
+	// wal is the write-ahead log of the uncommitted updates, nil until the
+	// first update if the log is enabled
+	wal *treeLog
+	// dropped is set once the tree is removed from the trie map
+	dropped bool
 }
 
 // Serialize returns the serialized bytes for a TreeInfo.
 //
 // Note that it's only serializing the underlying universe.TreeInfo and not the
 // trie pointer.
-func (ti TreeInfo) Serialize() []byte {
-	var buf bytes.Buffer
-	enc := gob.NewEncoder(&buf)
-	enc.Encode(ti.TreeInfo)
-	return buf.Bytes()
+func (ti *TreeInfo) Serialize() ([]byte, error) {
+	return proto.Marshal(&ti.TreeInfo)
 }
 
 // TreeInfoFromBytes creates a TreeInfo from serialized bytes.
-func TreeInfoFromBytes(data []byte) TreeInfo {
+func TreeInfoFromBytes(data []byte) (*TreeInfo, error) {
 	var info TreeInfo
-	dec := gob.NewDecoder(bytes.NewReader(data))
-	dec.Decode(&info.TreeInfo)
-	return info
+	err := proto.Unmarshal(data, &info.TreeInfo)
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
 }
 
 // Equal checks if two TreeInfos are equal
-func (ti TreeInfo) Equal(other TreeInfo) bool {
+func (ti *TreeInfo) Equal(other *TreeInfo) bool {
 	return (ti.TreeInfo.Name == other.TreeInfo.Name &&
 		bytes.Equal(ti.TreeInfo.Root, other.TreeInfo.Root))
 }
+
+// syncFromTrie copies the current trie metadata into the meta info.
+// Expected to be called w/write lock.
+func (ti *TreeInfo) syncFromTrie() {
+	ti.TreeInfo.Root = ti.trie.Root
+	ti.TreeInfo.TrieHeight = uint32(ti.trie.TrieHeight)
+	ti.TreeInfo.LoadDbCounter = uint32(ti.trie.LoadDbCounter)
+	ti.TreeInfo.LoadCacheCounter = uint32(ti.trie.LoadCacheCounter)
+	ti.TreeInfo.CacheHeightLimit = uint32(ti.trie.CacheHeightLimit)
+}
+
+// info returns a copy of the current trie metadata.
+// Expected to be called w/read lock.
+func (ti *TreeInfo) info() *universe.TreeInfo {
+	return &universe.TreeInfo{
+		Name:             ti.Name,
+		Root:             ti.trie.Root,
+		TrieHeight:       uint32(ti.trie.TrieHeight),
+		LoadDbCounter:    uint32(ti.trie.LoadDbCounter),
+		LoadCacheCounter: uint32(ti.trie.LoadCacheCounter),
+		CacheHeightLimit: uint32(ti.trie.CacheHeightLimit),
+		HashAlgorithm:    ti.HashAlgorithm,
+		KeyCount:         ti.KeyCount,
+		Version:          ti.Version,
+		AutoCommit:       ti.AutoCommit,
+		ForkedFrom:       ti.ForkedFrom,
+		ForkRoot:         ti.ForkRoot,
+		ForkGroup:        ti.ForkGroup,
+	}
+}
+
+// checkHashAlgorithm returns an error if a proof made with the given hash
+// algorithm cannot be verified against this tree.
+func (ti *TreeInfo) checkHashAlgorithm(alg universe.HashAlgorithm) error {
+	if alg != ti.HashAlgorithm {
+		return fieldError(ti.Name, "merkle_proof.hash_algorithm", "proof hash algorithm [%v] does not match tree [%v] hash algorithm [%v]", alg, ti.Name, ti.HashAlgorithm)
+	}
+	return nil
+}
@@ -10,15 +10,28 @@ import (
 func TestTreeInfo(t *testing.T) {
 	ti := makeTreeInfo()
 
-	b := ti.Serialize()
-	ti2 := main.TreeInfoFromBytes(b)
+	b, err := ti.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ti2, err := main.TreeInfoFromBytes(b)
+	if err != nil {
+		t.Fatal(err)
+	}
 	if !ti.Equal(ti2) {
 		t.Errorf("got %v, expected %v", ti, ti2)
 	}
 }
 
-func makeTreeInfo() main.TreeInfo {
-	return main.TreeInfo{
+func TestTreeInfoFromBytesInvalid(t *testing.T) {
+	_, err := main.TreeInfoFromBytes([]byte{0xff, 0xff, 0xff})
+	if err == nil {
+		t.Error("expected an error decoding invalid bytes")
+	}
+}
+
+func makeTreeInfo() *main.TreeInfo {
+	return &main.TreeInfo{
 		TreeInfo: universe.TreeInfo{
 			Root: []byte{
 				0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07,
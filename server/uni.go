@@ -3,68 +3,156 @@ package main
 import (
 	"log"
 	"sync"
+	"time"
 
 	"github.com/aergoio/aergo-lib/db"
 	"github.com/aergoio/aergo/pkg/trie"
 	"github.com/dgraph-io/badger"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health"
 )
 
 // grpc server -- hang DB handle off this
+//
+// The embedded lock only guards the trieInfo map itself. Each TreeInfo
+// carries its own lock which must be held while its trie is used. When both
+// are needed, the server lock is always taken first. The imports map, also
+// guarded by the server lock, holds the trees being imported until they join
+// the trie map.
 type universeTrieServer struct {
-	trieInfo map[string]TreeInfo
-	aergoDB  db.DB
-	metaDB   *badger.DB
-	sync.Mutex
+	trieInfo map[string]*TreeInfo
+	drops    map[string]*dropTask
+	imports  map[string]*TreeInfo
+	watch    *watchHub
+	health   *health.Server
+	// autoCommits queues the trees due for an auto commit after an update
+	autoCommits chan *TreeInfo
+	// multiUpdates counts the logs holding each multi-tree update, and
+	// lastMultiUpdate is the id of the last one, both guarded by multiLock
+	multiUpdates    map[uint64]int
+	lastMultiUpdate uint64
+	multiLock       sync.Mutex
+	// ready is set atomically to 1 once the trees are loaded, and back to 0
+	// on shutdown
+	ready int32
+	// treeDefaults, limits and wal are set from the config before init
+	treeDefaults treeConfig
+	limits       limitConfig
+	wal          walConfig
+	aergoDB      db.DB
+	metaDB       *badger.DB
+	sync.RWMutex
+	// nodeLock guards writes of trie nodes to the aergo DB: commits share it,
+	// reclaiming the nodes of a dropped tree needs it exclusively. It is
+	// always taken after the tree lock.
+	nodeLock sync.RWMutex
+	// closed is set w/nodeLock once the aergo DB is closed
+	closed   bool
+	quit     chan struct{}
 	shutdown bool
 }
 
 // newUniverseTrieServer constructs a new *universeTrieServer.
 func newUniverseTrieServer() *universeTrieServer {
-	return &universeTrieServer{
-		trieInfo: make(map[string]TreeInfo),
+	s := &universeTrieServer{
+		trieInfo: make(map[string]*TreeInfo),
+		drops:    make(map[string]*dropTask),
+		imports:  make(map[string]*TreeInfo),
+		quit:     make(chan struct{}),
+
+		autoCommits:  make(chan *TreeInfo, autoCommitQueue),
+		multiUpdates: make(map[uint64]int),
 	}
+	s.watch = newWatchHub(s.MetaSetWatchSequence)
+	s.health = newHealthServer()
+	return s
 }
 
-// syncMeta synchronizes the in-memory metadata to the on-disk meta DB.
+// getTree looks up a tree by name. Only the server read lock is held during
+// the lookup, the caller is responsible for locking the returned tree.
+func (s *universeTrieServer) getTree(treeName string) (*TreeInfo, bool) {
+	s.RLock()
+	defer s.RUnlock()
+
+	ti, ok := s.trieInfo[treeName]
+	return ti, ok
+}
+
+// trees returns a snapshot of the active/open trees from the trie map.
+func (s *universeTrieServer) trees() []*TreeInfo {
+	s.RLock()
+	defer s.RUnlock()
+
+	trees := make([]*TreeInfo, 0, len(s.trieInfo))
+	for _, ti := range s.trieInfo {
+		trees = append(trees, ti)
+	}
+	return trees
+}
+
+// nodeOwners returns a snapshot of all trees whose nodes are in use: the
+// active/open trees and the trees being imported.
 // Expected to be called w/lock.
-func (s *universeTrieServer) syncMeta() error {
-	// s.Lock()
-	// defer s.Unlock()
+func (s *universeTrieServer) nodeOwners() []*TreeInfo {
+	trees := make([]*TreeInfo, 0, len(s.trieInfo)+len(s.imports))
+	for _, ti := range s.trieInfo {
+		trees = append(trees, ti)
+	}
+	for _, ti := range s.imports {
+		trees = append(trees, ti)
+	}
+	return trees
+}
 
-	var err error
-	trees := make([]string, len(s.trieInfo))
-	i := 0
-	for treeName, ti := range s.trieInfo {
-		// sync metadata from trie before serializing to disk
-		ti.TreeInfo.Root = ti.trie.Root
-		ti.TreeInfo.TrieHeight = uint32(ti.trie.TrieHeight)
-		ti.TreeInfo.LoadDbCounter = uint32(ti.trie.LoadDbCounter)
-		ti.TreeInfo.LoadCacheCounter = uint32(ti.trie.LoadCacheCounter)
-		ti.TreeInfo.CacheHeightLimit = uint32(ti.trie.CacheHeightLimit)
-
-		err = s.MetaSetTreeInfo(treeName, ti)
-		if err != nil {
-			log.Printf("SyncMeta: error setting meta for tree [%v]", treeName)
-			return err
-		}
-		trees[i] = treeName
-		i++
+// syncTreeMeta synchronizes the in-memory metadata of a single tree to the
+// on-disk meta DB.
+// Expected to be called w/tree lock.
+func (s *universeTrieServer) syncTreeMeta(ti *TreeInfo) error {
+	if ti.dropped {
+		return nil
 	}
 
-	err = s.MetaSaveTrees(trees)
+	// sync metadata from trie before serializing to disk
+	ti.syncFromTrie()
+
+	err := s.MetaSetTreeInfo(ti.Name, ti)
 	if err != nil {
-		log.Printf("SyncMeta: error setting meta tree list")
+		log.Printf("SyncMeta: error setting meta for tree [%v]", ti.Name)
 		return err
 	}
+	return nil
+}
 
+// syncTreeList writes the names of all trees in the trie map to the on-disk
+// meta DB.
+// Expected to be called w/lock.
+func (s *universeTrieServer) syncTreeList() error {
+	err := s.MetaSaveTrees(s.listTrees())
+	if err != nil {
+		log.Printf("SyncMeta: error setting meta tree list")
+		return err
+	}
 	return nil
 }
 
-// listTrees returns the names of active/open tries from the trie map
-func (s *universeTrieServer) listTrees() []string {
-	s.Lock()
-	defer s.Unlock()
+// syncMeta synchronizes the in-memory metadata to the on-disk meta DB.
+// Expected to be called w/lock, but w/o any tree lock held.
+func (s *universeTrieServer) syncMeta() error {
+	for _, ti := range s.trieInfo {
+		ti.Lock()
+		err := s.syncTreeMeta(ti)
+		ti.Unlock()
+		if err != nil {
+			return err
+		}
+	}
 
+	return s.syncTreeList()
+}
+
+// listTrees returns the names of active/open tries from the trie map.
+// Expected to be called w/lock.
+func (s *universeTrieServer) listTrees() []string {
 	trees := make([]string, len(s.trieInfo))
 	i := 0
 	for name := range s.trieInfo {
@@ -83,6 +171,11 @@ func (s *universeTrieServer) loadTries() error {
 	}
 	log.Printf("loadTries: Got %d tries from meta DB", len(trees))
 
+	err = s.removeStaleLogs(trees)
+	if err != nil {
+		return err
+	}
+
 	s.Lock()
 	defer s.Unlock()
 
@@ -92,26 +185,163 @@ func (s *universeTrieServer) loadTries() error {
 		if err != nil {
 			return err
 		}
+		header, batches, offsets, size, err := s.readLog(treeName)
+		if err != nil {
+			return err
+		}
+		if header != nil {
+			// the meta DB may have the root of updates which weren't
+			// committed, start from the committed root of the log instead
+			ti.Root = header.GetRoot()
+			ti.KeyCount = header.GetKeyCount()
+		}
 
-		log.Printf("\tRoot=%x, TrieHeight=%d, LoadDbCounter=%d, LoadCacheCounter=%d, CacheHeightLimit=%d", ti.Root, ti.TrieHeight, ti.LoadDbCounter, ti.LoadCacheCounter, ti.CacheHeightLimit)
-		t := trie.NewTrie(ti.Root, Sha256, s.aergoDB)
+		log.Printf("\tRoot=%x, TrieHeight=%d, LoadDbCounter=%d, LoadCacheCounter=%d, CacheHeightLimit=%d, HashAlgorithm=%v", ti.Root, ti.TrieHeight, ti.LoadDbCounter, ti.LoadCacheCounter, ti.CacheHeightLimit, ti.HashAlgorithm)
+		hash, err := hashFunc(ti.HashAlgorithm)
+		if err != nil {
+			return err
+		}
+		t := trie.NewTrie(ti.Root, hash, s.aergoDB)
 		t.TrieHeight = int(ti.TrieHeight)
 		t.LoadDbCounter = int(ti.LoadDbCounter)
 		t.LoadCacheCounter = int(ti.LoadCacheCounter)
 		t.CacheHeightLimit = int(ti.CacheHeightLimit)
 
 		ti.trie = t
+		ti.committedRoot = ti.Root
+		if ti.KeyCount == 0 && len(ti.Root) != 0 {
+			// tree saved before keys were counted
+			keyCount, err := newNodeReader(s.aergoDB, t.TrieHeight).countLeaves(ti.Root)
+			if err != nil {
+				log.Printf("loadTries: could not count keys of tree %v: %v", treeName, err)
+			}
+			ti.KeyCount = keyCount
+		}
+		ti.committedKeyCount = ti.KeyCount
+		v, err := s.MetaGetVersion(treeName, ti.Version)
+		if err != nil {
+			return err
+		}
+		ti.lastCommit = time.Now()
+		if v != nil {
+			ti.lastCommit = time.Unix(v.Timestamp, 0)
+		}
+		if header != nil {
+			err = s.replayLog(ti, batches, offsets, size)
+			if err != nil {
+				return err
+			}
+			err = s.syncTreeMeta(ti)
+			if err != nil {
+				return err
+			}
+		}
 		s.trieInfo[treeName] = ti
+		s.checkTreeHealth(ti)
+	}
+	return s.pruneMultiUpdates()
+}
+
+// resumeDrops restarts reclaiming the nodes of trees which were dropped but
+// not fully reclaimed before the last shutdown.
+func (s *universeTrieServer) resumeDrops() error {
+	drops, err := s.MetaListDropProgress()
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	for _, dp := range drops {
+		log.Printf("resumeDrops: resuming reclaim of tree %v", dp.Name)
+		s.startDrop(dp)
 	}
 	return nil
 }
 
+// commitTree commits the updated nodes of a tree to the Aergo Trie DB.
+// Expected to be called w/tree lock.
+func (s *universeTrieServer) commitTree(ti *TreeInfo) error {
+	s.nodeLock.RLock()
+	defer s.nodeLock.RUnlock()
+
+	if ti.dropped {
+		return treeNotFound(ti.Name)
+	}
+	if s.closed {
+		return errStopped
+	}
+	err := ti.trie.Commit()
+	if err != nil {
+		return err
+	}
+	prevRoot := ti.committedRoot
+	ti.committedRoot = ti.trie.Root
+	ti.committedKeyCount = ti.KeyCount
+	ti.lastCommit = time.Now()
+	ti.clearPending()
+	err = s.appendVersion(ti, prevRoot)
+	if err != nil {
+		return err
+	}
+	return s.resetLog(ti)
+}
+
+// revertTree reverts a tree to one of its past roots, deleting the nodes of
+// the newer roots from the Aergo Trie DB along w/the versions of those roots.
+// Trees sharing nodes w/forks can't be reverted.
+// Expected to be called w/tree lock.
+func (s *universeTrieServer) revertTree(ti *TreeInfo, toOldRoot []byte) error {
+	err := ti.checkNotForked()
+	if err != nil {
+		return err
+	}
+	versions, err := s.MetaListVersions(ti.Name, 0, 0)
+	if err != nil {
+		return err
+	}
+
+	s.nodeLock.RLock()
+	defer s.nodeLock.RUnlock()
+
+	err = ti.trie.Revert(toOldRoot)
+	if err != nil {
+		return treeError(codes.FailedPrecondition, ti.Name, "tree [%v] can't be reverted to root [%x]: %v", ti.Name, toOldRoot, err)
+	}
+	ti.committedRoot = ti.trie.Root
+
+	keyCount, err := newNodeReader(s.aergoDB, ti.trie.TrieHeight).countLeaves(ti.committedRoot)
+	if err != nil {
+		return err
+	}
+	ti.KeyCount = keyCount
+	ti.committedKeyCount = keyCount
+	ti.clearPending()
+
+	// version numbers aren't reused, so the next commit skips the lost ones
+	var lost []uint64
+	for _, v := range versions {
+		if len(v.Root) != 0 && !ti.trie.TrieRootExists(v.Root) {
+			lost = append(lost, v.Version)
+		}
+	}
+	ti.syncFromTrie()
+	err = s.MetaRevertTree(ti, lost)
+	if err != nil {
+		return err
+	}
+	return s.resetLog(ti)
+}
+
 // commitAllTries iterates all active tree names and commits each to the Aergo
 // Trie DB. It is intended to be called upon shutdown. The lock should be held
 // before calling this.
 func (s *universeTrieServer) commitAllTries() {
 	for treeName, ti := range s.trieInfo {
-		err := ti.trie.Commit()
+		ti.Lock()
+		err := s.commitTree(ti)
+		ti.Unlock()
 		if err != nil {
 			log.Printf("could not commit trie %v: %v", treeName, err)
 		}
@@ -124,9 +354,21 @@ func (s *universeTrieServer) commitAllTries() {
 func (s *universeTrieServer) init() error {
 	// Load tries from s.metaDB
 	log.Print("Initializing trie server")
+	if err := s.migrateMeta(); err != nil {
+		return err
+	}
 	if err := s.loadTries(); err != nil {
 		return err
 	}
+	if err := s.resumeDrops(); err != nil {
+		return err
+	}
+	seq, err := s.MetaGetWatchSequence()
+	if err != nil {
+		return err
+	}
+	s.watch.restore(seq)
+	go s.autoCommitLoop()
 	return nil
 }
 
@@ -141,8 +383,15 @@ func (s *universeTrieServer) GracefulStop() {
 	}
 
 	log.Print("Shutting down gracefully")
+	s.setNotReady()
+	close(s.quit)
 	s.commitAllTries()
 	log.Print("AergoDB tries committed")
+	for _, ti := range s.trieInfo {
+		ti.Lock()
+		s.closeLog(ti)
+		ti.Unlock()
+	}
 
 	err := s.syncMeta()
 	if err != nil {
@@ -150,8 +399,16 @@ func (s *universeTrieServer) GracefulStop() {
 	} else {
 		log.Print("Meta synced")
 	}
+	err = s.watch.stop()
+	if err != nil {
+		log.Print("Could not save watch sequence: ", err)
+	}
 
+	// wait for any reclaim to stop before closing the DB under it
+	s.nodeLock.Lock()
 	s.aergoDB.Close()
+	s.closed = true
+	s.nodeLock.Unlock()
 	log.Print("AergoDB Closed")
 	s.shutdown = true
 }
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aergoio/aergo-lib/db"
+	"github.com/dashevo/universe-tree-db/universe"
+	"github.com/dgraph-io/badger"
+)
+
+// testDir creates a data dir, to be removed by the caller.
+func testDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "unidb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// openTestServer opens a server on the data in dir, w/the logs in dir/wal.
+func openTestServer(t *testing.T, dir string) *universeTrieServer {
+	t.Helper()
+	s := newUniverseTrieServer()
+	s.wal = walConfig{Dir: filepath.Join(dir, "wal"), Sync: true}
+	err := os.MkdirAll(s.wal.Dir, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.aergoDB = db.NewDB(db.BadgerImpl, filepath.Join(dir, "aergo"))
+	s.metaDB, err = badger.Open(badger.DefaultOptions(filepath.Join(dir, "meta")).WithLogger(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.init()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// closeTestServer shuts a server down and closes its DBs.
+func closeTestServer(s *universeTrieServer) {
+	s.GracefulStop()
+	s.metaDB.Close()
+}
+
+// testPairs returns n key/value pairs, the keys being the hashes of the
+// numbers from off on.
+func testPairs(n, off int) []*universe.KeyValuePair {
+	pairs := make([]*universe.KeyValuePair, n)
+	for i := range pairs {
+		pairs[i] = &universe.KeyValuePair{
+			Key:   Sha256([]byte(fmt.Sprint(off + i))),
+			Value: Sha256([]byte(fmt.Sprint("value ", off+i))),
+		}
+	}
+	return pairs
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+
+	"github.com/aergoio/aergo/pkg/trie"
+	"github.com/dashevo/universe-tree-db/universe"
+)
+
+// updatePairs checks the pairs of an update and returns their keys and
+// values. Every key must be keyLength bytes and the keys must be in strictly
+// increasing order, as the trie expects. Every value must be keyLength bytes
+// too, as the trie stores a leaf as a hash, or DefaultLeaf to delete the
+// key. There may be up to maxPairs pairs, unless maxPairs is 0. With
+// sortPairs set the pairs are sorted first and for duplicate keys the last
+// pair wins.
+func updatePairs(treeName string, pairs []*universe.KeyValuePair, keyLength int, maxPairs int, sortPairs bool) ([][]byte, [][]byte, error) {
+	if len(pairs) == 0 {
+		return nil, nil, fieldError(treeName, "key_value_pairs", "update has no pairs")
+	}
+	if maxPairs != 0 && len(pairs) > maxPairs {
+		return nil, nil, fieldError(treeName, "key_value_pairs", "update has [%d] pairs, the limit is [%d]", len(pairs), maxPairs)
+	}
+	for i, pair := range pairs {
+		key := pair.GetKey()
+		if len(key) == 0 {
+			return nil, nil, fieldError(treeName, pairField(i), "key of pair [%d] is empty", i)
+		}
+		if len(key) != keyLength {
+			return nil, nil, fieldError(treeName, pairField(i), "key [%x] of pair [%d] has length [%d], expected [%d]", key, i, len(key), keyLength)
+		}
+		value := pair.GetValue()
+		if len(value) != keyLength && !bytes.Equal(value, trie.DefaultLeaf) {
+			return nil, nil, fieldError(treeName, fmt.Sprintf("key_value_pairs[%d].value", i), "value [%x] of pair [%d] has length [%d], expected [%d] or DefaultLeaf to delete the key", value, i, len(value), keyLength)
+		}
+	}
+
+	if sortPairs {
+		sorted := make([]*universe.KeyValuePair, len(pairs))
+		copy(sorted, pairs)
+		sort.SliceStable(sorted, func(i, j int) bool {
+			return bytes.Compare(sorted[i].GetKey(), sorted[j].GetKey()) < 0
+		})
+		// keep the last of each run of equal keys
+		pairs = sorted[:0]
+		for i, pair := range sorted {
+			if i+1 < len(sorted) && bytes.Equal(pair.GetKey(), sorted[i+1].GetKey()) {
+				continue
+			}
+			pairs = append(pairs, pair)
+		}
+	}
+
+	keys := make([][]byte, len(pairs))
+	values := make([][]byte, len(pairs))
+	for i, pair := range pairs {
+		keys[i] = pair.GetKey()
+		values[i] = pair.GetValue()
+		if i == 0 {
+			continue
+		}
+		switch bytes.Compare(keys[i-1], keys[i]) {
+		case 0:
+			return nil, nil, fieldError(treeName, pairField(i), "key [%x] of pair [%d] is a duplicate of pair [%d]", keys[i], i, i-1)
+		case 1:
+			return nil, nil, fieldError(treeName, pairField(i), "key [%x] of pair [%d] is out of order, set sort_pairs to have the pairs sorted", keys[i], i)
+		}
+	}
+	return keys, values, nil
+}
+
+// pairField returns the request field of the key of pair i.
+func pairField(i int) string {
+	return fmt.Sprintf("key_value_pairs[%d].key", i)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/aergoio/aergo/pkg/trie"
+	"github.com/dashevo/universe-tree-db/universe"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestUpdatePairs(t *testing.T) {
+	k1, k2, k3 := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32), bytes.Repeat([]byte{3}, 32)
+	v1, v2 := Sha256([]byte("v1")), Sha256([]byte("v2"))
+	pair := func(k, v []byte) *universe.KeyValuePair {
+		return &universe.KeyValuePair{Key: k, Value: v}
+	}
+
+	tests := []struct {
+		name       string
+		pairs      []*universe.KeyValuePair
+		maxPairs   int
+		sortPairs  bool
+		wantField  string
+		wantKeys   [][]byte
+		wantValues [][]byte
+	}{
+		{"no pairs", nil, 0, false, "key_value_pairs", nil, nil},
+		{"too many pairs", []*universe.KeyValuePair{pair(k1, v1), pair(k2, v2)}, 1, false, "key_value_pairs", nil, nil},
+		{"empty key", []*universe.KeyValuePair{pair(k1, v1), pair(nil, v2)}, 0, false, "key_value_pairs[1].key", nil, nil},
+		{"bad key length", []*universe.KeyValuePair{pair(k1[:31], v1)}, 0, false, "key_value_pairs[0].key", nil, nil},
+		{"short value", []*universe.KeyValuePair{pair(k1, []byte("hi"))}, 0, false, "key_value_pairs[0].value", nil, nil},
+		{"empty value", []*universe.KeyValuePair{pair(k1, v1), pair(k2, nil)}, 0, false, "key_value_pairs[1].value", nil, nil},
+		{"duplicate", []*universe.KeyValuePair{pair(k1, v1), pair(k1, v2)}, 0, false, "key_value_pairs[1].key", nil, nil},
+		{"out of order", []*universe.KeyValuePair{pair(k2, v1), pair(k1, v2)}, 0, false, "key_value_pairs[1].key", nil, nil},
+		{"in order", []*universe.KeyValuePair{pair(k1, v1), pair(k2, trie.DefaultLeaf)}, 0, false, "", [][]byte{k1, k2}, [][]byte{v1, trie.DefaultLeaf}},
+		{"sorted, last wins", []*universe.KeyValuePair{pair(k3, v1), pair(k1, v1), pair(k3, v2), pair(k2, v2), pair(k1, v2)}, 0, true, "", [][]byte{k1, k2, k3}, [][]byte{v2, v2, v2}},
+	}
+
+	for _, tt := range tests {
+		keys, values, err := updatePairs("x", tt.pairs, 32, tt.maxPairs, tt.sortPairs)
+		if tt.wantField != "" {
+			if field := violatedField(err); field != tt.wantField {
+				t.Errorf("%s: got error %v on field %q, expected field %q", tt.name, err, field, tt.wantField)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !equalBytes(keys, tt.wantKeys) || !equalBytes(values, tt.wantValues) {
+			t.Errorf("%s: got keys %x values %x, expected keys %x values %x", tt.name, keys, values, tt.wantKeys, tt.wantValues)
+		}
+	}
+}
+
+// violatedField returns the field of the BadRequest detail of an
+// InvalidArgument error.
+func violatedField(err error) string {
+	st := status.Convert(err)
+	if st.Code() != codes.InvalidArgument {
+		return ""
+	}
+	for _, d := range st.Details() {
+		if br, ok := d.(*errdetails.BadRequest); ok && len(br.FieldViolations) != 0 {
+			return br.FieldViolations[0].Field
+		}
+	}
+	return ""
+}
+
+func equalBytes(a, b [][]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/aergoio/aergo/pkg/trie"
+	"github.com/dashevo/universe-tree-db/universe"
+	"google.golang.org/grpc/codes"
+)
+
+// appendVersion records the committed root of a tree as a new version in the
+// meta DB, unless the root has not changed since the last version.
+// Expected to be called w/tree lock.
+func (s *universeTrieServer) appendVersion(ti *TreeInfo, prevRoot []byte) error {
+	if ti.Version != 0 && bytes.Equal(prevRoot, ti.committedRoot) {
+		return nil
+	}
+
+	ti.Version++
+	ti.syncFromTrie()
+	v := &universe.TreeVersion{
+		Version:   ti.Version,
+		Root:      ti.committedRoot,
+		Timestamp: time.Now().Unix(),
+		KeyCount:  ti.committedKeyCount,
+	}
+	err := s.MetaAppendVersion(ti, v)
+	if err != nil {
+		ti.Version--
+		return err
+	}
+	return nil
+}
+
+// revertTreeToVersion resets a tree to the root of a past version, dropping
+// any uncommitted changes, and records that root as a new version. Unlike
+// Revert, no nodes are deleted so every other version stays available.
+// Expected to be called w/tree lock.
+func (s *universeTrieServer) revertTreeToVersion(ti *TreeInfo, v *universe.TreeVersion) error {
+	s.nodeLock.RLock()
+	defer s.nodeLock.RUnlock()
+
+	if len(v.Root) != 0 && !ti.trie.TrieRootExists(v.Root) {
+		return treeError(codes.FailedPrecondition, ti.Name, "tree [%v] version [%d] root [%x] is no longer in storage", ti.Name, v.Version, v.Root)
+	}
+	hash, err := hashFunc(ti.HashAlgorithm)
+	if err != nil {
+		return err
+	}
+
+	t := trie.NewTrie(v.Root, hash, s.aergoDB)
+	t.CacheHeightLimit = ti.trie.CacheHeightLimit
+	ti.trie = t
+
+	prevRoot := ti.committedRoot
+	ti.committedRoot = v.Root
+	ti.KeyCount = v.KeyCount
+	ti.committedKeyCount = v.KeyCount
+	ti.clearPending()
+	err = s.appendVersion(ti, prevRoot)
+	if err != nil {
+		return err
+	}
+	return s.resetLog(ti)
+}
+
+// resolveRoot returns the root to read from: the given root, else the root of
+// the given version, else the current root. Reads straight from the aergo DB
+// only see committed nodes, so the current root must have been committed.
+// Expected to be called w/tree read lock.
+func (s *universeTrieServer) resolveRoot(ti *TreeInfo, root []byte, version uint64) ([]byte, error) {
+	if len(root) != 0 {
+		err := s.checkTreeRoot(ti, root)
+		if err != nil {
+			return nil, err
+		}
+		return root, nil
+	}
+	if version != 0 {
+		v, err := s.getVersion(ti.Name, version)
+		if err != nil {
+			return nil, err
+		}
+		return v.Root, nil
+	}
+	if !bytes.Equal(ti.trie.Root, ti.committedRoot) {
+		return nil, treeError(codes.FailedPrecondition, ti.Name, "tree [%v] has uncommitted changes, commit it or give a root or version", ti.Name)
+	}
+	return ti.committedRoot, nil
+}
+
+// checkTreeRoot fails unless root is the committed root of the tree or the
+// root of one of its versions, so that the roots of other trees can't be read
+// w/the rights on this one.
+// Expected to be called w/tree read lock.
+func (s *universeTrieServer) checkTreeRoot(ti *TreeInfo, root []byte) error {
+	if bytes.Equal(root, ti.committedRoot) {
+		return nil
+	}
+	versions, err := s.MetaListVersions(ti.Name, 0, 0)
+	if err != nil {
+		return err
+	}
+	for _, v := range versions {
+		if bytes.Equal(root, v.Root) {
+			return nil
+		}
+	}
+	return treeError(codes.NotFound, ti.Name, "tree [%v] has no root [%x]", ti.Name, root)
+}
+
+// getVersion retrieves a version record of a tree, failing if it doesn't
+// exist.
+func (s *universeTrieServer) getVersion(treeName string, version uint64) (*universe.TreeVersion, error) {
+	v, err := s.MetaGetVersion(treeName, version)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, treeError(codes.NotFound, treeName, "tree [%v] version [%d] not found", treeName, version)
+	}
+	return v, nil
+}
+
+// versionAt retrieves the version of a tree which was current at time t.
+func (s *universeTrieServer) versionAt(treeName string, t int64) (*universe.TreeVersion, error) {
+	versions, err := s.MetaListVersions(treeName, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	var found *universe.TreeVersion
+	for _, v := range versions {
+		if v.Timestamp > t {
+			break
+		}
+		found = v
+	}
+	if found == nil {
+		return nil, treeError(codes.NotFound, treeName, "tree [%v] has no version at time [%d]", treeName, t)
+	}
+	return found, nil
+}
+
+// treeRoots returns the committed root and the roots of all versions of a
+// tree, i.e. all roots whose nodes may still be needed.
+func (s *universeTrieServer) treeRoots(ti *TreeInfo) ([][]byte, error) {
+	versions, err := s.MetaListVersions(ti.Name, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	var roots [][]byte
+	add := func(root []byte) {
+		if len(root) != 0 && !seen[string(root)] {
+			seen[string(root)] = true
+			roots = append(roots, root)
+		}
+	}
+	add(ti.committedRoot)
+	for _, v := range versions {
+		add(v.Root)
+	}
+	return roots, nil
+}
+
+// keyCountDelta returns by how much the number of keys in the trie changes
+// when the keys are set to the values.
+func keyCountDelta(t *trie.Trie, keys, values [][]byte) (int64, error) {
+	_, delta, err := oldValues(t, keys, values)
+	return delta, err
+}
+
+// oldValues returns the current values of the keys, DefaultLeaf for keys
+// which aren't in the trie, and by how much the number of keys changes when
+// the keys are set to the values. Setting the keys to the old values again
+// undoes the update.
+func oldValues(t *trie.Trie, keys, values [][]byte) ([][]byte, int64, error) {
+	old := make([][]byte, len(keys))
+	var delta int64
+	for i, key := range keys {
+		val, err := t.Get(key)
+		if err != nil {
+			return nil, 0, err
+		}
+		deleting := bytes.Equal(values[i], trie.DefaultLeaf)
+		switch {
+		case len(val) == 0 && !deleting:
+			delta++
+		case len(val) != 0 && deleting:
+			delta--
+		}
+		old[i] = val
+		if len(val) == 0 {
+			old[i] = trie.DefaultLeaf
+		}
+	}
+	return old, delta, nil
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/dashevo/universe-tree-db/universe"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestForeignRootRejected(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	s := openTestServer(t, dir)
+	defer closeTestServer(s)
+	ctx := context.Background()
+
+	for i, treeName := range []string{"public", "secret"} {
+		_, err := s.CreateTree(ctx, &universe.CreateTreeRequest{Name: treeName})
+		if err != nil {
+			t.Fatal(err)
+		}
+		update(t, s, treeName, testPairs(10, i*100))
+		_, err = s.Commit(ctx, &universe.CommitRequest{TreeName: treeName})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	own := s.trieInfo["public"].committedRoot
+	secret := s.trieInfo["secret"].committedRoot
+	key := testPairs(1, 100)[0].Key
+
+	calls := []struct {
+		name string
+		call func(root []byte) error
+	}{
+		{"MerkleProofR", func(root []byte) error {
+			_, err := s.MerkleProofR(ctx, &universe.MerkleProofRRequest{TreeName: "public", Key: key, Root: root})
+			return err
+		}},
+		{"MerkleProofCompressedR", func(root []byte) error {
+			_, err := s.MerkleProofCompressedR(ctx, &universe.MerkleProofRRequest{TreeName: "public", Key: key, Root: root})
+			return err
+		}},
+		{"BatchGet", func(root []byte) error {
+			_, err := s.BatchGet(ctx, &universe.BatchGetRequest{TreeName: "public", Keys: [][]byte{key}, Root: root})
+			return err
+		}},
+		{"BatchMerkleProof", func(root []byte) error {
+			_, err := s.BatchMerkleProof(ctx, &universe.BatchMerkleProofRequest{TreeName: "public", Keys: [][]byte{key}, Root: root})
+			return err
+		}},
+		{"Iterate", func(root []byte) error {
+			return s.Iterate(&universe.IterateRequest{TreeName: "public", Root: root}, &iterateStream{})
+		}},
+		{"Iterate resume token", func(root []byte) error {
+			return s.Iterate(&universe.IterateRequest{TreeName: "public", ResumeToken: encodeResumeToken(root, key)}, &iterateStream{})
+		}},
+	}
+	for _, c := range calls {
+		if err := c.call(own); err != nil {
+			t.Errorf("%s: root of the tree: %v", c.name, err)
+		}
+		if code := status.Code(c.call(secret)); code != codes.NotFound {
+			t.Errorf("%s: root of another tree: got code %v, expected %v", c.name, code, codes.NotFound)
+		}
+	}
+}
@@ -0,0 +1,530 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aergoio/aergo/pkg/trie"
+	"github.com/dashevo/universe-tree-db/universe"
+	"github.com/golang/protobuf/proto"
+)
+
+// Updates only change the trie in memory until the tree is committed. So
+// that acknowledged updates survive a crash, each update batch is appended to
+// the write-ahead log of its tree and synced before the call returns. The log
+// starts w/a header holding the committed root the batches apply to, and is
+// replaced by a new header whenever the committed root changes. On startup,
+// a tree w/a log is loaded at the header root and the batches are replayed.
+//
+// The log of a tree is a file in the WAL dir named by the hex of the tree
+// name. Each record is preceded by its length and its CRC-32C, both as big
+// endian uint32. A torn record at the end, left by a crash while appending,
+// is cut off when the log is replayed.
+//
+// The batches of a multi-tree update carry its id, and a marker w/the id is
+// saved to the meta DB along w/the new roots of the trees. A batch whose
+// marker is missing, as the server crashed before all trees were updated, is
+// not replayed. The marker is removed once no log holds the update anymore.
+
+// walFormatVersion is the version of the write-ahead log records.
+const walFormatVersion = 1
+
+// walSuffix is the file name suffix of write-ahead logs.
+const walSuffix = ".wal"
+
+// walFrameSize is the size of the length and CRC preceding each record.
+const walFrameSize = 8
+
+var walCRCTable = crc32.MakeTable(crc32.Castagnoli)
+
+// treeLog is the open write-ahead log of a tree. It is guarded by the tree
+// lock.
+type treeLog struct {
+	f *os.File
+	// size is the size of the records written so far
+	size int64
+	// multiUpdates are the ids of the multi-tree updates in the log
+	multiUpdates []uint64
+}
+
+// append writes a record at the end of the log, syncing it to disk if sync
+// is set.
+func (l *treeLog) append(rec *universe.WALRecord, sync bool) error {
+	data, err := proto.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, walFrameSize+len(data))
+	binary.BigEndian.PutUint32(buf, uint32(len(data)))
+	binary.BigEndian.PutUint32(buf[4:], crc32.Checksum(data, walCRCTable))
+	copy(buf[walFrameSize:], data)
+
+	_, err = l.f.WriteAt(buf, l.size)
+	if err != nil {
+		return err
+	}
+	if sync {
+		err = l.f.Sync()
+		if err != nil {
+			return err
+		}
+	}
+	l.size += int64(len(buf))
+	return nil
+}
+
+// truncate cuts off the records from offset on.
+func (l *treeLog) truncate(offset int64) error {
+	err := l.f.Truncate(offset)
+	if err != nil {
+		return err
+	}
+	l.size = offset
+	return l.f.Sync()
+}
+
+// walPath returns the path of the write-ahead log of a tree.
+func (s *universeTrieServer) walPath(treeName string) string {
+	return filepath.Join(s.wal.Dir, hex.EncodeToString([]byte(treeName))+walSuffix)
+}
+
+// logUpdate appends an update batch to the write-ahead log of a tree before
+// it is applied. It returns the size of the log before the batch, to cut the
+// batch off again w/unlogUpdate if it can't be applied. multiUpdateID is the
+// id of the multi-tree update the batch is part of, 0 if none.
+// Expected to be called w/tree lock.
+func (s *universeTrieServer) logUpdate(ti *TreeInfo, keys, values [][]byte, atomic bool, multiUpdateID uint64) (int64, error) {
+	if s.wal.Dir == "" {
+		return 0, nil
+	}
+	if ti.dropped {
+		return 0, treeNotFound(ti.Name)
+	}
+	if ti.wal == nil {
+		err := s.resetLog(ti)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	offset := ti.wal.size
+	err := ti.wal.append(&universe.WALRecord{
+		Keys:   keys,
+		Values: values,
+		Atomic: atomic,
+
+		MultiUpdateId: multiUpdateID,
+	}, s.wal.Sync)
+	if err != nil {
+		log.Printf("WAL: could not log update of tree [%v]: %v", ti.Name, err)
+		return 0, err
+	}
+	return offset, nil
+}
+
+// unlogUpdate cuts off the batch logged at offset, which could not be
+// applied.
+// Expected to be called w/tree lock.
+func (s *universeTrieServer) unlogUpdate(ti *TreeInfo, offset int64) {
+	if ti.wal == nil {
+		return
+	}
+	err := ti.wal.truncate(offset)
+	if err != nil {
+		log.Printf("WAL: could not truncate log of tree [%v]: %v", ti.Name, err)
+	}
+}
+
+// resetLog replaces the write-ahead log of a tree by an empty one starting at
+// its committed root, once the logged batches are committed or discarded.
+// Expected to be called w/tree lock.
+func (s *universeTrieServer) resetLog(ti *TreeInfo) error {
+	if s.wal.Dir == "" {
+		return nil
+	}
+	old := ti.wal
+	s.closeLog(ti)
+
+	path := s.walPath(ti.Name)
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	l := &treeLog{f: f}
+	err = l.append(&universe.WALRecord{
+		Header: &universe.WALHeader{
+			FormatVersion: walFormatVersion,
+			Name:          ti.Name,
+			Root:          ti.committedRoot,
+			KeyCount:      ti.committedKeyCount,
+		},
+	}, s.wal.Sync)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err == nil && s.wal.Sync {
+		err = syncDir(s.wal.Dir)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		log.Printf("WAL: could not reset log of tree [%v]: %v", ti.Name, err)
+		return err
+	}
+	ti.wal = l
+	s.releaseMultiUpdates(old)
+	return nil
+}
+
+// copyLog writes the records of the write-ahead log of a tree to the log of
+// newName, for the tree to be renamed. It returns the new log, which
+// replaces the old one w/switchLog once the rename is saved, or nil if the
+// tree has no open log.
+// Expected to be called w/tree lock.
+func (s *universeTrieServer) copyLog(ti *TreeInfo, newName string) (*treeLog, error) {
+	if s.wal.Dir == "" {
+		return nil, nil
+	}
+	path := s.walPath(newName)
+	if ti.wal == nil {
+		// no log to copy, but a log left under the new name must not be
+		// replayed for the tree
+		err := os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		return nil, nil
+	}
+	header, batches, _, _, err := s.readLog(ti.Name)
+	if err != nil {
+		return nil, err
+	}
+	if header == nil {
+		return nil, fmt.Errorf("log of tree [%v] has no header", ti.Name)
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	l := &treeLog{f: f, multiUpdates: ti.wal.multiUpdates}
+	header.Name = newName
+	err = l.append(&universe.WALRecord{Header: header}, false)
+	for _, rec := range batches {
+		if err != nil {
+			break
+		}
+		err = l.append(rec, false)
+	}
+	if err == nil && s.wal.Sync {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err == nil && s.wal.Sync {
+		err = syncDir(s.wal.Dir)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		log.Printf("WAL: could not copy log of tree [%v] to [%v]: %v", ti.Name, newName, err)
+		return nil, err
+	}
+	return l, nil
+}
+
+// switchLog replaces the write-ahead log of a renamed tree by the copy made
+// w/copyLog, deleting the log of the old name.
+// Expected to be called w/tree lock.
+func (s *universeTrieServer) switchLog(ti *TreeInfo, oldName string, l *treeLog) {
+	if s.wal.Dir == "" {
+		return
+	}
+	if ti.wal != nil {
+		ti.wal.f.Close()
+	}
+	ti.wal = l
+	err := os.Remove(s.walPath(oldName))
+	if err != nil && !os.IsNotExist(err) {
+		// removed as a stale log on the next startup
+		log.Printf("WAL: could not remove log of renamed tree [%v]: %v", oldName, err)
+	}
+}
+
+// discardLogCopy deletes the copy of a log made w/copyLog for a rename which
+// failed.
+func (s *universeTrieServer) discardLogCopy(newName string, l *treeLog) {
+	if l == nil {
+		return
+	}
+	l.f.Close()
+	err := os.Remove(s.walPath(newName))
+	if err != nil {
+		log.Printf("WAL: could not remove log copy [%v]: %v", newName, err)
+	}
+}
+
+// removeLog deletes the write-ahead log of a dropped tree.
+// Expected to be called w/tree lock.
+func (s *universeTrieServer) removeLog(ti *TreeInfo) {
+	if s.wal.Dir == "" {
+		return
+	}
+	old := ti.wal
+	s.closeLog(ti)
+	err := os.Remove(s.walPath(ti.Name))
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("WAL: could not remove log of tree [%v]: %v", ti.Name, err)
+		return
+	}
+	s.releaseMultiUpdates(old)
+}
+
+// closeLog closes the write-ahead log of a tree, if open.
+// Expected to be called w/tree lock.
+func (s *universeTrieServer) closeLog(ti *TreeInfo) {
+	if ti.wal == nil {
+		return
+	}
+	ti.wal.f.Close()
+	ti.wal = nil
+}
+
+// readLog reads the write-ahead log of a tree. It returns the header, the
+// update batches w/the offset each starts at, and the size of the valid
+// records. The header is nil if the tree has no log.
+func (s *universeTrieServer) readLog(treeName string) (*universe.WALHeader, []*universe.WALRecord, []int64, int64, error) {
+	if s.wal.Dir == "" {
+		return nil, nil, nil, 0, nil
+	}
+	data, err := ioutil.ReadFile(s.walPath(treeName))
+	if os.IsNotExist(err) {
+		return nil, nil, nil, 0, nil
+	}
+	if err != nil {
+		return nil, nil, nil, 0, err
+	}
+
+	var header *universe.WALHeader
+	var batches []*universe.WALRecord
+	var offsets []int64
+	var size int64
+	for int64(len(data)) >= size+walFrameSize {
+		n := int64(binary.BigEndian.Uint32(data[size:]))
+		sum := binary.BigEndian.Uint32(data[size+4:])
+		if int64(len(data)) < size+walFrameSize+n {
+			break
+		}
+		payload := data[size+walFrameSize : size+walFrameSize+n]
+		if crc32.Checksum(payload, walCRCTable) != sum {
+			break
+		}
+		rec := &universe.WALRecord{}
+		if proto.Unmarshal(payload, rec) != nil {
+			break
+		}
+		if header == nil {
+			header = rec.GetHeader()
+			if header == nil {
+				return nil, nil, nil, 0, fmt.Errorf("log of tree [%v] does not start w/a header", treeName)
+			}
+			if header.GetFormatVersion() != walFormatVersion {
+				return nil, nil, nil, 0, fmt.Errorf("log of tree [%v] has unsupported format version [%d]", treeName, header.GetFormatVersion())
+			}
+			if header.GetName() != treeName {
+				return nil, nil, nil, 0, fmt.Errorf("log of tree [%v] belongs to tree [%v]", treeName, header.GetName())
+			}
+		} else {
+			batches = append(batches, rec)
+			offsets = append(offsets, size)
+		}
+		size += walFrameSize + n
+	}
+	if header == nil {
+		// torn while written unsynced, the meta DB has the root instead
+		log.Printf("WAL: ignoring log of tree [%v] w/o a valid header", treeName)
+		return nil, nil, nil, 0, nil
+	}
+	if size != int64(len(data)) {
+		log.Printf("WAL: cutting off [%d] bytes of torn records from the log of tree [%v]", int64(len(data))-size, treeName)
+	}
+	return header, batches, offsets, size, nil
+}
+
+// replayLog applies the logged update batches to a tree loaded at the root of
+// its log header, and opens the log to append to. A batch which can't be
+// applied, or whose multi-tree update wasn't completed, is cut off along w/the
+// batches after it.
+// Expected to be called w/tree lock.
+func (s *universeTrieServer) replayLog(ti *TreeInfo, batches []*universe.WALRecord, offsets []int64, size int64) error {
+	replayed := 0
+	var multiUpdates []uint64
+	for i, rec := range batches {
+		err := s.checkMultiUpdate(rec.GetMultiUpdateId())
+		var delta int64
+		if err == nil {
+			delta, err = keyCountDelta(ti.trie, rec.GetKeys(), rec.GetValues())
+		}
+		if err == nil {
+			if rec.GetAtomic() {
+				_, err = ti.trie.AtomicUpdate(rec.GetKeys(), rec.GetValues())
+			} else {
+				_, err = ti.trie.Update(rec.GetKeys(), rec.GetValues())
+			}
+		}
+		if err != nil {
+			log.Printf("WAL: could not replay update [%d] of tree [%v], dropping it and the [%d] after it: %v", i, ti.Name, len(batches)-i-1, err)
+			size = offsets[i]
+			break
+		}
+		ti.KeyCount = uint64(int64(ti.KeyCount) + delta)
+		ti.pendingUpdates++
+		ti.pendingPairs += uint64(len(rec.GetKeys()))
+		replayed++
+		if rec.GetMultiUpdateId() != 0 {
+			multiUpdates = append(multiUpdates, rec.GetMultiUpdateId())
+		}
+	}
+
+	f, err := os.OpenFile(s.walPath(ti.Name), os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	ti.wal = &treeLog{f: f, size: size}
+	s.holdMultiUpdates(ti.wal, multiUpdates)
+	err = ti.wal.truncate(size)
+	if err != nil {
+		return err
+	}
+	if replayed == 0 {
+		return nil
+	}
+	log.Printf("WAL: replayed [%d] updates of tree [%v], root [%x]", replayed, ti.Name, ti.trie.Root)
+	ti.pendingSince = time.Now()
+
+	if ti.trie.TrieRootExists(ti.trie.Root) {
+		// the batches were committed, but the log wasn't reset before the
+		// crash, which may also have come before the version was saved
+		err := ti.trie.Commit()
+		if err != nil {
+			return err
+		}
+		prevRoot := ti.committedRoot
+		ti.committedRoot = ti.trie.Root
+		ti.committedKeyCount = ti.KeyCount
+		ti.clearPending()
+		v, err := s.MetaGetVersion(ti.Name, ti.Version)
+		if err != nil {
+			return err
+		}
+		if v == nil || !bytes.Equal(v.Root, ti.committedRoot) {
+			err = s.appendVersion(ti, prevRoot)
+			if err != nil {
+				return err
+			}
+		}
+		return s.resetLog(ti)
+	}
+	return nil
+}
+
+// rebuildTree resets a tree whose trie can't be trusted anymore to the root
+// of its log header and applies the logged batches again. W/o a log, the
+// tree is reset to its committed root and its uncommitted updates are lost.
+// Expected to be called w/tree lock.
+func (s *universeTrieServer) rebuildTree(ti *TreeInfo) error {
+	header, batches, _, _, err := s.readLog(ti.Name)
+	if err != nil {
+		return err
+	}
+	root, keyCount := ti.committedRoot, ti.committedKeyCount
+	if header != nil {
+		root, keyCount = header.GetRoot(), header.GetKeyCount()
+	} else if ti.pendingUpdates != 0 {
+		log.Printf("WAL: tree [%v] has no log, dropping [%d] uncommitted updates", ti.Name, ti.pendingUpdates)
+	}
+	hash, err := hashFunc(ti.HashAlgorithm)
+	if err != nil {
+		return err
+	}
+
+	t := trie.NewTrie(root, hash, s.aergoDB)
+	t.CacheHeightLimit = ti.trie.CacheHeightLimit
+	var pairs uint64
+	for i, rec := range batches {
+		delta, err := keyCountDelta(t, rec.GetKeys(), rec.GetValues())
+		if err == nil {
+			if rec.GetAtomic() {
+				_, err = t.AtomicUpdate(rec.GetKeys(), rec.GetValues())
+			} else {
+				_, err = t.Update(rec.GetKeys(), rec.GetValues())
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("could not apply logged update [%d] of tree [%v] again: %v", i, ti.Name, err)
+		}
+		keyCount = uint64(int64(keyCount) + delta)
+		pairs += uint64(len(rec.GetKeys()))
+	}
+	ti.trie = t
+	ti.KeyCount = keyCount
+	ti.pendingUpdates = uint64(len(batches))
+	ti.pendingPairs = pairs
+	if len(batches) == 0 {
+		ti.clearPending()
+	}
+	ti.syncFromTrie()
+	return nil
+}
+
+// removeStaleLogs deletes the write-ahead logs, and unfinished new logs, of
+// trees which aren't in trees, e.g. because they were dropped before the log
+// was removed.
+func (s *universeTrieServer) removeStaleLogs(trees []string) error {
+	if s.wal.Dir == "" {
+		return nil
+	}
+	files, err := ioutil.ReadDir(s.wal.Dir)
+	if err != nil {
+		return err
+	}
+
+	known := make(map[string]bool, len(trees))
+	for _, treeName := range trees {
+		known[hex.EncodeToString([]byte(treeName))+walSuffix] = true
+	}
+	for _, fi := range files {
+		name := fi.Name()
+		if known[name] || !(strings.HasSuffix(name, walSuffix) || strings.HasSuffix(name, walSuffix+".tmp")) {
+			continue
+		}
+		log.Printf("WAL: removing stale log [%v]", name)
+		err := os.Remove(filepath.Join(s.wal.Dir, name))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncDir syncs a dir, so that files created or renamed in it are durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
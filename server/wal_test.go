@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/dashevo/universe-tree-db/universe"
+)
+
+func TestReplayLog(t *testing.T) {
+	tests := []struct {
+		name string
+		// damage changes the log left by the crash
+		damage func(t *testing.T, path string)
+		// replayed is the number of updates replayed
+		replayed int
+	}{
+		{"intact", nil, 3},
+		{"torn record", func(t *testing.T, path string) {
+			// the frame of a record whose payload didn't make it to disk
+			f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+			if err == nil {
+				_, err = f.Write([]byte{0, 0, 0, 100, 1, 2, 3, 4, 5, 6})
+				f.Close()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}, 3},
+		{"crc mismatch", func(t *testing.T, path string) {
+			// the last record is damaged
+			data, err := ioutil.ReadFile(path)
+			if err == nil {
+				data[len(data)-1] ^= 0xff
+				err = ioutil.WriteFile(path, data, 0644)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}, 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := testDir(t)
+			defer os.RemoveAll(dir)
+			ctx := context.Background()
+
+			s := openTestServer(t, dir)
+			_, err := s.CreateTree(ctx, &universe.CreateTreeRequest{Name: "x"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			update(t, s, "x", testPairs(10, 0))
+			_, err = s.Commit(ctx, &universe.CommitRequest{TreeName: "x"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			headerRoot := s.trieInfo["x"].committedRoot
+			var roots [][]byte
+			for i := 1; i <= 3; i++ {
+				roots = append(roots, update(t, s, "x", testPairs(10, i*100)))
+			}
+			path := s.walPath("x")
+			crashTestServer(s)
+			if tt.damage != nil {
+				tt.damage(t, path)
+			}
+
+			s = openTestServer(t, dir)
+			defer closeTestServer(s)
+			ti := s.trieInfo["x"]
+			if !bytes.Equal(ti.committedRoot, headerRoot) {
+				t.Errorf("got committed root [%x], expected the header root [%x]", ti.committedRoot, headerRoot)
+			}
+			if !bytes.Equal(ti.trie.Root, roots[tt.replayed-1]) {
+				t.Errorf("got root [%x], expected the root after update %d [%x]", ti.trie.Root, tt.replayed, roots[tt.replayed-1])
+			}
+			if want := uint64(10 + 10*tt.replayed); ti.KeyCount != want {
+				t.Errorf("got %d keys, expected %d", ti.KeyCount, want)
+			}
+			// the damage is cut off, so new updates are logged after the
+			// replayed ones
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size() != ti.wal.size {
+				t.Errorf("got log of size %d, expected %d", info.Size(), ti.wal.size)
+			}
+		})
+	}
+}
+
+func TestReplayCommittedLog(t *testing.T) {
+	tests := []struct {
+		name string
+		// saveVersion is whether the crash comes after the version of the
+		// commit was saved
+		saveVersion bool
+	}{
+		{"nodes written", false},
+		{"version saved", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := testDir(t)
+			defer os.RemoveAll(dir)
+			ctx := context.Background()
+
+			s := openTestServer(t, dir)
+			_, err := s.CreateTree(ctx, &universe.CreateTreeRequest{Name: "x"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			update(t, s, "x", testPairs(10, 0))
+			_, err = s.Commit(ctx, &universe.CommitRequest{TreeName: "x"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			root := update(t, s, "x", testPairs(10, 100))
+			// the crash comes before the log is reset
+			ti := s.trieInfo["x"]
+			ti.Lock()
+			err = ti.trie.Commit()
+			if err == nil && tt.saveVersion {
+				prevRoot := ti.committedRoot
+				ti.committedRoot = ti.trie.Root
+				ti.committedKeyCount = ti.KeyCount
+				err = s.appendVersion(ti, prevRoot)
+			}
+			ti.Unlock()
+			if err != nil {
+				t.Fatal(err)
+			}
+			crashTestServer(s)
+
+			s = openTestServer(t, dir)
+			defer closeTestServer(s)
+			ti = s.trieInfo["x"]
+			if !bytes.Equal(ti.trie.Root, root) || !bytes.Equal(ti.committedRoot, root) {
+				t.Errorf("got root [%x] and committed root [%x], expected [%x]", ti.trie.Root, ti.committedRoot, root)
+			}
+			if ti.KeyCount != 20 || ti.committedKeyCount != 20 || ti.pendingUpdates != 0 {
+				t.Errorf("got %d keys, %d committed, %d pending updates, expected 20 committed", ti.KeyCount, ti.committedKeyCount, ti.pendingUpdates)
+			}
+			header, batches, _, _, err := s.readLog("x")
+			if err != nil || !bytes.Equal(header.GetRoot(), root) || len(batches) != 0 {
+				t.Errorf("got log header root [%x] w/%d updates, err: %v, expected a reset log", header.GetRoot(), len(batches), err)
+			}
+			// the commit is recorded as a version once
+			versions, err := s.MetaListVersions("x", 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(versions) != 2 || ti.Version != 2 || !bytes.Equal(versions[1].Root, root) || versions[1].KeyCount != 20 {
+				t.Errorf("got version %d and versions %v, expected version 2 at root [%x]", ti.Version, versions, root)
+			}
+		})
+	}
+}
+
+// update updates a tree and returns the new root.
+func update(t *testing.T, s *universeTrieServer, treeName string, pairs []*universe.KeyValuePair) []byte {
+	t.Helper()
+	resp, err := s.Update(context.Background(), &universe.UpdateRequest{TreeName: treeName, KeyValuePairs: pairs, SortPairs: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp.GetRoot()
+}
+
+// crashTestServer closes the DBs and logs of a server w/o committing its
+// trees, leaving the data as a crash would.
+func crashTestServer(s *universeTrieServer) {
+	s.Lock()
+	defer s.Unlock()
+
+	close(s.quit)
+	for _, ti := range s.trieInfo {
+		ti.Lock()
+		s.closeLog(ti)
+		ti.Unlock()
+	}
+	s.nodeLock.Lock()
+	s.aergoDB.Close()
+	s.closed = true
+	s.nodeLock.Unlock()
+	s.metaDB.Close()
+}
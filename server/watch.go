@@ -0,0 +1,165 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/dashevo/universe-tree-db/universe"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// watchBacklog is the number of recent events kept for watchers resuming
+// from a past sequence.
+const watchBacklog = 4096
+
+// watchBuffer is the number of events queued for a watcher before it is
+// considered too slow and cut off.
+const watchBuffer = 256
+
+// watchReserve is the number of sequences reserved in the meta DB at once, so
+// that sequences keep increasing across a crash w/o a write per event.
+const watchReserve = 1000
+
+// watchHub numbers the events of all trees and hands them out to watchers.
+type watchHub struct {
+	sync.Mutex
+	// next is the sequence of the next event
+	next uint64
+	// reserved is the first sequence not reserved in the meta DB yet
+	reserved uint64
+	save     func(seq uint64) error
+	// backlog holds the recent events, oldest first
+	backlog  []*universe.TreeEvent
+	watchers map[*watcher]bool
+}
+
+// watcher receives the events of one tree or, w/o a tree name, of all trees.
+type watcher struct {
+	treeName string
+	// events is closed when the watcher falls behind
+	events chan *universe.TreeEvent
+}
+
+// newWatchHub creates a watchHub which saves reserved sequences w/save.
+func newWatchHub(save func(seq uint64) error) *watchHub {
+	return &watchHub{
+		next:     1,
+		reserved: 1,
+		save:     save,
+		watchers: make(map[*watcher]bool),
+	}
+}
+
+// restore continues numbering events from the sequence saved in the meta DB.
+func (h *watchHub) restore(seq uint64) {
+	h.Lock()
+	defer h.Unlock()
+
+	if seq > h.next {
+		h.next = seq
+		h.reserved = seq
+	}
+}
+
+// stop saves the exact sequence of the next event, so that watchers can resume
+// seamlessly after a restart.
+func (h *watchHub) stop() error {
+	h.Lock()
+	defer h.Unlock()
+
+	h.reserved = h.next
+	return h.save(h.next)
+}
+
+// publish numbers an event and sends it to the watchers of its tree. A
+// watcher whose queue is full is cut off rather than holding up the tree.
+func (h *watchHub) publish(ev *universe.TreeEvent) {
+	h.Lock()
+	defer h.Unlock()
+
+	if h.next >= h.reserved {
+		err := h.save(h.next + watchReserve)
+		if err != nil {
+			log.Printf("WatchTree: could not reserve event sequences: %v", err)
+		} else {
+			h.reserved = h.next + watchReserve
+		}
+	}
+	ev.Sequence = h.next
+	h.next++
+
+	h.backlog = append(h.backlog, ev)
+	if len(h.backlog) > 2*watchBacklog {
+		h.backlog = append([]*universe.TreeEvent(nil), h.backlog[len(h.backlog)-watchBacklog:]...)
+	}
+
+	for w := range h.watchers {
+		if w.treeName != "" && w.treeName != ev.TreeName {
+			continue
+		}
+		select {
+		case w.events <- ev:
+		default:
+			close(w.events)
+			delete(h.watchers, w)
+		}
+	}
+}
+
+// subscribe adds a watcher of treeName. With from set, the events since that
+// sequence are returned to be sent first. It also returns the sequence to
+// resume from if no event is received.
+func (h *watchHub) subscribe(treeName string, from uint64) (*watcher, []*universe.TreeEvent, uint64, error) {
+	h.Lock()
+	defer h.Unlock()
+
+	var backlog []*universe.TreeEvent
+	if from != 0 {
+		oldest := h.next
+		if len(h.backlog) != 0 {
+			oldest = h.backlog[0].Sequence
+		}
+		if from < oldest {
+			return nil, nil, 0, status.Errorf(codes.OutOfRange, "events before sequence [%d] are no longer available, re-read the tree", oldest)
+		}
+		if from > h.next {
+			return nil, nil, 0, status.Errorf(codes.OutOfRange, "sequence [%d] is past the next event [%d], re-read the tree", from, h.next)
+		}
+		for _, ev := range h.backlog {
+			if ev.Sequence >= from && (treeName == "" || ev.TreeName == treeName) {
+				backlog = append(backlog, ev)
+			}
+		}
+	} else {
+		from = h.next
+	}
+
+	w := &watcher{
+		treeName: treeName,
+		events:   make(chan *universe.TreeEvent, watchBuffer),
+	}
+	h.watchers[w] = true
+	return w, backlog, from, nil
+}
+
+// unsubscribe removes a watcher.
+func (h *watchHub) unsubscribe(w *watcher) {
+	h.Lock()
+	defer h.Unlock()
+
+	delete(h.watchers, w)
+}
+
+// notify publishes an event about a change of a tree.
+func (s *universeTrieServer) notify(treeName string, op universe.TreeOperation, oldRoot, newRoot []byte) {
+	countOperation(treeName, op)
+	s.watch.publish(&universe.TreeEvent{
+		TreeName:  treeName,
+		Operation: op,
+		OldRoot:   oldRoot,
+		NewRoot:   newRoot,
+		Timestamp: time.Now().Unix(),
+	})
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"testing"
+
+	"github.com/dashevo/universe-tree-db/universe"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestWatchCommit(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	s := openTestServer(t, dir)
+	defer closeTestServer(s)
+	ctx := context.Background()
+
+	_, err := s.CreateTree(ctx, &universe.CreateTreeRequest{Name: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.CreateTree(ctx, &universe.CreateTreeRequest{Name: "y"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, _, _, err := s.watch.subscribe("x", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.watch.unsubscribe(w)
+
+	update(t, s, "y", testPairs(10, 100))
+	root := update(t, s, "x", testPairs(10, 0))
+	_, err = s.Commit(ctx, &universe.CommitRequest{TreeName: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// only the events of the watched tree, in order
+	for _, op := range []universe.TreeOperation{universe.TreeOperation_UPDATE, universe.TreeOperation_COMMIT} {
+		select {
+		case ev := <-w.events:
+			if ev.TreeName != "x" || ev.Operation != op || !bytes.Equal(ev.NewRoot, root) {
+				t.Errorf("got event %v, expected %v of tree [x] to root [%x]", ev, op, root)
+			}
+		default:
+			t.Fatalf("no %v event", op)
+		}
+	}
+	select {
+	case ev := <-w.events:
+		t.Errorf("got unexpected event %v", ev)
+	default:
+	}
+}
+
+func TestWatchSlowSubscriber(t *testing.T) {
+	h := newWatchHub(func(uint64) error { return nil })
+	slow, _, _, _ := h.subscribe("", 0)
+	fast, _, _, _ := h.subscribe("", 0)
+
+	for i := 0; i <= watchBuffer; i++ {
+		h.publish(&universe.TreeEvent{TreeName: "x"})
+		<-fast.events
+	}
+
+	// the slow watcher gets the events queued before it was cut off
+	n := 0
+	for range slow.events {
+		n++
+	}
+	if n != watchBuffer {
+		t.Errorf("slow watcher got %d events, expected %d", n, watchBuffer)
+	}
+	if h.watchers[slow] || !h.watchers[fast] {
+		t.Error("expected only the slow watcher to be cut off")
+	}
+}
+
+func TestWatchResume(t *testing.T) {
+	h := newWatchHub(func(uint64) error { return nil })
+	for i := 0; i < 2*watchBacklog+1; i++ {
+		h.publish(&universe.TreeEvent{TreeName: "x"})
+	}
+	next := uint64(2*watchBacklog + 2)
+
+	tests := []struct {
+		name    string
+		from    uint64
+		backlog int
+		code    codes.Code
+	}{
+		{"recent", next - 10, 10, codes.OK},
+		{"next", next, 0, codes.OK},
+		{"trimmed", 1, 0, codes.OutOfRange},
+		{"future", next + 1, 0, codes.OutOfRange},
+	}
+	for _, tt := range tests {
+		w, backlog, from, err := h.subscribe("x", tt.from)
+		if code := status.Code(err); code != tt.code || len(backlog) != tt.backlog {
+			t.Errorf("%s: got code %v w/%d events, expected %v w/%d", tt.name, code, len(backlog), tt.code, tt.backlog)
+		}
+		if err != nil {
+			continue
+		}
+		if from != tt.from || (len(backlog) != 0 && backlog[0].Sequence != tt.from) {
+			t.Errorf("%s: got resume sequence %d, expected %d", tt.name, from, tt.from)
+		}
+		h.unsubscribe(w)
+	}
+}
+
+func TestWatchRestart(t *testing.T) {
+	dir := testDir(t)
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+
+	s := openTestServer(t, dir)
+	_, err := s.CreateTree(ctx, &universe.CreateTreeRequest{Name: "x"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	update(t, s, "x", testPairs(10, 0))
+	s.watch.Lock()
+	next := s.watch.next
+	s.watch.Unlock()
+	closeTestServer(s)
+
+	// a watcher resumes from the next sequence w/o missing an event
+	s = openTestServer(t, dir)
+	w, backlog, from, err := s.watch.subscribe("x", next)
+	if err != nil || len(backlog) != 0 || from != next {
+		t.Fatalf("got %d events and sequence %d, err: %v, expected to resume from %d", len(backlog), from, err, next)
+	}
+	update(t, s, "x", testPairs(10, 100))
+	ev := <-w.events
+	if ev.Sequence != next {
+		t.Errorf("got sequence %d after a restart, expected %d", ev.Sequence, next)
+	}
+	s.watch.unsubscribe(w)
+
+	// after a crash the sequences go on past all those handed out
+	crashTestServer(s)
+	s = openTestServer(t, dir)
+	defer closeTestServer(s)
+	update(t, s, "x", testPairs(10, 200))
+	s.watch.Lock()
+	last := s.watch.backlog[len(s.watch.backlog)-1].Sequence
+	s.watch.Unlock()
+	if last <= ev.Sequence {
+		t.Errorf("got sequence %d after a crash, expected more than %d", last, ev.Sequence)
+	}
+	_, _, _, err = s.watch.subscribe("x", ev.Sequence)
+	if code := status.Code(err); code != codes.OutOfRange {
+		t.Errorf("resuming from before the crash: got code %v, expected %v", code, codes.OutOfRange)
+	}
+}
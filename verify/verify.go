@@ -0,0 +1,334 @@
+// Package verify checks Merkle proofs produced by the universe tree DB
+// without a server or database, e.g. in light clients.
+//
+// The checks are the same as the ones done by the Aergo State Trie
+// (github.com/aergoio/aergo/pkg/trie). Unlike the trie, malformed proofs are
+// rejected instead of causing a panic.
+package verify
+
+import (
+	"bytes"
+	"sort"
+
+	"github.com/dashevo/universe-tree-db/universe"
+)
+
+// HashFunc is the hash function of the tree a proof was made from. It must
+// hash the concatenation of its inputs, like the hashes of the server.
+type HashFunc func(data ...[]byte) []byte
+
+// defaultLeaf is the value of an empty subtree in the trie.
+var defaultLeaf = []byte{0}
+
+// MerkleProof verifies a proof of inclusion or non-inclusion of key in the
+// tree at root, as returned by the MerkleProof RPCs.
+func MerkleProof(root []byte, hash HashFunc, key []byte, mp *universe.MerkleProof) bool {
+	if mp.GetIncluded() {
+		return Inclusion(root, hash, mp.GetAuditPath(), key, mp.GetProofValue())
+	}
+	return NonInclusion(root, hash, mp.GetAuditPath(), key, mp.GetProofValue(), mp.GetProofKey())
+}
+
+// MerkleProofCompressed verifies a compressed proof of inclusion or
+// non-inclusion of key in the tree at root, as returned by the
+// MerkleProofCompressed RPCs.
+func MerkleProofCompressed(root []byte, hash HashFunc, key []byte, mp *universe.MerkleProofCompressed) bool {
+	if mp.GetIncluded() {
+		return InclusionC(root, hash, mp.GetBitmap(), key, mp.GetProofValue(), mp.GetAuditPath(), int(mp.GetHeight()))
+	}
+	return NonInclusionC(root, hash, mp.GetAuditPath(), int(mp.GetHeight()), mp.GetBitmap(), key, mp.GetProofValue(), mp.GetProofKey())
+}
+
+// BatchMerkleProof verifies a proof of the inclusion or non-inclusion of keys
+// in the tree at root, as returned by the BatchMerkleProof RPC. It returns the
+// values of the keys in the order given, nil for keys which aren't included,
+// and false if the proof is invalid.
+func BatchMerkleProof(root []byte, hash HashFunc, keys [][]byte, bp *universe.BatchMerkleProof) ([][]byte, bool) {
+	if len(keys) == 0 {
+		return nil, false
+	}
+	height := trieHeight(hash)
+	sorted := make([][]byte, len(keys))
+	copy(sorted, keys)
+	for _, key := range sorted {
+		if len(key)*8 != height {
+			return nil, false
+		}
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return bytes.Compare(sorted[i], sorted[j]) < 0
+	})
+	unique := sorted[:1]
+	for _, key := range sorted[1:] {
+		if !bytes.Equal(key, unique[len(unique)-1]) {
+			unique = append(unique, key)
+		}
+	}
+
+	v := &batchVerifier{
+		hash:   hash,
+		height: height,
+		proof:  bp,
+		values: make(map[string][]byte),
+	}
+	got, ok := v.node(unique, 0)
+	if !ok || !v.done() {
+		return nil, false
+	}
+	if len(root) == 0 {
+		// an empty tree
+		root = defaultLeaf
+	}
+	if !bytes.Equal(root, got) {
+		return nil, false
+	}
+	values := make([][]byte, len(keys))
+	for i, key := range keys {
+		values[i] = v.values[string(key)]
+	}
+	return values, true
+}
+
+// batchVerifier computes the root of a batch proof, reading the proof in the
+// order it was written.
+type batchVerifier struct {
+	hash   HashFunc
+	height int
+	proof  *universe.BatchMerkleProof
+	// positions of the next items of the proof
+	branch, sibling, auditPath, leaf int
+	// values of the included keys
+	values map[string][]byte
+}
+
+// node returns the hash of the node at depth on the paths of keys, which are
+// sorted and share the path up to depth.
+func (v *batchVerifier) node(keys [][]byte, depth int) ([]byte, bool) {
+	branch, ok := nextBit(v.proof.GetBranches(), &v.branch)
+	if !ok {
+		return nil, false
+	}
+	if !branch {
+		return v.leafNode(keys, depth)
+	}
+	if depth == v.height {
+		return nil, false
+	}
+
+	split := sort.Search(len(keys), func(i int) bool {
+		return bitIsSet(keys[i], depth)
+	})
+	left, right := keys[:split], keys[split:]
+	var lnode, rnode []byte
+	ok = true
+	switch {
+	case len(left) == 0:
+		lnode, ok = v.siblingNode()
+	case len(right) == 0:
+		rnode, ok = v.siblingNode()
+	}
+	if ok && len(left) != 0 {
+		lnode, ok = v.node(left, depth+1)
+	}
+	if ok && len(right) != 0 {
+		rnode, ok = v.node(right, depth+1)
+	}
+	if !ok {
+		return nil, false
+	}
+	return v.hash(lnode, rnode), true
+}
+
+// leafNode returns the hash of the leaf or empty subtree the paths of keys
+// end in.
+func (v *batchVerifier) leafNode(keys [][]byte, depth int) ([]byte, bool) {
+	leaves := v.proof.GetLeaves()
+	if v.leaf == len(leaves) {
+		return nil, false
+	}
+	leaf := leaves[v.leaf]
+	v.leaf++
+
+	key, value := leaf.GetKey(), leaf.GetValue()
+	if len(value) == 0 {
+		if len(key) != 0 {
+			return nil, false
+		}
+		return defaultLeaf, true
+	}
+	if len(key) == 0 {
+		key = keys[0]
+	}
+	if len(key)*8 != v.height {
+		return nil, false
+	}
+	// the leaf must be on the path so far
+	for b := 0; b < depth; b++ {
+		if bitIsSet(key, b) != bitIsSet(keys[0], b) {
+			return nil, false
+		}
+	}
+	for _, k := range keys {
+		if bytes.Equal(k, key) {
+			v.values[string(k)] = value
+		}
+	}
+	return v.hash(key, value, []byte{byte(v.height - depth)}), true
+}
+
+// siblingNode returns the hash of the next sibling which is on no path.
+func (v *batchVerifier) siblingNode() ([]byte, bool) {
+	set, ok := nextBit(v.proof.GetBitmap(), &v.sibling)
+	if !ok {
+		return nil, false
+	}
+	if !set {
+		return defaultLeaf, true
+	}
+	ap := v.proof.GetAuditPath()
+	if v.auditPath == len(ap) {
+		return nil, false
+	}
+	v.auditPath++
+	return ap[v.auditPath-1], true
+}
+
+// done reports whether the whole proof was read.
+func (v *batchVerifier) done() bool {
+	bp := v.proof
+	return len(bp.GetBranches()) == (v.branch+7)/8 &&
+		len(bp.GetBitmap()) == (v.sibling+7)/8 &&
+		len(bp.GetAuditPath()) == v.auditPath &&
+		len(bp.GetLeaves()) == v.leaf
+}
+
+// nextBit reads the bit at *i from bits and advances *i.
+func nextBit(bits []byte, i *int) (bool, bool) {
+	if *i >= len(bits)*8 {
+		return false, false
+	}
+	set := bitIsSet(bits, *i)
+	*i++
+	return set, true
+}
+
+// Inclusion verifies that key/value is included in the tree at root.
+func Inclusion(root []byte, hash HashFunc, ap [][]byte, key, value []byte) bool {
+	if len(ap) > len(key)*8 {
+		return false
+	}
+	leafHash := hash(key, value, []byte{byte(trieHeight(hash) - len(ap))})
+	return bytes.Equal(root, verifyInclusion(hash, ap, 0, key, leafHash))
+}
+
+// NonInclusion verifies that key is not included in the tree at root. The
+// value and proofKey are those of the leaf found on the path of key, if any.
+func NonInclusion(root []byte, hash HashFunc, ap [][]byte, key, value, proofKey []byte) bool {
+	if len(ap) > len(key)*8 {
+		return false
+	}
+	// Check if an empty subtree is on the key path
+	if len(proofKey) == 0 {
+		// return true if a DefaultLeaf in the key path is included in the trie
+		return bytes.Equal(root, verifyInclusion(hash, ap, 0, key, defaultLeaf))
+	}
+	// Check if another kv leaf is on the key path in 2 steps
+	// 1- Check the proof leaf exists
+	if !Inclusion(root, hash, ap, proofKey, value) {
+		return false
+	}
+	// 2- Check the proof leaf is on the key path
+	for b := 0; b < len(ap); b++ {
+		if bitIsSet(key, b) != bitIsSet(proofKey, b) {
+			return false
+		}
+	}
+	return true
+}
+
+// InclusionC verifies that key/value is included in the tree at root using a
+// compressed proof.
+func InclusionC(root []byte, hash HashFunc, bitmap, key, value []byte, ap [][]byte, length int) bool {
+	if !validCompressed(bitmap, key, ap, length) {
+		return false
+	}
+	leafHash := hash(key, value, []byte{byte(trieHeight(hash) - length)})
+	return bytes.Equal(root, verifyInclusionC(hash, bitmap, key, leafHash, ap, length, 0, 0))
+}
+
+// NonInclusionC verifies that key is not included in the tree at root using a
+// compressed proof. The value and proofKey are those of the leaf found on the
+// path of key, if any.
+func NonInclusionC(root []byte, hash HashFunc, ap [][]byte, length int, bitmap, key, value, proofKey []byte) bool {
+	if !validCompressed(bitmap, key, ap, length) {
+		return false
+	}
+	// Check if an empty subtree is on the key path
+	if len(proofKey) == 0 {
+		return bytes.Equal(root, verifyInclusionC(hash, bitmap, key, defaultLeaf, ap, length, 0, 0))
+	}
+	// Check the proof leaf exists and is on the key path
+	if !InclusionC(root, hash, bitmap, proofKey, value, ap, length) {
+		return false
+	}
+	for b := 0; b < length; b++ {
+		if bitIsSet(key, b) != bitIsSet(proofKey, b) {
+			return false
+		}
+	}
+	return true
+}
+
+// verifyInclusion returns the merkle root by hashing the merkle proof items.
+func verifyInclusion(hash HashFunc, ap [][]byte, keyIndex int, key, leafHash []byte) []byte {
+	if keyIndex == len(ap) {
+		return leafHash
+	}
+	if bitIsSet(key, keyIndex) {
+		return hash(ap[len(ap)-keyIndex-1], verifyInclusion(hash, ap, keyIndex+1, key, leafHash))
+	}
+	return hash(verifyInclusion(hash, ap, keyIndex+1, key, leafHash), ap[len(ap)-keyIndex-1])
+}
+
+// verifyInclusionC returns the merkle root by hashing the compressed merkle
+// proof items.
+func verifyInclusionC(hash HashFunc, bitmap, key, leafHash []byte, ap [][]byte, length, keyIndex, apIndex int) []byte {
+	if keyIndex == length {
+		return leafHash
+	}
+	if bitIsSet(key, keyIndex) {
+		if bitIsSet(bitmap, length-keyIndex-1) {
+			return hash(ap[len(ap)-apIndex-1], verifyInclusionC(hash, bitmap, key, leafHash, ap, length, keyIndex+1, apIndex+1))
+		}
+		return hash(defaultLeaf, verifyInclusionC(hash, bitmap, key, leafHash, ap, length, keyIndex+1, apIndex))
+	}
+	if bitIsSet(bitmap, length-keyIndex-1) {
+		return hash(verifyInclusionC(hash, bitmap, key, leafHash, ap, length, keyIndex+1, apIndex+1), ap[len(ap)-apIndex-1])
+	}
+	return hash(verifyInclusionC(hash, bitmap, key, leafHash, ap, length, keyIndex+1, apIndex), defaultLeaf)
+}
+
+// validCompressed checks the shape of a compressed proof, so that verifying
+// it can't index out of range.
+func validCompressed(bitmap, key []byte, ap [][]byte, length int) bool {
+	if length < 0 || length > len(key)*8 || length > len(bitmap)*8 {
+		return false
+	}
+	set := 0
+	for i := 0; i < length; i++ {
+		if bitIsSet(bitmap, i) {
+			set++
+		}
+	}
+	return set == len(ap)
+}
+
+// trieHeight returns the number of bits in a key of the trie, which is the
+// output length of its hash function.
+func trieHeight(hash HashFunc) int {
+	return len(hash([]byte("height"))) * 8
+}
+
+func bitIsSet(bits []byte, i int) bool {
+	return bits[i/8]&(1<<uint(7-i%8)) != 0
+}
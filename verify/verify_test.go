@@ -0,0 +1,154 @@
+package verify_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+
+	"github.com/aergoio/aergo-lib/db"
+	"github.com/aergoio/aergo/pkg/trie"
+	"github.com/dashevo/universe-tree-db/universe"
+	"github.com/dashevo/universe-tree-db/verify"
+)
+
+func hash(data ...[]byte) []byte {
+	h := sha256.New()
+	for _, d := range data {
+		h.Write(d)
+	}
+	return h.Sum(nil)
+}
+
+func key(i int) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(i))
+	return hash(b)
+}
+
+func TestVerify(t *testing.T) {
+	smt := trie.NewTrie(nil, hash, db.NewDB(db.MemoryImpl, ""))
+	var keys, values [][]byte
+	for i := 0; i < 100; i++ {
+		keys = append(keys, key(i))
+		values = append(values, hash(key(i)))
+	}
+	sortKeys(keys, values)
+	root, err := smt.Update(keys, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// present and absent keys
+	var probes [][]byte
+	probes = append(probes, keys...)
+	for i := 100; i < 200; i++ {
+		probes = append(probes, key(i))
+	}
+
+	for i, k := range probes {
+		ap, included, proofKey, proofValue, err := smt.MerkleProof(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mp := &universe.MerkleProof{AuditPath: ap, Included: included, ProofKey: proofKey, ProofValue: proofValue}
+		want := smt.VerifyNonInclusion(ap, k, proofValue, proofKey)
+		if included {
+			want = smt.VerifyInclusion(ap, k, proofValue)
+		}
+		if !want {
+			t.Fatalf("probe %d: aergo rejects its own proof", i)
+		}
+		if got := verify.MerkleProof(root, hash, k, mp); got != want {
+			t.Errorf("probe %d: got %v, expected %v", i, got, want)
+		}
+
+		bitmap, compAP, length, included, proofKey, proofValue, err := smt.MerkleProofCompressed(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		mpc := &universe.MerkleProofCompressed{Bitmap: bitmap, AuditPath: compAP, Height: uint32(length), Included: included, ProofKey: proofKey, ProofValue: proofValue}
+		want = smt.VerifyNonInclusionC(compAP, length, bitmap, k, proofValue, proofKey)
+		if included {
+			want = smt.VerifyInclusionC(bitmap, k, proofValue, compAP, length)
+		}
+		if !want {
+			t.Fatalf("probe %d: aergo rejects its own compressed proof", i)
+		}
+		if got := verify.MerkleProofCompressed(root, hash, k, mpc); got != want {
+			t.Errorf("probe %d: got %v, expected %v for compressed proof", i, got, want)
+		}
+
+		// a proof for another root, key or value must not verify
+		if verify.MerkleProof(hash(root), hash, k, mp) {
+			t.Errorf("probe %d: proof verifies against the wrong root", i)
+		}
+		if verify.MerkleProofCompressed(hash(root), hash, k, mpc) {
+			t.Errorf("probe %d: compressed proof verifies against the wrong root", i)
+		}
+		if included {
+			mp.ProofValue = hash(mp.ProofValue)
+			if verify.MerkleProof(root, hash, k, mp) != smt.VerifyInclusion(ap, k, mp.ProofValue) {
+				t.Errorf("probe %d: results differ for a wrong value", i)
+			}
+			mpc.ProofValue = mp.ProofValue
+			if verify.MerkleProofCompressed(root, hash, k, mpc) != smt.VerifyInclusionC(bitmap, k, mpc.ProofValue, compAP, length) {
+				t.Errorf("probe %d: results differ for a wrong compressed value", i)
+			}
+		}
+	}
+}
+
+func TestVerifyMalformed(t *testing.T) {
+	k := key(0)
+	tests := []struct {
+		name string
+		mp   *universe.MerkleProof
+		mpc  *universe.MerkleProofCompressed
+	}{
+		{"audit path longer than key", &universe.MerkleProof{AuditPath: make([][]byte, 257), Included: true}, nil},
+		{"height beyond bitmap", nil, &universe.MerkleProofCompressed{Bitmap: []byte{0xff}, Height: 16, Included: true}},
+		{"bitmap and audit path disagree", nil, &universe.MerkleProofCompressed{Bitmap: []byte{0xff}, AuditPath: [][]byte{k}, Height: 8}},
+		{"huge height", nil, &universe.MerkleProofCompressed{Height: ^uint32(0), Included: true}},
+	}
+
+	for _, tt := range tests {
+		if tt.mp != nil && verify.MerkleProof(k, hash, k, tt.mp) {
+			t.Errorf("%s: malformed proof verifies", tt.name)
+		}
+		if tt.mpc != nil && verify.MerkleProofCompressed(k, hash, k, tt.mpc) {
+			t.Errorf("%s: malformed compressed proof verifies", tt.name)
+		}
+	}
+
+	// the batch proof of an empty tree is one empty subtree
+	empty := []*universe.BatchMerkleProofLeaf{{}}
+	if _, ok := verify.BatchMerkleProof(nil, hash, [][]byte{k}, &universe.BatchMerkleProof{Branches: []byte{0}, Leaves: empty}); !ok {
+		t.Errorf("batch proof of an empty tree doesn't verify")
+	}
+	batchTests := []struct {
+		name string
+		bp   *universe.BatchMerkleProof
+	}{
+		{"no nodes", &universe.BatchMerkleProof{Leaves: empty}},
+		{"missing leaf", &universe.BatchMerkleProof{Branches: []byte{0}}},
+		{"trailing audit path", &universe.BatchMerkleProof{Branches: []byte{0}, Leaves: empty, AuditPath: [][]byte{k}}},
+		{"empty subtree w/key", &universe.BatchMerkleProof{Branches: []byte{0}, Leaves: []*universe.BatchMerkleProofLeaf{{Key: k}}}},
+		{"branches beyond key", &universe.BatchMerkleProof{Branches: bytes.Repeat([]byte{0xff}, 33), Leaves: empty}},
+	}
+	for _, tt := range batchTests {
+		if _, ok := verify.BatchMerkleProof(nil, hash, [][]byte{k}, tt.bp); ok {
+			t.Errorf("%s: malformed batch proof verifies", tt.name)
+		}
+	}
+}
+
+// sortKeys sorts the keys and values by key, as the trie expects.
+func sortKeys(keys, values [][]byte) {
+	for i := 1; i < len(keys); i++ {
+		for j := i; j > 0 && bytes.Compare(keys[j], keys[j-1]) < 0; j-- {
+			keys[j], keys[j-1] = keys[j-1], keys[j]
+			values[j], values[j-1] = values[j-1], values[j]
+		}
+	}
+}